@@ -53,6 +53,22 @@ func run() int {
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
+	// SIGUSR1 triggers an immediate poll of every agent.
+	pollChan := make(chan os.Signal, 1)
+	signal.Notify(pollChan, syscall.SIGUSR1)
+	defer signal.Stop(pollChan)
+	go func() {
+		for {
+			select {
+			case <-pollChan:
+				logger.Info("Received SIGUSR1, polling now")
+				app.PollNow()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
 	// Run the app in a separate goroutine
 	errChan := make(chan error, 1)
 	go func() {
@@ -69,7 +85,12 @@ func run() int {
 		}
 	case sig := <-sigChan:
 		logger.Info("Received signal, cancelling context", "signal", sig)
-		cancel()         // Cancel the context
+		cancel() // Cancel the context
+		// Let a package install in progress finish before exiting.
+		if err := app.Shutdown(); err != nil {
+			logger.Error("Shutdown drain failed", "error", err)
+			exitCode = 1
+		}
 		err := <-errChan // Wait for the app to finish
 		if err != nil {
 			logger.Error("App exited with error", "error", err)
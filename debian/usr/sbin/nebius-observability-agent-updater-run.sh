@@ -2,16 +2,8 @@
 set -ex
 UPDATER_ENDPOINT=observability-agent-manager.api.nebius.cloud
 
-METADATA_BASE_URL="http://metadata.nebius.internal"
-METADATA_FALLBACK_URL="http://169.254.169.254"
-METADATA_HEADER="Metadata: true"
-
-# Try to get updater endpoint override from IMDS
-OVERRIDE=$(curl -s -f -H "$METADATA_HEADER" "${METADATA_BASE_URL}/v1/instance-data/o11y/updater-endpoint-override" 2>/dev/null || \
-           curl -s -f -H "$METADATA_HEADER" "${METADATA_FALLBACK_URL}/v1/instance-data/o11y/updater-endpoint-override" 2>/dev/null || true)
-if [ -n "$OVERRIDE" ]; then
-    UPDATER_ENDPOINT="$OVERRIDE"
-fi
+# The updater itself applies the endpoint override from IMDS
+# (/v1/instance-data/o11y/updater-endpoint-override) and re-checks it at runtime.
 
 export GOMAXPROCS=1
 
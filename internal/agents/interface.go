@@ -1,8 +1,11 @@
 package agents
 
 import (
+	"context"
+
 	"github.com/nebius/gosdk/proto/nebius/logging/v1/agentmanager"
 	"github.com/nebius/nebius-observability-agent-updater/internal/healthcheck"
+	"github.com/nebius/nebius-observability-agent-updater/internal/osutils"
 )
 
 type AgentData interface {
@@ -11,9 +14,13 @@ type AgentData interface {
 	GetServiceName() string
 	GetEnvironmentFilePath() string
 	IsAgentHealthy() (bool, healthcheck.Response)
-	Update(updateRepoScriptPath string, version string) error
+	Update(ctx context.Context, protect osutils.Protect, updateRepoScriptPath string, version string) error
 	GetLastUpdateError() error
-	Restart() error
+	SetLastUpdateError(err error)
+	AddNotice(msg string)
+	PendingNotices() []string
+	RemoveNotices(delivered []string)
+	Restart(ctx context.Context) error
 	GetLastSeenConfigVersion() uint64
 	SetLastSeenConfigVersion(version uint64)
 }
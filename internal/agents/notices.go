@@ -0,0 +1,49 @@
+package agents
+
+import (
+	"slices"
+	"sync"
+)
+
+// maxNotices caps how many notices are kept between two reports so a backend
+// outage cannot grow the list without bound; the oldest are dropped first.
+const maxNotices = 20
+
+// noticeList collects one-off status messages (deferred actions, refused
+// restarts, ...) that the client reports with the next request. Notices are
+// removed once a report carrying them was delivered, so a condition that
+// persists is re-added by the poll that observes it, and a failed report
+// keeps them for the next one.
+type noticeList struct {
+	mu    sync.Mutex
+	items []string
+}
+
+func (n *noticeList) add(msg string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, existing := range n.items {
+		if existing == msg {
+			return
+		}
+	}
+	n.items = append(n.items, msg)
+	if len(n.items) > maxNotices {
+		n.items = n.items[len(n.items)-maxNotices:]
+	}
+}
+
+func (n *noticeList) pending() []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]string(nil), n.items...)
+}
+
+// remove drops the delivered notices, keeping those added since.
+func (n *noticeList) remove(delivered []string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.items = slices.DeleteFunc(n.items, func(item string) bool {
+		return slices.Contains(delivered, item)
+	})
+}
@@ -1,11 +1,14 @@
 package agents
 
 import (
+	"context"
+	"fmt"
 	"log/slog"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/nebius/gosdk/proto/nebius/logging/v1/agentmanager"
@@ -20,13 +23,26 @@ import (
 // re-sends the version. Declared as var so tests can shorten it.
 var stateIOTimeout = 5 * time.Second
 
+// packageManager is the part of osutils.OsHelper that installs and restarts
+// the agent.
+type packageManager interface {
+	UpdateRepo(ctx context.Context, scriptPath string) error
+	RepairDpkg(ctx context.Context, protect osutils.Protect) (string, error)
+	InstallPackage(ctx context.Context, protect osutils.Protect, packageName string, version string) error
+	RestartService(ctx context.Context, serviceName string) error
+}
+
 type O11yagent struct {
+	// mu guards lastUpdateError, which is set by installs running on the
+	// update worker and read by reports from the poll loop.
+	mu                    sync.Mutex
 	lastUpdateError       error
+	notices               noticeList
 	lastSeenConfigVersion uint64
 	stateFilePath         string
 	logger                *slog.Logger
 	fileGuard             *osutils.FileGuard
-	oh                    *osutils.OsHelper
+	oh                    packageManager
 }
 
 func NewO11yagent(stateDir string, logger *slog.Logger, fileGuard *osutils.FileGuard) *O11yagent {
@@ -86,26 +102,73 @@ func (o *O11yagent) IsAgentHealthy() (isHealthy bool, response healthcheck.Respo
 	return healthcheck.CheckHealthWithReasons(o.GetHealthCheckUrl())
 }
 
-func (o *O11yagent) Update(updateRepoScriptPath string, version string) error {
-	err := o.oh.UpdateRepo(updateRepoScriptPath)
-	if err != nil {
-		o.lastUpdateError = err
-		return err
+// Update refreshes the package lists and installs version. Only the steps
+// that change the installed packages run through protect; the lock waits and
+// the repository refresh stop as soon as ctx is cancelled. A dpkg repair
+// before the install is part of the reported update error, and stays
+// reported after a successful install until the next one.
+func (o *O11yagent) Update(ctx context.Context, protect osutils.Protect, updateRepoScriptPath string, version string) error {
+	var repaired string
+	err := o.oh.UpdateRepo(ctx, updateRepoScriptPath)
+	if err == nil {
+		repaired, err = o.repairDpkg(ctx, protect)
+	}
+	if err == nil {
+		err = o.oh.InstallPackage(ctx, protect, o.GetDebPackageName(), version)
 	}
+	switch {
+	case repaired == "":
+		o.SetLastUpdateError(err)
+	case err != nil:
+		err = fmt.Errorf("%w (after repairing dpkg with dpkg --configure -a: %s)", err, repaired)
+		o.SetLastUpdateError(err)
+	default:
+		o.SetLastUpdateError(fmt.Errorf("installed %s after repairing dpkg with dpkg --configure -a: %s", version, repaired))
+	}
+	return err
+}
 
-	err = o.oh.InstallPackage(o.GetDebPackageName(), version)
+// repairDpkg finishes an interrupted dpkg run before installing, since apt
+// refuses to install until it is, and returns what it repaired. A failed
+// repair is returned and so becomes the update error.
+func (o *O11yagent) repairDpkg(ctx context.Context, protect osutils.Protect) (string, error) {
+	problems, err := o.oh.RepairDpkg(ctx, protect)
 	if err != nil {
-		o.lastUpdateError = err
-		return err
+		o.logger.Error("failed to repair dpkg before install", "problems", problems, "error", err)
+		return "", err
 	}
-	o.lastUpdateError = nil
-	return nil
+	if problems != "" {
+		o.logger.Warn("repaired dpkg before install", "problems", problems)
+	}
+	return problems, nil
 }
 
 func (o *O11yagent) GetLastUpdateError() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
 	return o.lastUpdateError
 }
 
+// SetLastUpdateError overrides the error reported to the backend, e.g. when a
+// successful install was rolled back because the new version never came up.
+func (o *O11yagent) SetLastUpdateError(err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.lastUpdateError = err
+}
+
+func (o *O11yagent) AddNotice(msg string) {
+	o.notices.add(msg)
+}
+
+func (o *O11yagent) PendingNotices() []string {
+	return o.notices.pending()
+}
+
+func (o *O11yagent) RemoveNotices(delivered []string) {
+	o.notices.remove(delivered)
+}
+
 func (o *O11yagent) GetLastSeenConfigVersion() uint64 {
 	return o.lastSeenConfigVersion
 }
@@ -117,6 +180,6 @@ func (o *O11yagent) SetLastSeenConfigVersion(version uint64) {
 	}
 }
 
-func (o *O11yagent) Restart() error {
-	return o.oh.RestartService(o.GetServiceName())
+func (o *O11yagent) Restart(ctx context.Context) error {
+	return o.oh.RestartService(ctx, o.GetServiceName())
 }
@@ -1,6 +1,7 @@
 package agents
 
 import (
+	"context"
 	"io"
 	"log/slog"
 	"os"
@@ -70,3 +71,72 @@ func TestO11yagent_HungDiskDoesNotBlockStartup(t *testing.T) {
 		t.Fatal("NewO11yagent hung on unresponsive state file")
 	}
 }
+
+func TestO11yagent_NoticesAreDeduplicatedAndRemovedOnceDelivered(t *testing.T) {
+	agent := NewO11yagent(t.TempDir(), discardLogger(), testGuard())
+	agent.AddNotice("restart deferred")
+	agent.AddNotice("restart deferred")
+	agent.AddNotice("update deferred")
+
+	sent := agent.PendingNotices()
+	assert.Equal(t, []string{"restart deferred", "update deferred"}, sent)
+	assert.Equal(t, sent, agent.PendingNotices(), "notices are kept until delivered")
+
+	agent.AddNotice("backend unreachable")
+	agent.RemoveNotices(sent)
+	assert.Equal(t, []string{"backend unreachable"}, agent.PendingNotices(), "notices added since the report are kept")
+}
+
+// fakePackageManager repairs dpkg if repaired is set and fails installs with
+// installErr.
+type fakePackageManager struct {
+	repaired   string
+	installErr error
+}
+
+func (f fakePackageManager) UpdateRepo(context.Context, string) error { return nil }
+
+func (f fakePackageManager) RepairDpkg(context.Context, osutils.Protect) (string, error) {
+	return f.repaired, nil
+}
+
+func (f fakePackageManager) InstallPackage(context.Context, osutils.Protect, string, string) error {
+	return f.installErr
+}
+
+func (f fakePackageManager) RestartService(context.Context, string) error { return nil }
+
+func TestO11yagent_UpdateReportsDpkgRepair(t *testing.T) {
+	installErr := &osutils.AptError{Code: osutils.AptErrorNetwork, Package: "nebius-observability-agent=1.0.1"}
+	tests := []struct {
+		name     string
+		pm       fakePackageManager
+		wantErr  bool
+		reported string
+	}{
+		{name: "nothing to repair", pm: fakePackageManager{}},
+		{name: "install after repair", pm: fakePackageManager{repaired: "dpkg was interrupted"},
+			reported: "installed 1.0.1 after repairing dpkg with dpkg --configure -a: dpkg was interrupted"},
+		{name: "failed install after repair", pm: fakePackageManager{repaired: "dpkg was interrupted", installErr: installErr}, wantErr: true,
+			reported: installErr.Error() + " (after repairing dpkg with dpkg --configure -a: dpkg was interrupted)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			agent := NewO11yagent(t.TempDir(), discardLogger(), testGuard())
+			agent.oh = tt.pm
+
+			err := agent.Update(context.Background(), nil, "/usr/sbin/update-repo.sh", "1.0.1")
+			if tt.wantErr {
+				var aptErr *osutils.AptError
+				assert.ErrorAs(t, err, &aptErr, "the install error stays classifiable")
+			} else {
+				assert.NoError(t, err)
+			}
+			if tt.reported == "" {
+				assert.NoError(t, agent.GetLastUpdateError())
+			} else {
+				assert.EqualError(t, agent.GetLastUpdateError(), tt.reported)
+			}
+		})
+	}
+}
@@ -2,24 +2,29 @@ package application
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"math/rand"
-	"os"
-	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/nebius/gosdk/proto/nebius/logging/v1/agentmanager"
 	"github.com/nebius/nebius-observability-agent-updater/internal/agents"
 	"github.com/nebius/nebius-observability-agent-updater/internal/config"
+	"github.com/nebius/nebius-observability-agent-updater/internal/envfile"
+	"github.com/nebius/nebius-observability-agent-updater/internal/journal"
 	"github.com/nebius/nebius-observability-agent-updater/internal/osutils"
+	"github.com/nebius/nebius-observability-agent-updater/internal/policy"
+	"github.com/nebius/nebius-observability-agent-updater/internal/restartlimit"
+	"github.com/nebius/nebius-observability-agent-updater/internal/updateattempts"
+	"github.com/nebius/nebius-observability-agent-updater/internal/versionpolicy"
 )
 
-var validEnvKeyRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
-
 type App struct {
 	config    *config.Config
 	client    updaterClient
@@ -27,10 +32,24 @@ type App struct {
 	agents    []agents.AgentData
 	oh        oshelper
 	fileGuard *osutils.FileGuard
+	journal   *journal.Journal
+	restarts  *restartlimit.Limiter
+	attempts  *updateattempts.Tracker
+	policy    *policy.Engine
+	paused    atomic.Bool
+	// pollNow holds one wake channel per agent, indexed like agents.
+	pollNow  []chan struct{}
+	installs *installGuard
+	// updates holds the background update worker of each agent.
+	updates map[agents.AgentData]*updateWorker
+	// unloadedEnv holds the environment keys agents did not load on restart.
+	unloadedEnv unloadedEnv
 }
 
 const (
-	MinimalUptimeForUpdate = 15 * time.Minute
+	// freshBootUptime is the system uptime below which the node counts as
+	// just booted.
+	freshBootUptime = 15 * time.Minute
 	// restartGracePeriod prevents spurious restarts when file mtime is close to agent start time.
 	restartGracePeriod = 30 * time.Second
 )
@@ -41,123 +60,392 @@ const (
 var envFileIOTimeout = 5 * time.Second
 
 type updaterClient interface {
-	SendAgentData(agent agents.AgentData) (*agentmanager.GetVersionResponse, error)
+	SendAgentData(ctx context.Context, agent agents.AgentData) (*agentmanager.GetVersionResponse, error)
 	Close()
 }
 
 type oshelper interface {
-	GetSystemUptime() (time.Duration, error)
-	GetServiceUptime(serviceName string) (time.Duration, error)
+	policy.Probe
+	GetDebVersion(ctx context.Context, name string) (string, error)
+	GetServiceRestartCount(ctx context.Context, serviceName string) (int, error)
+	GetServiceEnviron(ctx context.Context, serviceName string) (map[string]string, error)
 }
 
 func New(config *config.Config, client updaterClient, logger *slog.Logger, agents []agents.AgentData, oh oshelper, fileGuard *osutils.FileGuard) *App {
-	app := &App{config: config, client: client, logger: logger, agents: agents, oh: oh, fileGuard: fileGuard}
+	app := &App{
+		config:    config,
+		client:    client,
+		logger:    logger,
+		agents:    agents,
+		oh:        oh,
+		fileGuard: fileGuard,
+		journal:   journal.New(config.StateDir, logger, fileGuard),
+		restarts:  restartlimit.New(config.RestartLimit, config.StateDir, oh, logger, fileGuard),
+		attempts:  updateattempts.New(config.UpdateAttempts, config.StateDir, logger, fileGuard),
+		policy:    policy.New(config.Policy, oh, logger),
+		pollNow:   make([]chan struct{}, len(agents)),
+		installs:  newInstallGuard(config.ShutdownDrainTimeout),
+		updates:   newUpdateWorkers(agents),
+	}
+	for i := range app.pollNow {
+		app.pollNow[i] = make(chan struct{}, 1)
+	}
 	return app
 }
 
-func (s *App) poll(agent agents.AgentData) {
+// poll reports agent state to the backend and applies the response. Plans
+// with a package install run on the agent's update worker; while it is busy
+// the agent keeps reporting and later responses are left for the poll after
+// it finished. It returns false if the backend could not be reached.
+func (s *App) poll(ctx context.Context, agent agents.AgentData) bool {
+	worker := s.updates[agent]
+	s.collectUpdate(agent, worker)
+	if job, ok := worker.current(); ok {
+		agent.AddNotice(job.progress())
+	}
+
 	s.logger.Info("Polling for ", "agent", agent.GetServiceName())
-	response, err := s.client.SendAgentData(agent)
+	response, err := s.client.SendAgentData(ctx, agent)
 	if err != nil {
 		s.logger.Error("Failed to send agent data", "error", err, "agent", agent.GetServiceName())
-		return
+		return false
 	}
 	s.logger.Debug("Received response", "response", response, "agent", agent.GetServiceName())
 
-	restarted := s.processFeatureFlags(response, agent)
-
-	if response.Action == agentmanager.Action_UPDATE {
-		s.Update(response, agent)
+	s.collectUpdate(agent, worker)
+	if job, ok := worker.current(); ok {
+		s.logger.Info("Update in progress, leaving response for a later poll", "version", job.version, "since", job.since, "agent", agent.GetServiceName())
+		return true
 	}
-	if response.Action == agentmanager.Action_RESTART && !restarted {
-		s.Restart(agent)
+
+	p, failed := s.plan(ctx, response, agent)
+	if p.install != nil && worker != nil {
+		job := &updateJob{
+			version:       p.install.targetVersion,
+			configVersion: response.GetConfigVersion(),
+			since:         time.Now(),
+			failed:        failed,
+		}
+		s.logger.Info("Starting background update", "version", job.version, "agent", agent.GetServiceName())
+		worker.start(job, func() stepErrors {
+			_, failed := s.execute(ctx, agent, p)
+			return failed
+		})
+		return true
 	}
+	_, execFailed := s.execute(ctx, agent, p)
+	s.acknowledge(agent, response.GetConfigVersion(), append(failed, execFailed...))
+	return true
+}
 
-	if cv := response.GetConfigVersion(); cv > agent.GetLastSeenConfigVersion() {
-		agent.SetLastSeenConfigVersion(cv)
+// collectUpdate picks up the result of a finished background update.
+func (s *App) collectUpdate(agent agents.AgentData, worker *updateWorker) {
+	job, ok := worker.takeFinished()
+	if !ok {
+		return
 	}
+	s.logger.Info("Background update finished", "version", job.version, "error", job.failed.err(), "agent", agent.GetServiceName())
+	s.acknowledge(agent, job.configVersion, job.failed)
 }
 
-func (s *App) Update(response *agentmanager.GetVersionResponse, agent agents.AgentData) {
-	systemUptime, err := s.oh.GetSystemUptime()
-	if err != nil {
-		s.logger.Error("Failed to get system uptime", "error", err)
-	} else if systemUptime < MinimalUptimeForUpdate {
-		s.logger.Info("System uptime is less than 15 minutes, skipping update", "system_uptime", systemUptime.String())
+// acknowledge stores cv as the last seen config version if it is newer and
+// nothing failed applying the response it came with. On failure the old
+// version is kept so the backend re-sends the response until it has been
+// applied, and the failed steps are reported.
+func (s *App) acknowledge(agent agents.AgentData, cv uint64, failed stepErrors) {
+	if cv <= agent.GetLastSeenConfigVersion() {
+		return
+	}
+	if len(failed) > 0 {
+		s.logger.Warn("Response not fully applied, not acknowledging config version",
+			"config_version", cv, "error", failed, "agent", agent.GetServiceName())
+		agent.AddNotice(fmt.Sprintf("config version %d not applied: %s", cv, failed))
 		return
 	}
+	if !s.mutationAllowed(agent, "acknowledged config version "+strconv.FormatUint(cv, 10)) {
+		return
+	}
+	start := time.Now()
+	previous := agent.GetLastSeenConfigVersion()
+	agent.SetLastSeenConfigVersion(cv)
+	s.journal.Record(agent.GetServiceName(), journal.ActionConfigAck, journal.TriggerServerAction, map[string]string{
+		"config_version":          strconv.FormatUint(cv, 10),
+		"previous_config_version": strconv.FormatUint(previous, 10),
+	}, start, nil)
+}
+
+// planInstall returns the install response asks for, or nil if it must not
+// run now. An error means the response cannot be acted on.
+func (s *App) planInstall(ctx context.Context, response *agentmanager.GetVersionResponse, agent agents.AgentData) (*installStep, error) {
 	updateData := response.GetUpdate()
 	if updateData == nil {
 		s.logger.Error("Received empty update data")
-		return
+		return nil, errors.New("empty update data")
 	}
-	s.logger.Info("Updating agent to version", "version", updateData.GetVersion(), "agent", agent.GetServiceName())
-	err = agent.Update(s.config.UpdateRepoScriptPath, updateData.GetVersion())
+	targetVersion := updateData.GetVersion()
+	err := s.attempts.Check(agent.GetServiceName(), targetVersion)
+	if errors.Is(err, updateattempts.ErrQuarantined) {
+		// Reported until the server asks for a different version.
+		s.logger.Warn("Target version is quarantined, skipping update", "error", err, "agent", agent.GetServiceName())
+		agent.SetLastUpdateError(err)
+		return nil, nil
+	}
+	s.clearQuarantineReport(agent)
 	if err != nil {
-		s.logger.Error("Failed to update agent", "error", err)
-		return
+		s.logger.Info("Backing off after failed update", "error", err, "agent", agent.GetServiceName())
+		agent.AddNotice(err.Error())
+		return nil, nil
+	}
+	if !s.policyAllows(ctx, agent, policy.ActionInstall, "update to "+targetVersion) {
+		return nil, nil
 	}
+	if !s.inMaintenanceWindow(agent, "update to "+targetVersion) {
+		return nil, nil
+	}
+	previousVersion, err := s.oh.GetDebVersion(ctx, agent.GetDebPackageName())
+	if err != nil {
+		// Not installed (or unknown): the update proceeds, but there is nothing to roll back to.
+		s.logger.Info("Could not determine installed agent version, rollback will be unavailable", "error", err, "agent", agent.GetServiceName())
+		previousVersion = ""
+	}
+	if err := s.versionPolicyAllows(agent, targetVersion, previousVersion); err != nil {
+		// Re-reported by every poll that is refused, so the report stops once
+		// the server asks for an allowed version or the policy changes.
+		s.logger.Warn("Skipping update refused by local version policy", "error", err, "version", targetVersion, "agent", agent.GetServiceName())
+		agent.AddNotice(fmt.Sprintf("update to %s: %s", targetVersion, err))
+		return nil, nil
+	}
+	if !s.mutationAllowed(agent, "updated agent to "+targetVersion) {
+		return nil, nil
+	}
+	return &installStep{targetVersion: targetVersion, previousVersion: previousVersion}, nil
 }
 
-func (s *App) Restart(agent agents.AgentData) {
-	s.logger.Info("Restarting agent", "agent", agent.GetServiceName())
-	err := agent.Restart()
+// versionPolicyAllows checks targetVersion against the local version policy,
+// which is re-read so a node can be frozen without restarting the updater. An
+// unreadable policy refuses the update rather than ignoring the pins.
+func (s *App) versionPolicyAllows(agent agents.AgentData, targetVersion, installedVersion string) error {
+	p, err := versionpolicy.Load(s.fileGuard, s.config.VersionPolicyPath)
 	if err != nil {
-		s.logger.Error("Failed to restart agent", "error", err)
-		return
+		return fmt.Errorf("%w: %w", versionpolicy.ErrRejected, err)
 	}
+	return p.Check(agent.GetDebPackageName(), targetVersion, installedVersion)
 }
 
-// needsQuoting returns true if a value contains characters that require
-// double-quoting in a systemd EnvironmentFile (spaces, quotes, backslashes,
-// or leading/trailing whitespace).
-func needsQuoting(v string) bool {
-	if v == "" {
-		return false
-	}
-	if v[0] == ' ' || v[0] == '\t' || v[len(v)-1] == ' ' || v[len(v)-1] == '\t' {
-		return true
+// install runs step.
+func (s *App) install(ctx context.Context, agent agents.AgentData, step *installStep) error {
+	s.logger.Info("Updating agent to version", "version", step.targetVersion, "previous_version", step.previousVersion, "agent", agent.GetServiceName())
+	start := time.Now()
+	err := agent.Update(ctx, s.installs.run, s.config.UpdateRepoScriptPath, step.targetVersion)
+	s.journal.Record(agent.GetServiceName(), journal.ActionInstall, journal.TriggerServerAction, map[string]string{
+		"target_version":   step.targetVersion,
+		"previous_version": step.previousVersion,
+	}, start, err)
+	if err != nil {
+		s.logger.Error("Failed to update agent", "error", err)
+		var aptErr *osutils.AptError
+		if ctx.Err() == nil && errors.As(err, &aptErr) && aptErr.PackageFault() {
+			s.attempts.RecordFailure(agent.GetServiceName(), step.targetVersion, time.Now(), err)
+		} else {
+			s.logger.Info("Install failure not caused by the package, not counting it against the version", "version", step.targetVersion, "agent", agent.GetServiceName())
+		}
 	}
-	return strings.ContainsAny(v, ` "'`+"`"+`\$`)
+	return err
 }
 
-func generateEnvironmentFileContent(featureFlags map[string]string) string {
-	var sb strings.Builder
-	sb.WriteString("# Managed by agent updater. Variables are loaded as env vars at agent startup.\n")
+// clearQuarantineReport stops reporting a quarantined version once the server
+// no longer asks for it.
+func (s *App) clearQuarantineReport(agent agents.AgentData) {
+	if errors.Is(agent.GetLastUpdateError(), updateattempts.ErrQuarantined) {
+		agent.SetLastUpdateError(nil)
+	}
+}
 
-	if len(featureFlags) == 0 {
-		return sb.String()
+// verifyInstall checks the installed step and rolls back to the previous
+// version if it fails verification. The verification error is returned
+// whether or not the rollback succeeded.
+func (s *App) verifyInstall(ctx context.Context, agent agents.AgentData, step *installStep) error {
+	targetVersion, previousVersion := step.targetVersion, step.previousVersion
+	verifyErr := s.verifyUpdate(ctx, agent, targetVersion)
+	if verifyErr == nil {
+		s.attempts.RecordSuccess(agent.GetServiceName())
+		return nil
 	}
+	if ctx.Err() != nil {
+		// Interrupted by shutdown, not a verdict on the new version.
+		s.logger.Warn("Update verification interrupted, not rolling back", "error", verifyErr, "version", targetVersion, "agent", agent.GetServiceName())
+		return verifyErr
+	}
+	s.logger.Error("Updated agent failed verification", "error", verifyErr, "version", targetVersion, "agent", agent.GetServiceName())
+	s.attempts.RecordFailure(agent.GetServiceName(), targetVersion, time.Now(), verifyErr)
+	if previousVersion == "" || previousVersion == targetVersion {
+		agent.SetLastUpdateError(fmt.Errorf("update to %s failed verification, no previous version to roll back to: %w", targetVersion, verifyErr))
+		return verifyErr
+	}
+	s.rollback(ctx, agent, targetVersion, previousVersion, verifyErr)
+	return verifyErr
+}
 
-	keys := make([]string, 0, len(featureFlags))
-	for k := range featureFlags {
-		keys = append(keys, k)
+// verifyUpdate checks that the target version is actually installed and that
+// the agent stays healthy within the verification window: HealthyChecks
+// consecutive checks must pass with the systemd restart counter unchanged, so
+// an agent that comes up once and then crash-loops is not reported as updated.
+func (s *App) verifyUpdate(ctx context.Context, agent agents.AgentData, targetVersion string) error {
+	installedVersion, err := s.oh.GetDebVersion(ctx, agent.GetDebPackageName())
+	if err != nil {
+		return fmt.Errorf("failed to get installed version: %w", err)
+	}
+	if installedVersion != targetVersion {
+		return fmt.Errorf("installed version %s does not match target %s", installedVersion, targetVersion)
 	}
-	sort.Strings(keys)
 
-	for _, k := range keys {
-		v := featureFlags[k]
-		if needsQuoting(v) {
-			v = `"` + strings.ReplaceAll(strings.ReplaceAll(v, `\`, `\\`), `"`, `\"`) + `"`
+	window := s.config.UpdateVerification.Window
+	if window <= 0 {
+		return nil
+	}
+	interval := s.config.UpdateVerification.CheckInterval
+	if interval <= 0 {
+		interval = window
+	}
+	required := max(s.config.UpdateVerification.HealthyChecks, 1)
+	deadline := time.Now().Add(window)
+	var reasons []string
+	streak, lastRestarts := 0, 0
+	for {
+		healthy, health := agent.IsAgentHealthy()
+		if !healthy {
+			streak = 0
+			reasons = health.Reasons
+		} else {
+			// With a single required check there is nothing to compare the
+			// restart counter with.
+			restarts := 0
+			if required > 1 {
+				if restarts, err = s.oh.GetServiceRestartCount(ctx, agent.GetServiceName()); err != nil {
+					s.logger.Warn("Failed to get agent restart count, relying on health checks only", "error", err, "agent", agent.GetServiceName())
+					restarts = lastRestarts
+				}
+			}
+			if streak > 0 && restarts != lastRestarts {
+				s.logger.Warn("Updated agent restarted during verification", "version", targetVersion, "restarts", restarts-lastRestarts, "agent", agent.GetServiceName())
+				streak = 0
+				reasons = []string{fmt.Sprintf("restarted %d times while reporting healthy", restarts-lastRestarts)}
+			}
+			streak++
+			lastRestarts = restarts
+			if streak >= required {
+				s.logger.Info("Updated agent is healthy", "version", targetVersion, "healthy_checks", streak, "agent", agent.GetServiceName())
+				return nil
+			}
+		}
+		if time.Now().Add(interval).After(deadline) {
+			break
+		}
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return ctx.Err()
 		}
-		fmt.Fprintf(&sb, "%s=%s\n", k, v)
 	}
-	return sb.String()
+	msg := fmt.Sprintf("agent unhealthy for %s after update", window)
+	if streak > 0 {
+		msg = fmt.Sprintf("agent healthy on only %d of %d consecutive checks within %s after update", streak, required, window)
+	}
+	if len(reasons) > 0 {
+		msg += ": " + strings.Join(reasons, "; ")
+	}
+	return errors.New(msg)
 }
 
-// stripComments removes comment lines (starting with #) and blank lines,
-// returning only the meaningful content for comparison.
-func stripComments(s string) string {
-	var sb strings.Builder
-	for _, line := range strings.Split(s, "\n") {
-		trimmed := strings.TrimSpace(line)
-		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
-			continue
+func (s *App) rollback(ctx context.Context, agent agents.AgentData, fromVersion, toVersion string, cause error) {
+	s.logger.Warn("Rolling back agent", "from_version", fromVersion, "to_version", toVersion, "agent", agent.GetServiceName())
+	start := time.Now()
+	err := agent.Update(ctx, s.installs.run, s.config.UpdateRepoScriptPath, toVersion)
+	s.journal.Record(agent.GetServiceName(), journal.ActionRollback, journal.TriggerVerification, map[string]string{
+		"from_version": fromVersion,
+		"to_version":   toVersion,
+		"cause":        cause.Error(),
+	}, start, err)
+	if err != nil {
+		s.logger.Error("Failed to roll back agent", "error", err, "agent", agent.GetServiceName())
+		agent.SetLastUpdateError(fmt.Errorf("rollback from %s to %s failed: %w (after: %w)", fromVersion, toVersion, err, cause))
+		return
+	}
+	agent.SetLastUpdateError(fmt.Errorf("rolled back from %s to %s: %w", fromVersion, toVersion, cause))
+}
+
+func (s *App) planRestart(ctx context.Context, agent agents.AgentData) bool {
+	return s.policyAllows(ctx, agent, policy.ActionRestart, "restart") &&
+		s.inMaintenanceWindow(agent, "restart") &&
+		s.mutationAllowed(agent, "restarted agent")
+}
+
+// restartAgent restarts agent unless the restart budget is exhausted or the
+// agent is crash-looping, in which case the refusal is reported and returned.
+// Every attempt is counted against the budget and journaled.
+func (s *App) restartAgent(ctx context.Context, agent agents.AgentData, trigger string) error {
+	if err := s.restarts.Check(ctx, agent.GetServiceName()); err != nil {
+		agent.AddNotice(err.Error())
+		return err
+	}
+	start := time.Now()
+	err := agent.Restart(ctx)
+	s.restarts.Record(agent.GetServiceName(), start)
+	s.journal.Record(agent.GetServiceName(), journal.ActionRestart, trigger, nil, start, err)
+	return err
+}
+
+// policyAllows reports whether the action policy permits action now. Like a
+// maintenance window deferral, a refusal is reported with the next request
+// and evaluated again by the next poll.
+func (s *App) policyAllows(ctx context.Context, agent agents.AgentData, action policy.Action, what string) bool {
+	err := s.policy.Check(ctx, action, agent.GetServiceName())
+	if err == nil {
+		return true
+	}
+	s.logger.Info("Action refused by policy, deferring", "action", what, "reason", err, "agent", agent.GetServiceName())
+	agent.AddNotice(what + " deferred: " + err.Error())
+	return false
+}
+
+// inMaintenanceWindow reports whether a mutating action may run now. Outside
+// the configured windows the action is deferred: nothing is done, the deferral
+// is reported with the next request, and the next poll evaluates it again.
+func (s *App) inMaintenanceWindow(agent agents.AgentData, action string) bool {
+	if s.config.MaintenanceWindows.IsOpen(time.Now()) {
+		return true
+	}
+	s.logger.Info("Outside maintenance window, deferring action", "action", action, "agent", agent.GetServiceName())
+	agent.AddNotice(action + " deferred: outside maintenance window")
+	return false
+}
+
+// flagDiff summarizes added, removed and changed keys between two flag sets
+// as comma-separated sorted lists, omitting empty categories.
+func flagDiff(oldFlags, newFlags map[string]string) map[string]string {
+	var added, removed, changed []string
+	for k, v := range newFlags {
+		oldValue, found := oldFlags[k]
+		switch {
+		case !found:
+			added = append(added, k)
+		case oldValue != v:
+			changed = append(changed, k)
 		}
-		sb.WriteString(line)
-		sb.WriteByte('\n')
 	}
-	return sb.String()
+	for k := range oldFlags {
+		if _, found := newFlags[k]; !found {
+			removed = append(removed, k)
+		}
+	}
+	diff := make(map[string]string)
+	for name, keys := range map[string][]string{"flags_added": added, "flags_removed": removed, "flags_changed": changed} {
+		if len(keys) > 0 {
+			sort.Strings(keys)
+			diff[name] = strings.Join(keys, ",")
+		}
+	}
+	return diff
 }
 
 func (s *App) validateFeatureFlags(flags map[string]string) map[string]string {
@@ -166,7 +454,7 @@ func (s *App) validateFeatureFlags(flags map[string]string) map[string]string {
 	}
 	valid := make(map[string]string, len(flags))
 	for k, v := range flags {
-		if !validEnvKeyRegexp.MatchString(k) {
+		if !envfile.IsValidKey(k) {
 			s.logger.Warn("Skipping feature flag with invalid key", "key", k)
 			continue
 		}
@@ -179,111 +467,129 @@ func (s *App) validateFeatureFlags(flags map[string]string) map[string]string {
 	return valid
 }
 
-func (s *App) processFeatureFlags(response *agentmanager.GetVersionResponse, agent agents.AgentData) bool {
-	if response.GetFeatureFlagsUnavailable() {
-		s.logger.Warn("Server reports feature flags unavailable, keeping current flag set", "agent", agent.GetServiceName())
-		return false
-	}
-
-	envPath := agent.GetEnvironmentFilePath()
-	if envPath == "" {
-		return false
-	}
-
-	featureFlags := s.validateFeatureFlags(response.GetFeatureFlags())
-	newContent := generateEnvironmentFileContent(featureFlags)
-
-	existingContent, err := s.fileGuard.ReadFile(envPath, envFileIOTimeout)
-	fileExists := err == nil
-	if err != nil && !os.IsNotExist(err) {
-		s.logger.Error("Failed to read environment file", "error", err, "path", envPath)
-		return false
-	}
-
-	// No flags and no existing file (or file with only comments) — nothing to do,
-	// avoid creating a header-only file that would trigger a spurious restart.
-	if len(featureFlags) == 0 && (!fileExists || stripComments(string(existingContent)) == "") {
-		return false
-	}
-
-	if stripComments(string(existingContent)) != stripComments(newContent) {
-		s.logger.Info("Feature flags changed, updating environment file", "agent", agent.GetServiceName(), "path", envPath)
-		if err := s.fileGuard.WriteFileAtomic(envPath, []byte(newContent), 0640, envFileIOTimeout); err != nil {
-			s.logger.Error("Failed to write environment file", "error", err, "path", envPath)
-			return false
+func (s *App) Run(ctx context.Context) error {
+	var wg sync.WaitGroup
+	for i, agent := range s.agents {
+		var wake chan struct{}
+		if i < len(s.pollNow) {
+			wake = s.pollNow[i]
 		}
+		wg.Add(1)
+		go func(a agents.AgentData) {
+			defer wg.Done()
+			s.runForAgent(ctx, a, wake)
+		}(agent)
 	}
-
-	fileInfo, err := s.fileGuard.Stat(envPath, envFileIOTimeout)
-	if err != nil {
-		s.logger.Error("Failed to stat environment file", "error", err, "path", envPath)
-		return false
+	wg.Wait()
+	for _, worker := range s.updates {
+		worker.wait()
 	}
+	return nil
+}
 
-	agentUptime, err := s.oh.GetServiceUptime(agent.GetServiceName())
-	if err != nil {
-		s.logger.Error("Failed to get agent uptime", "error", err)
-		return false
+// PollNow wakes every agent loop for an immediate poll without resetting its
+// regular schedule. Requests that arrive while a poll is in flight are
+// coalesced into a single follow-up poll.
+func (s *App) PollNow() {
+	for _, wake := range s.pollNow {
+		select {
+		case wake <- struct{}{}:
+		default:
+		}
 	}
+}
 
-	systemUptime, sysErr := s.oh.GetSystemUptime()
-	freshBoot := sysErr == nil && systemUptime < MinimalUptimeForUpdate
-	agentStartTime := time.Now().Add(-agentUptime)
+// pollStreak tracks consecutive backend failures of one agent loop. notice
+// is the streak notice queued for the next report, replaced as the streak
+// grows.
+type pollStreak struct {
+	failures    int
+	lastSuccess time.Time
+	notice      string
+}
 
-	gracePeriod := restartGracePeriod
-	requireMinUptime := true
-	if freshBoot {
-		gracePeriod = 0
-		requireMinUptime = false
+func (s *App) runForAgent(ctx context.Context, agent agents.AgentData, wake <-chan struct{}) {
+	streak := &pollStreak{lastSuccess: time.Now()}
+	for {
+		interval := s.nextPollInterval(streak.failures)
+		s.logger.Info("Calculated poll interval", "poll_interval", interval.String(), "failure_streak", streak.failures, "agent", agent.GetServiceName())
+		if !s.waitAndPoll(ctx, agent, interval, wake, streak) {
+			return
+		}
 	}
+}
 
-	if !fileInfo.ModTime().After(agentStartTime.Add(gracePeriod)) {
-		return false
+// nextPollInterval returns the jittered poll interval, doubled for each
+// consecutive failure up to PollBackoffMaxInterval.
+func (s *App) nextPollInterval(failures int) time.Duration {
+	interval := s.config.PollInterval + time.Duration(float64(s.config.PollJitter)*(2*rand.Float64()-1))
+	if interval < 0 {
+		interval = 0
 	}
-	if requireMinUptime && agentUptime < MinimalUptimeForUpdate {
-		s.logger.Info("Agent uptime is less than 15 minutes, skipping restart after feature flags change",
-			"agent_uptime", agentUptime.String(), "system_uptime", systemUptime.String(), "agent", agent.GetServiceName())
-		return false
+	maxInterval := s.config.PollBackoffMaxInterval
+	if failures == 0 || maxInterval <= 0 || interval >= maxInterval {
+		return interval
 	}
-
-	s.logger.Info("Restarting agent due to feature flags change",
-		"agent", agent.GetServiceName(), "agent_uptime", agentUptime.String(), "system_uptime", systemUptime.String())
-	if err := agent.Restart(); err != nil {
-		s.logger.Error("Failed to restart agent after feature flags change", "error", err, "agent", agent.GetServiceName())
-		return false
+	// Past 2^20 the cap has long been reached; bounding the shift avoids overflow.
+	backoff := interval * time.Duration(1<<min(failures, 20))
+	if backoff <= 0 || backoff > maxInterval {
+		return maxInterval
 	}
-	return true
+	return backoff
 }
 
-func (s *App) Run(ctx context.Context) error {
-	var wg sync.WaitGroup
-	for _, agent := range s.agents {
-		wg.Add(1)
-		go func(a agents.AgentData) {
-			defer wg.Done()
-			s.runForAgent(ctx, a)
-		}(agent)
+// waitAndPoll polls once the interval elapses, serving on-demand polls from
+// wake in the meantime without restarting the timer. It returns false when
+// ctx is cancelled.
+func (s *App) waitAndPoll(ctx context.Context, agent agents.AgentData, interval time.Duration, wake <-chan struct{}, streak *pollStreak) bool {
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			s.trackedPoll(ctx, agent, streak)
+			return true
+		case <-wake:
+			s.logger.Info("On-demand poll requested", "agent", agent.GetServiceName())
+			s.trackedPoll(ctx, agent, streak)
+		case <-ctx.Done():
+			return false
+		}
 	}
-	wg.Wait()
-	return nil
 }
 
-func (s *App) runForAgent(ctx context.Context, agent agents.AgentData) {
-	for {
-		interval := s.config.PollInterval + time.Duration(float64(s.config.PollJitter)*(2*rand.Float64()-1))
-		s.logger.Info("Calculated poll interval", "poll_interval", interval.String(), "agent", agent.GetServiceName())
-		if interval < 0 {
-			interval = 0
+// trackedPoll polls and updates the failure streak. While the backend is
+// unreachable every request carries the streak, so the first one that gets
+// through tells the backend how long the node was cut off.
+func (s *App) trackedPoll(ctx context.Context, agent agents.AgentData, streak *pollStreak) {
+	sinceSuccess := time.Since(streak.lastSuccess).Round(time.Second)
+	if streak.failures > 0 {
+		if streak.notice != "" {
+			agent.RemoveNotices([]string{streak.notice})
 		}
-		select {
-		case <-time.After(interval):
-			s.poll(agent)
-		case <-ctx.Done():
+		streak.notice = fmt.Sprintf("backend unreachable: %d consecutive failed polls, %s since last success", streak.failures, sinceSuccess)
+		agent.AddNotice(streak.notice)
+	}
+	if !s.poll(ctx, agent) {
+		if ctx.Err() != nil {
 			return
 		}
+		streak.failures++
+		s.logger.Warn("Poll failed, backing off", "failure_streak", streak.failures, "since_last_success", sinceSuccess.String(), "agent", agent.GetServiceName())
+		return
 	}
+	if streak.failures > 0 {
+		s.logger.Info("Backend reachable again", "failure_streak", streak.failures, "since_last_success", sinceSuccess.String(), "agent", agent.GetServiceName())
+	}
+	streak.failures, streak.notice = 0, ""
+	streak.lastSuccess = time.Now()
 }
 
+// Shutdown waits for an apt-get or dpkg run that changes installed packages
+// to finish, for at most ShutdownDrainTimeout, so stopping the updater never
+// leaves dpkg half-configured. Installs still waiting for the dpkg lock or
+// refreshing the package lists stop with the context passed to Run. Call it
+// after cancelling that context.
 func (s *App) Shutdown() error {
-	return nil
+	return s.installs.drain()
 }
@@ -1,21 +1,34 @@
 package application
 
 import (
+	"bufio"
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"log/slog"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/nebius/gosdk/proto/nebius/logging/v1/agentmanager"
 	"github.com/nebius/nebius-observability-agent-updater/internal/agents"
 	"github.com/nebius/nebius-observability-agent-updater/internal/config"
+	"github.com/nebius/nebius-observability-agent-updater/internal/envfile"
 	"github.com/nebius/nebius-observability-agent-updater/internal/healthcheck"
+	"github.com/nebius/nebius-observability-agent-updater/internal/journal"
+	"github.com/nebius/nebius-observability-agent-updater/internal/maintenance"
 	"github.com/nebius/nebius-observability-agent-updater/internal/osutils"
+	"github.com/nebius/nebius-observability-agent-updater/internal/policy"
+	"github.com/nebius/nebius-observability-agent-updater/internal/restartlimit"
+	"github.com/nebius/nebius-observability-agent-updater/internal/updateattempts"
+	"github.com/nebius/nebius-observability-agent-updater/internal/versionpolicy"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 	"go.uber.org/goleak"
 )
 
@@ -30,7 +43,7 @@ type MockUpdaterClient struct {
 	mock.Mock
 }
 
-func (m *MockUpdaterClient) SendAgentData(agent agents.AgentData) (*agentmanager.GetVersionResponse, error) {
+func (m *MockUpdaterClient) SendAgentData(_ context.Context, agent agents.AgentData) (*agentmanager.GetVersionResponse, error) {
 	args := m.Called(agent)
 	return args.Get(0).(*agentmanager.GetVersionResponse), args.Error(1)
 }
@@ -41,6 +54,8 @@ func (m *MockUpdaterClient) Close() {
 
 type MockAgentData struct {
 	mock.Mock
+	unhealthy       bool
+	lastUpdateError error
 }
 
 func (m *MockAgentData) GetServiceName() string {
@@ -48,9 +63,13 @@ func (m *MockAgentData) GetServiceName() string {
 	return args.String(0)
 }
 
-func (m *MockAgentData) Update(updateScriptPath string, version string) error {
-	args := m.Called(updateScriptPath, version)
-	return args.Error(0)
+// Update runs the mocked install through protect, as the install step of a
+// real agent does.
+func (m *MockAgentData) Update(ctx context.Context, protect osutils.Protect, updateScriptPath string, version string) error {
+	return protect(ctx, func(context.Context) error {
+		args := m.MethodCalled("Update", updateScriptPath, version)
+		return args.Error(0)
+	})
 }
 
 func (m *MockAgentData) GetAgentType() agentmanager.AgentType {
@@ -68,19 +87,39 @@ func (m *MockAgentData) GetSystemdServiceName() string {
 	return "nebius-observability-agent"
 }
 func (m *MockAgentData) IsAgentHealthy() (bool, healthcheck.Response) {
+	if m.unhealthy {
+		return false, healthcheck.Response{Reasons: []string{"agent down"}}
+	}
 	return true, healthcheck.Response{}
 }
 
 func (m *MockAgentData) GetLastUpdateError() error {
+	return m.lastUpdateError
+}
+
+func (m *MockAgentData) SetLastUpdateError(err error) {
+	m.Called(err)
+	m.lastUpdateError = err
+}
+
+func (m *MockAgentData) AddNotice(msg string) {
+	m.Called(msg)
+}
+
+func (m *MockAgentData) PendingNotices() []string {
 	return nil
 }
 
+func (m *MockAgentData) RemoveNotices(delivered []string) {
+	m.Called(delivered)
+}
+
 func (m *MockAgentData) GetEnvironmentFilePath() string {
 	args := m.Called()
 	return args.String(0)
 }
 
-func (m *MockAgentData) Restart() error {
+func (m *MockAgentData) Restart(context.Context) error {
 	args := m.Called()
 	return args.Error(0)
 }
@@ -96,28 +135,103 @@ func (m *MockAgentData) SetLastSeenConfigVersion(version uint64) {
 
 type MockOSHelper struct {
 	mock.Mock
+	// environ enables GetServiceEnviron expectations; without it the running
+	// environment is unreadable and the mtime fallback is exercised.
+	environ bool
 }
 
-func (m *MockOSHelper) GetSystemUptime() (time.Duration, error) {
+func (m *MockOSHelper) GetSystemUptime(context.Context) (time.Duration, error) {
 	args := m.Called()
 	return args.Get(0).(time.Duration), args.Error(1)
 }
 
-func (m *MockOSHelper) GetServiceUptime(serviceName string) (time.Duration, error) {
+func (m *MockOSHelper) GetServiceUptime(_ context.Context, serviceName string) (time.Duration, error) {
 	args := m.Called(serviceName)
 	return args.Get(0).(time.Duration), args.Error(1)
 }
 
+func (m *MockOSHelper) GetServiceRestartCount(_ context.Context, serviceName string) (int, error) {
+	args := m.Called(serviceName)
+	return args.Int(0), args.Error(1)
+}
+
+func (m *MockOSHelper) GetServiceEnviron(_ context.Context, serviceName string) (map[string]string, error) {
+	if !m.environ {
+		return nil, errors.New("environ unavailable")
+	}
+	args := m.Called(serviceName)
+	env, _ := args.Get(0).(map[string]string)
+	return env, args.Error(1)
+}
+
+func (m *MockOSHelper) GetDebVersion(_ context.Context, name string) (string, error) {
+	args := m.Called(name)
+	return args.String(0), args.Error(1)
+}
+
+func (m *MockOSHelper) GetCloudInitStatus(context.Context) (string, error) {
+	args := m.Called()
+	return args.String(0), args.Error(1)
+}
+
+func (m *MockOSHelper) GetSystemState(context.Context) (string, error) {
+	args := m.Called()
+	return args.String(0), args.Error(1)
+}
+
+func (m *MockOSHelper) GetLoadPerCPU(context.Context) (float64, error) {
+	args := m.Called()
+	return args.Get(0).(float64), args.Error(1)
+}
+
+func (m *MockOSHelper) GetPressure(_ context.Context, resource string) (float64, error) {
+	args := m.Called(resource)
+	return args.Get(0).(float64), args.Error(1)
+}
+
+func (m *MockOSHelper) GetPackageManagerProcesses(context.Context) ([]string, error) {
+	args := m.Called()
+	procs, _ := args.Get(0).([]string)
+	return procs, args.Error(1)
+}
+
 func newTestApp(client updaterClient, oh oshelper) *App {
+	cfg := config.GetDefaultConfig()
+	cfg.StateDir = "" // keep tests independent of a pause file on the host
+	cfg.VersionPolicyPath = ""
+	// A single healthy check passes the update verification; the stability
+	// checks are covered by TestApp_verifyUpdate_Stability.
+	cfg.UpdateVerification.HealthyChecks = 1
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
 	return &App{
 		client:    client,
-		logger:    slog.New(slog.NewTextHandler(io.Discard, nil)),
-		config:    config.GetDefaultConfig(),
+		logger:    logger,
+		config:    cfg,
 		oh:        oh,
 		fileGuard: osutils.NewFileGuard(osutils.DefaultMaxPendingFileOps),
+		policy:    policy.New(cfg.Policy, oh, logger),
 	}
 }
 
+// restartResponse asks for an agent restart.
+var restartResponse = &agentmanager.GetVersionResponse{Action: agentmanager.Action_RESTART}
+
+// apply plans response for agent and executes the plan inline, as poll does
+// when no install is due. It reports whether the agent was restarted and
+// returns the steps that failed to plan or execute.
+func apply(ctx context.Context, app *App, response *agentmanager.GetVersionResponse, agent agents.AgentData) (bool, error) {
+	p, failed := app.plan(ctx, response, agent)
+	restarted, execFailed := app.execute(ctx, agent, p)
+	return restarted, append(failed, execFailed...).err()
+}
+
+// closedMaintenanceWindows returns a schedule whose only window is two days
+// from now, so every action evaluated during the test is outside it.
+func closedMaintenanceWindows() maintenance.Config {
+	day := maintenance.Weekday(time.Now().UTC().Add(48 * time.Hour).Weekday())
+	return maintenance.Config{Windows: []maintenance.Window{{Days: []maintenance.Weekday{day}, Start: 0, End: 60}}}
+}
+
 func writeEnvFile(t *testing.T, path, content string, mtime time.Time) {
 	t.Helper()
 	err := os.WriteFile(path, []byte(content), 0640)
@@ -171,6 +285,7 @@ func TestApp_poll(t *testing.T) {
 				agent.On("GetServiceName").Return("test-agent")
 				agent.On("GetEnvironmentFilePath").Return("")
 				oh.On("GetSystemUptime").Return(20*time.Minute, nil)
+				oh.On("GetDebVersion", mock.Anything).Return(testVersion, nil)
 				agent.On("Update", mock.Anything, testVersion).Return(nil)
 				agent.On("GetLastSeenConfigVersion").Return(uint64(0))
 			},
@@ -203,6 +318,24 @@ func TestApp_poll(t *testing.T) {
 			},
 			expectedLogMsg: logMsgPolling,
 		},
+		{
+			name: "Keeps config version when install fails",
+			setupMocks: func(client *MockUpdaterClient, agent *MockAgentData, oh *MockOSHelper) {
+				client.On("SendAgentData", mock.Anything).Return(&agentmanager.GetVersionResponse{
+					Action:        agentmanager.Action_UPDATE,
+					Response:      &agentmanager.GetVersionResponse_Update{Update: &agentmanager.UpdateActionParams{Version: testVersion}},
+					ConfigVersion: 7,
+				}, nil)
+				agent.On("GetServiceName").Return("test-agent")
+				agent.On("GetEnvironmentFilePath").Return("")
+				oh.On("GetSystemUptime").Return(20*time.Minute, nil)
+				oh.On("GetDebVersion", mock.Anything).Return("1.0.0", nil)
+				agent.On("Update", mock.Anything, testVersion).Return(errors.New("apt-get failed"))
+				agent.On("GetLastSeenConfigVersion").Return(uint64(0))
+				agent.On("AddNotice", "config version 7 not applied: install "+testVersion+": apt-get failed").Return().Once()
+			},
+			expectedLogMsg: logMsgPolling,
+		},
 		{
 			name: "Does not store config version that is not newer",
 			setupMocks: func(client *MockUpdaterClient, agent *MockAgentData, oh *MockOSHelper) {
@@ -235,7 +368,7 @@ func TestApp_poll(t *testing.T) {
 
 			app := newTestApp(client, oh)
 
-			app.poll(agent)
+			app.poll(context.Background(), agent)
 
 			client.AssertExpectations(t)
 			agent.AssertExpectations(t)
@@ -244,6 +377,100 @@ func TestApp_poll(t *testing.T) {
 	}
 }
 
+func TestApp_poll_AcksDeferredActions(t *testing.T) {
+	setup := func(action agentmanager.Action) (*App, *MockAgentData, *MockOSHelper) {
+		client := &MockUpdaterClient{}
+		agent := &MockAgentData{}
+		oh := &MockOSHelper{}
+		client.On("SendAgentData", mock.Anything).Return(&agentmanager.GetVersionResponse{
+			Action:        action,
+			Response:      &agentmanager.GetVersionResponse_Update{Update: &agentmanager.UpdateActionParams{Version: testVersion}},
+			ConfigVersion: 7,
+		}, nil)
+		agent.On("GetServiceName").Return("test-agent")
+		agent.On("GetEnvironmentFilePath").Return("")
+		agent.On("GetLastSeenConfigVersion").Return(uint64(0))
+		agent.On("SetLastSeenConfigVersion", uint64(7)).Return().Once()
+		return newTestApp(client, oh), agent, oh
+	}
+
+	t.Run("update outside maintenance window", func(t *testing.T) {
+		app, agent, oh := setup(agentmanager.Action_UPDATE)
+		app.config.MaintenanceWindows = closedMaintenanceWindows()
+		oh.On("GetSystemUptime").Return(time.Hour, nil)
+		agent.On("AddNotice", "update to "+testVersion+" deferred: outside maintenance window").Return().Once()
+
+		app.poll(context.Background(), agent)
+
+		agent.AssertNotCalled(t, "Update", mock.Anything, mock.Anything)
+		agent.AssertExpectations(t)
+	})
+
+	t.Run("restart refused by the restart limit", func(t *testing.T) {
+		app, agent, oh := setup(agentmanager.Action_RESTART)
+		app.restarts = restartlimit.New(restartlimit.GetDefaultConfig(), "", oh, app.logger, app.fileGuard)
+		oh.On("GetServiceUptime", "test-agent").Return(time.Minute, nil)
+		oh.On("GetServiceRestartCount", "test-agent").Return(5, nil)
+		agent.On("AddNotice", mock.MatchedBy(func(msg string) bool {
+			return strings.Contains(msg, "crash-looping")
+		})).Return().Once()
+
+		app.poll(context.Background(), agent)
+
+		agent.AssertNotCalled(t, "Restart")
+		agent.AssertExpectations(t)
+	})
+}
+
+func TestApp_poll_BackgroundUpdate(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	client := &MockUpdaterClient{}
+	agent := &MockAgentData{}
+	oh := &MockOSHelper{}
+	client.On("SendAgentData", mock.Anything).Return(&agentmanager.GetVersionResponse{
+		Action:        agentmanager.Action_UPDATE,
+		Response:      &agentmanager.GetVersionResponse_Update{Update: &agentmanager.UpdateActionParams{Version: testVersion}},
+		ConfigVersion: 7,
+	}, nil)
+	agent.On("GetServiceName").Return("test-agent")
+	agent.On("GetEnvironmentFilePath").Return("")
+	agent.On("GetLastSeenConfigVersion").Return(uint64(0))
+	oh.On("GetSystemUptime").Return(time.Hour, nil)
+	oh.On("GetDebVersion", mock.Anything).Return(testVersion, nil)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	agent.On("Update", mock.Anything, testVersion).Run(func(mock.Arguments) {
+		close(started)
+		<-release
+	}).Return(nil).Once()
+
+	app := newTestApp(client, oh)
+	app.updates = newUpdateWorkers([]agents.AgentData{agent})
+
+	require.True(t, app.poll(context.Background(), agent))
+	<-started
+
+	agent.On("AddNotice", mock.MatchedBy(func(msg string) bool {
+		return strings.HasPrefix(msg, "update to "+testVersion+" in progress since ")
+	})).Return().Once()
+	require.True(t, app.poll(context.Background(), agent), "polling continues during the install")
+	agent.AssertNotCalled(t, "SetLastSeenConfigVersion", mock.Anything)
+
+	close(release)
+	app.updates[agent].wait()
+	agent.On("SetLastSeenConfigVersion", uint64(7)).Return().Once()
+	// The next poll picks up the result and starts the update again, since
+	// the mocked backend keeps asking for it.
+	agent.On("Update", mock.Anything, testVersion).Return(nil).Once()
+	require.True(t, app.poll(context.Background(), agent))
+	app.updates[agent].wait()
+
+	agent.AssertNumberOfCalls(t, "Update", 2)
+	agent.AssertExpectations(t)
+}
+
 func TestApp_Update(t *testing.T) {
 	tests := []struct {
 		name         string
@@ -255,6 +482,7 @@ func TestApp_Update(t *testing.T) {
 			name: "Update with sufficient uptime",
 			setupMocks: func(agent *MockAgentData, oh *MockOSHelper) {
 				oh.On("GetSystemUptime").Return(20*time.Minute, nil)
+				oh.On("GetDebVersion", mock.Anything).Return(testVersion, nil)
 				agent.On("GetServiceName").Return("test-agent")
 				agent.On("Update", mock.Anything, testVersion).Return(nil)
 			},
@@ -268,6 +496,8 @@ func TestApp_Update(t *testing.T) {
 			name: "Skip update with insufficient uptime",
 			setupMocks: func(agent *MockAgentData, oh *MockOSHelper) {
 				oh.On("GetSystemUptime").Return(10*time.Minute, nil)
+				agent.On("GetServiceName").Return("test-agent")
+				agent.On("AddNotice", "update to "+testVersion+" deferred: refused by policy: system uptime 10m0s is below 15m0s").Return().Once()
 			},
 			response: &agentmanager.GetVersionResponse{
 				Action:   agentmanager.Action_UPDATE,
@@ -279,6 +509,7 @@ func TestApp_Update(t *testing.T) {
 			name: "Update with error getting uptime",
 			setupMocks: func(agent *MockAgentData, oh *MockOSHelper) {
 				oh.On("GetSystemUptime").Return(time.Duration(0), errors.New("uptime error"))
+				oh.On("GetDebVersion", mock.Anything).Return(testVersion, nil)
 				agent.On("GetServiceName").Return("test-agent")
 				agent.On("Update", mock.Anything, testVersion).Return(nil)
 			},
@@ -291,7 +522,6 @@ func TestApp_Update(t *testing.T) {
 		{
 			name: "Update with empty update data",
 			setupMocks: func(agent *MockAgentData, oh *MockOSHelper) {
-				oh.On("GetSystemUptime").Return(20*time.Minute, nil)
 			},
 			response: &agentmanager.GetVersionResponse{
 				Action: agentmanager.Action_UPDATE,
@@ -303,12 +533,265 @@ func TestApp_Update(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			agent := &MockAgentData{}
+			agent.On("GetEnvironmentFilePath").Return("")
+			oh := &MockOSHelper{}
+			tt.setupMocks(agent, oh)
+
+			app := newTestApp(nil, oh)
+
+			apply(context.Background(), app, tt.response, agent)
+
+			agent.AssertExpectations(t)
+			oh.AssertExpectations(t)
+		})
+	}
+}
+
+func TestApp_Update_Policy(t *testing.T) {
+	agent := &MockAgentData{}
+	oh := &MockOSHelper{}
+	oh.On("GetSystemUptime").Return(time.Hour, nil)
+	oh.On("GetCloudInitStatus").Return("running", nil)
+	oh.On("GetPackageManagerProcesses").Return([]string{"unattended-upgr (pid 812)"}, nil)
+	agent.On("GetServiceName").Return("test-agent")
+	agent.On("GetEnvironmentFilePath").Return("")
+	agent.On("AddNotice", "update to "+testVersion+" deferred: refused by policy: cloud-init is still running; package manager running: unattended-upgr (pid 812)").Return().Once()
+
+	app := newTestApp(nil, oh)
+	app.config.Policy.Install.CloudInitDone = true
+	app.config.Policy.Install.NoPackageManager = true
+	app.policy = policy.New(app.config.Policy, oh, app.logger)
+
+	_, err := apply(context.Background(), app, &agentmanager.GetVersionResponse{
+		Action:   agentmanager.Action_UPDATE,
+		Response: &agentmanager.GetVersionResponse_Update{Update: &agentmanager.UpdateActionParams{Version: testVersion}},
+	}, agent)
+
+	assert.NoError(t, err, "a policy refusal is a deferral")
+	agent.AssertNotCalled(t, "Update", mock.Anything, mock.Anything)
+	agent.AssertExpectations(t)
+	oh.AssertExpectations(t)
+}
+
+func TestApp_Update_FailedAttempts(t *testing.T) {
+	response := &agentmanager.GetVersionResponse{
+		Action:   agentmanager.Action_UPDATE,
+		Response: &agentmanager.GetVersionResponse_Update{Update: &agentmanager.UpdateActionParams{Version: testVersion}},
+	}
+	setup := func(cfg updateattempts.Config) (*App, *MockAgentData) {
+		agent := &MockAgentData{}
+		oh := &MockOSHelper{}
+		oh.On("GetSystemUptime").Return(time.Hour, nil)
+		oh.On("GetDebVersion", mock.Anything).Return("1.0.0", nil)
+		agent.On("GetServiceName").Return("test-agent")
+		agent.On("GetEnvironmentFilePath").Return("")
+		app := newTestApp(nil, oh)
+		app.attempts = updateattempts.New(cfg, t.TempDir(), app.logger, app.fileGuard)
+		return app, agent
+	}
+
+	packageFault := &osutils.AptError{Code: osutils.AptErrorDependencyConflict, Package: "nebius-observability-agent=" + testVersion}
+
+	t.Run("failed install backs off", func(t *testing.T) {
+		app, agent := setup(updateattempts.Config{InitialBackoff: time.Hour})
+		agent.On("Update", mock.Anything, testVersion).Return(packageFault).Once()
+		agent.On("AddNotice", mock.MatchedBy(func(msg string) bool {
+			return strings.HasPrefix(msg, "update backing off: update to "+testVersion+" failed 1 times")
+		})).Return().Once()
+
+		_, err := apply(context.Background(), app, response, agent)
+		assert.Error(t, err)
+		_, err = apply(context.Background(), app, response, agent)
+		assert.NoError(t, err, "backing off is a deferral")
+
+		agent.AssertNumberOfCalls(t, "Update", 1)
+		agent.AssertExpectations(t)
+	})
+
+	t.Run("version is quarantined after repeated failures", func(t *testing.T) {
+		app, agent := setup(updateattempts.Config{MaxFailures: 2})
+		agent.On("Update", mock.Anything, testVersion).Return(packageFault).Twice()
+		agent.On("SetLastUpdateError", mock.MatchedBy(func(err error) bool {
+			return errors.Is(err, updateattempts.ErrQuarantined)
+		})).Return().Twice()
+
+		_, _ = apply(context.Background(), app, response, agent)
+		_, _ = apply(context.Background(), app, response, agent)
+		_, _ = apply(context.Background(), app, response, agent)
+		agent.AssertNumberOfCalls(t, "Update", 2)
+
+		// Reported until the server stops asking for the version...
+		agent.On("SetLastUpdateError", nil).Return().Twice()
+		_, _ = apply(context.Background(), app, &agentmanager.GetVersionResponse{Action: agentmanager.Action_NOP}, agent)
+		assert.NoError(t, agent.GetLastUpdateError())
+
+		// ...or asks for another one, even while that one is deferred.
+		_, _ = apply(context.Background(), app, response, agent)
+		require.ErrorIs(t, agent.GetLastUpdateError(), updateattempts.ErrQuarantined)
+		app.config.MaintenanceWindows = closedMaintenanceWindows()
+		agent.On("AddNotice", "update to 1.0.2 deferred: outside maintenance window").Return().Once()
+		_, _ = apply(context.Background(), app, &agentmanager.GetVersionResponse{
+			Action:   agentmanager.Action_UPDATE,
+			Response: &agentmanager.GetVersionResponse_Update{Update: &agentmanager.UpdateActionParams{Version: "1.0.2"}},
+		}, agent)
+		assert.NoError(t, agent.GetLastUpdateError())
+		agent.AssertExpectations(t)
+	})
+
+	t.Run("failures not caused by the package are not counted", func(t *testing.T) {
+		app, agent := setup(updateattempts.Config{MaxFailures: 2, InitialBackoff: time.Hour})
+		for _, err := range []error{
+			&osutils.AptError{Code: osutils.AptErrorLockHeld, Package: "nebius-observability-agent=" + testVersion},
+			&osutils.AptError{Code: osutils.AptErrorNetwork, Op: "failed to update repo"},
+			errors.New("update script failed"),
+		} {
+			agent.On("Update", mock.Anything, testVersion).Return(err).Once()
+		}
+
+		for range 3 {
+			_, err := apply(context.Background(), app, response, agent)
+			assert.Error(t, err)
+		}
+
+		agent.AssertNumberOfCalls(t, "Update", 3)
+		agent.AssertExpectations(t)
+	})
+}
+
+func TestApp_Update_VersionPolicy(t *testing.T) {
+	response := &agentmanager.GetVersionResponse{
+		Action:   agentmanager.Action_UPDATE,
+		Response: &agentmanager.GetVersionResponse_Update{Update: &agentmanager.UpdateActionParams{Version: testVersion}},
+	}
+	tests := []struct {
+		name      string
+		policy    string
+		installed string
+		refused   string
+	}{
+		{name: "upgrade without policy file", installed: "1.0.0"},
+		{name: "downgrade without policy file", installed: "1.0.2", refused: "would downgrade from 1.0.2"},
+		{name: "allowed downgrade", policy: "allow_downgrade: true", installed: "1.0.2"},
+		{name: "pinned elsewhere", policy: "packages: {nebius-observability-agent: {pin: '1.0.0'}}", installed: "1.0.0", refused: "is pinned to 1.0.0"},
+		{name: "outside allowed range", policy: "packages: {nebius-observability-agent: {allowed: ['<< 1.0.1']}}", installed: "1.0.0", refused: "outside the allowed ranges << 1.0.1"},
+		{name: "unreadable policy", policy: "packages: [", installed: "1.0.0", refused: "failed to parse version policy"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			agent := &MockAgentData{}
+			oh := &MockOSHelper{}
+			oh.On("GetSystemUptime").Return(time.Hour, nil)
+			oh.On("GetDebVersion", mock.Anything).Return(tt.installed, nil).Once()
+			oh.On("GetDebVersion", mock.Anything).Return(testVersion, nil)
+			agent.On("GetServiceName").Return("test-agent")
+			agent.On("GetEnvironmentFilePath").Return("")
+			app := newTestApp(nil, oh)
+			app.config.UpdateVerification.Window = 0
+			if tt.policy != "" {
+				app.config.VersionPolicyPath = filepath.Join(t.TempDir(), "version-policy.yaml")
+				require.NoError(t, os.WriteFile(app.config.VersionPolicyPath, []byte(tt.policy), 0640))
+			}
+			if tt.refused != "" {
+				agent.On("AddNotice", mock.MatchedBy(func(msg string) bool {
+					return strings.Contains(msg, versionpolicy.ErrRejected.Error()) && strings.Contains(msg, tt.refused)
+				})).Return().Once()
+			} else {
+				agent.On("Update", mock.Anything, testVersion).Return(nil).Once()
+			}
+
+			_, err := apply(context.Background(), app, response, agent)
+			assert.NoError(t, err, "a refused version is not an update failure")
+
+			agent.AssertExpectations(t)
+			if tt.refused != "" {
+				agent.AssertNotCalled(t, "Update", mock.Anything, mock.Anything)
+				agent.AssertNotCalled(t, "SetLastUpdateError", mock.Anything)
+			}
+		})
+	}
+}
+
+func TestApp_Update_Verification(t *testing.T) {
+	const previousVersion = "1.0.0"
+	updateResponse := &agentmanager.GetVersionResponse{
+		Action:   agentmanager.Action_UPDATE,
+		Response: &agentmanager.GetVersionResponse_Update{Update: &agentmanager.UpdateActionParams{Version: testVersion}},
+	}
+	errContains := func(substr string) interface{} {
+		return mock.MatchedBy(func(err error) bool { return err != nil && strings.Contains(err.Error(), substr) })
+	}
+
+	tests := []struct {
+		name       string
+		unhealthy  bool
+		setupMocks func(*MockAgentData, *MockOSHelper)
+	}{
+		{
+			name: "healthy after update keeps new version",
+			setupMocks: func(agent *MockAgentData, oh *MockOSHelper) {
+				oh.On("GetDebVersion", mock.Anything).Return(previousVersion, nil).Once()
+				oh.On("GetDebVersion", mock.Anything).Return(testVersion, nil).Once()
+				agent.On("Update", mock.Anything, testVersion).Return(nil).Once()
+			},
+		},
+		{
+			name:      "unhealthy after update rolls back",
+			unhealthy: true,
+			setupMocks: func(agent *MockAgentData, oh *MockOSHelper) {
+				oh.On("GetDebVersion", mock.Anything).Return(previousVersion, nil).Once()
+				oh.On("GetDebVersion", mock.Anything).Return(testVersion, nil).Once()
+				agent.On("Update", mock.Anything, testVersion).Return(nil).Once()
+				agent.On("Update", mock.Anything, previousVersion).Return(nil).Once()
+				agent.On("SetLastUpdateError", errContains("rolled back from 1.0.1 to 1.0.0")).Once()
+			},
+		},
+		{
+			name:      "failed rollback is reported",
+			unhealthy: true,
+			setupMocks: func(agent *MockAgentData, oh *MockOSHelper) {
+				oh.On("GetDebVersion", mock.Anything).Return(previousVersion, nil).Once()
+				oh.On("GetDebVersion", mock.Anything).Return(testVersion, nil).Once()
+				agent.On("Update", mock.Anything, testVersion).Return(nil).Once()
+				agent.On("Update", mock.Anything, previousVersion).Return(errors.New("apt error")).Once()
+				agent.On("SetLastUpdateError", errContains("rollback from 1.0.1 to 1.0.0 failed")).Once()
+			},
+		},
+		{
+			name: "version mismatch after install rolls back",
+			setupMocks: func(agent *MockAgentData, oh *MockOSHelper) {
+				oh.On("GetDebVersion", mock.Anything).Return(previousVersion, nil).Once()
+				oh.On("GetDebVersion", mock.Anything).Return("0.9.0", nil).Once()
+				agent.On("Update", mock.Anything, testVersion).Return(nil).Once()
+				agent.On("Update", mock.Anything, previousVersion).Return(nil).Once()
+				agent.On("SetLastUpdateError", errContains("installed version 0.9.0 does not match target 1.0.1")).Once()
+			},
+		},
+		{
+			name:      "fresh install has nothing to roll back to",
+			unhealthy: true,
+			setupMocks: func(agent *MockAgentData, oh *MockOSHelper) {
+				oh.On("GetDebVersion", mock.Anything).Return("", osutils.ErrDebNotFound).Once()
+				oh.On("GetDebVersion", mock.Anything).Return(testVersion, nil).Once()
+				agent.On("Update", mock.Anything, testVersion).Return(nil).Once()
+				agent.On("SetLastUpdateError", errContains("no previous version to roll back to")).Once()
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			agent := &MockAgentData{unhealthy: tt.unhealthy}
 			oh := &MockOSHelper{}
+			agent.On("GetServiceName").Return("test-agent")
+			agent.On("GetEnvironmentFilePath").Return("")
+			oh.On("GetSystemUptime").Return(20*time.Minute, nil)
 			tt.setupMocks(agent, oh)
 
 			app := newTestApp(nil, oh)
+			app.config.UpdateVerification.Window = 30 * time.Millisecond
+			app.config.UpdateVerification.CheckInterval = 10 * time.Millisecond
 
-			app.Update(tt.response, agent)
+			apply(context.Background(), app, updateResponse, agent)
 
 			agent.AssertExpectations(t)
 			oh.AssertExpectations(t)
@@ -316,6 +799,47 @@ func TestApp_Update(t *testing.T) {
 	}
 }
 
+func TestApp_verifyUpdate_Stability(t *testing.T) {
+	setup := func() (*App, *MockAgentData, *MockOSHelper) {
+		agent := &MockAgentData{}
+		oh := &MockOSHelper{}
+		agent.On("GetServiceName").Return("test-agent")
+		oh.On("GetDebVersion", mock.Anything).Return(testVersion, nil)
+		app := newTestApp(nil, oh)
+		app.config.UpdateVerification.Window = time.Second
+		app.config.UpdateVerification.CheckInterval = time.Millisecond
+		app.config.UpdateVerification.HealthyChecks = 3
+		return app, agent, oh
+	}
+
+	t.Run("stays healthy", func(t *testing.T) {
+		app, agent, oh := setup()
+		oh.On("GetServiceRestartCount", "test-agent").Return(2, nil)
+
+		assert.NoError(t, app.verifyUpdate(context.Background(), agent, testVersion))
+		oh.AssertNumberOfCalls(t, "GetServiceRestartCount", 3)
+	})
+
+	t.Run("crash loop between healthy checks", func(t *testing.T) {
+		app, agent, oh := setup()
+		app.config.UpdateVerification.Window = 50 * time.Millisecond
+		for i := range 1000 {
+			oh.On("GetServiceRestartCount", "test-agent").Return(i, nil).Once()
+		}
+
+		err := app.verifyUpdate(context.Background(), agent, testVersion)
+		assert.ErrorContains(t, err, "agent healthy on only 1 of 3 consecutive checks")
+		assert.ErrorContains(t, err, "restarted 1 times while reporting healthy")
+	})
+
+	t.Run("unreadable restart count", func(t *testing.T) {
+		app, agent, oh := setup()
+		oh.On("GetServiceRestartCount", "test-agent").Return(0, errors.New("systemctl failed"))
+
+		assert.NoError(t, app.verifyUpdate(context.Background(), agent, testVersion), "the health checks alone decide")
+	})
+}
+
 func TestApp_Restart(t *testing.T) {
 	tests := []struct {
 		name          string
@@ -344,10 +868,11 @@ func TestApp_Restart(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			agent := &MockAgentData{}
 			tt.setupMocks(agent)
+			agent.On("GetEnvironmentFilePath").Return("")
 
 			app := newTestApp(nil, nil)
 
-			app.Restart(agent)
+			apply(context.Background(), app, restartResponse, agent)
 
 			agent.AssertExpectations(t)
 		})
@@ -383,14 +908,202 @@ func TestApp_Run(t *testing.T) {
 	agent.AssertExpectations(t)
 }
 
+func TestApp_PollNow(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	cfg := &config.Config{PollInterval: time.Hour}
+	client := &MockUpdaterClient{}
+	agent := &MockAgentData{}
+	polled := make(chan struct{}, 10)
+	release := make(chan struct{}, 10)
+
+	agent.On("GetServiceName").Return("test-agent")
+	agent.On("GetEnvironmentFilePath").Return("")
+	agent.On("GetLastSeenConfigVersion").Return(uint64(0))
+	client.On("SendAgentData", mock.Anything).Run(func(mock.Arguments) {
+		polled <- struct{}{}
+		<-release
+	}).Return(&agentmanager.GetVersionResponse{Action: agentmanager.Action_NOP}, nil)
+
+	app := New(cfg, client, slog.New(slog.NewTextHandler(io.Discard, nil)), []agents.AgentData{agent}, &MockOSHelper{}, osutils.NewFileGuard(osutils.DefaultMaxPendingFileOps))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- app.Run(ctx) }()
+
+	waitPoll := func(msg string) {
+		t.Helper()
+		select {
+		case <-polled:
+		case <-time.After(time.Second):
+			t.Fatal(msg)
+		}
+	}
+
+	app.PollNow()
+	waitPoll("PollNow did not trigger a poll")
+
+	// Requests arriving while the poll is in flight coalesce into one follow-up.
+	app.PollNow()
+	app.PollNow()
+	app.PollNow()
+	release <- struct{}{}
+	waitPoll("request during in-flight poll was lost")
+	release <- struct{}{}
+
+	select {
+	case <-polled:
+		t.Fatal("coalesced requests must not trigger extra polls")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	cancel()
+	assert.NoError(t, <-done)
+}
+
+func TestApp_NextPollInterval(t *testing.T) {
+	app := &App{config: &config.Config{PollInterval: time.Minute, PollBackoffMaxInterval: 10 * time.Minute}}
+
+	tests := []struct {
+		failures int
+		expected time.Duration
+	}{
+		{0, time.Minute},
+		{1, 2 * time.Minute},
+		{3, 8 * time.Minute},
+		{4, 10 * time.Minute},
+		{1000, 10 * time.Minute},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, app.nextPollInterval(tt.failures), "failures=%d", tt.failures)
+	}
+
+	app.config.PollBackoffMaxInterval = 0
+	assert.Equal(t, time.Minute, app.nextPollInterval(5), "zero cap disables backoff")
+}
+
+func TestApp_TrackedPollReportsFailureStreak(t *testing.T) {
+	client := &MockUpdaterClient{}
+	agent := &MockAgentData{}
+	app := newTestApp(client, &MockOSHelper{})
+
+	agent.On("GetServiceName").Return("test-agent")
+	agent.On("GetEnvironmentFilePath").Return("")
+	agent.On("GetLastSeenConfigVersion").Return(uint64(0))
+	client.On("SendAgentData", agent).Return((*agentmanager.GetVersionResponse)(nil), errors.New("unavailable")).Twice()
+	client.On("SendAgentData", agent).Return(&agentmanager.GetVersionResponse{Action: agentmanager.Action_NOP}, nil)
+	agent.On("AddNotice", mock.MatchedBy(func(msg string) bool {
+		return strings.HasPrefix(msg, "backend unreachable: ")
+	})).Return()
+	agent.On("RemoveNotices", mock.Anything).Return()
+
+	streak := &pollStreak{lastSuccess: time.Now().Add(-time.Hour)}
+	app.trackedPoll(context.Background(), agent, streak)
+	agent.AssertNotCalled(t, "AddNotice", mock.Anything)
+	app.trackedPoll(context.Background(), agent, streak)
+	assert.Equal(t, 2, streak.failures)
+
+	app.trackedPoll(context.Background(), agent, streak)
+	assert.Equal(t, 0, streak.failures)
+	assert.WithinDuration(t, time.Now(), streak.lastSuccess, time.Second)
+	agent.AssertCalled(t, "AddNotice", "backend unreachable: 2 consecutive failed polls, 1h0m0s since last success")
+	agent.AssertNumberOfCalls(t, "AddNotice", 2)
+	agent.AssertCalled(t, "RemoveNotices", []string{"backend unreachable: 1 consecutive failed polls, 1h0m0s since last success"})
+	assert.Empty(t, streak.notice)
+}
+
 func TestApp_Shutdown(t *testing.T) {
 	app := &App{}
 	err := app.Shutdown()
 	assert.NoError(t, err)
 }
 
-func TestGenerateEnvironmentFileContent(t *testing.T) {
-	header := "# Managed by agent updater. Variables are loaded as env vars at agent startup.\n"
+func TestApp_ShutdownLetsInstallFinish(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	agent := &MockAgentData{}
+	oh := &MockOSHelper{}
+	app := newTestApp(&MockUpdaterClient{}, oh)
+	app.installs = newInstallGuard(time.Minute)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	agent.On("GetServiceName").Return("test-agent")
+	agent.On("GetEnvironmentFilePath").Return("")
+	oh.On("GetSystemUptime").Return(time.Hour, nil)
+	oh.On("GetDebVersion", mock.Anything).Return(testVersion, nil)
+	agent.On("Update", mock.Anything, testVersion).Run(func(mock.Arguments) {
+		close(started)
+		<-release
+	}).Return(nil).Once()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	updated := make(chan struct{})
+	go func() {
+		defer close(updated)
+		apply(ctx, app, &agentmanager.GetVersionResponse{
+			Action:   agentmanager.Action_UPDATE,
+			Response: &agentmanager.GetVersionResponse_Update{Update: &agentmanager.UpdateActionParams{Version: testVersion}},
+		}, agent)
+	}()
+	<-started
+	cancel()
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- app.Shutdown() }()
+	select {
+	case <-shutdown:
+		t.Fatal("Shutdown returned while the install was still running")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	assert.NoError(t, <-shutdown)
+	<-updated
+	agent.AssertExpectations(t)
+}
+
+func TestInstallGuard(t *testing.T) {
+	t.Run("install context survives caller cancellation", func(t *testing.T) {
+		g := newInstallGuard(time.Minute)
+		ctx, cancel := context.WithCancel(context.Background())
+		err := g.run(ctx, func(installCtx context.Context) error {
+			cancel()
+			return installCtx.Err()
+		})
+		assert.NoError(t, err)
+	})
+
+	t.Run("no install starts after cancellation or drain", func(t *testing.T) {
+		g := newInstallGuard(time.Minute)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		assert.ErrorIs(t, g.run(ctx, func(context.Context) error { return nil }), context.Canceled)
+
+		assert.NoError(t, g.drain())
+		assert.ErrorIs(t, g.run(context.Background(), func(context.Context) error { return nil }), errShuttingDown)
+	})
+
+	t.Run("drain timeout aborts the install", func(t *testing.T) {
+		g := newInstallGuard(10 * time.Millisecond)
+		started := make(chan struct{})
+		finished := make(chan error, 1)
+		go func() {
+			finished <- g.run(context.Background(), func(installCtx context.Context) error {
+				close(started)
+				<-installCtx.Done()
+				return installCtx.Err()
+			})
+		}()
+		<-started
+		assert.Error(t, g.drain())
+		assert.ErrorIs(t, <-finished, context.Canceled)
+	})
+}
+
+func TestRenderEnvironmentFile(t *testing.T) {
+	header := envBlockBegin + "\n"
+	footer := envBlockEnd + "\n"
 
 	tests := []struct {
 		name     string
@@ -400,18 +1113,19 @@ func TestGenerateEnvironmentFileContent(t *testing.T) {
 		{
 			name:     "nil flags",
 			flags:    nil,
-			expected: header,
+			expected: header + footer,
 		},
 		{
 			name:     "empty flags",
 			flags:    map[string]string{},
-			expected: header,
+			expected: header + footer,
 		},
 		{
 			name:  "single flag",
 			flags: map[string]string{"FEATURE_FLAG_GPU_LOGS_COLLECTION_ENABLED": flagValTrue},
 			expected: header +
-				"FEATURE_FLAG_GPU_LOGS_COLLECTION_ENABLED=true\n",
+				"FEATURE_FLAG_GPU_LOGS_COLLECTION_ENABLED=true\n" +
+				footer,
 		},
 		{
 			name: "multiple flags sorted",
@@ -421,49 +1135,55 @@ func TestGenerateEnvironmentFileContent(t *testing.T) {
 			},
 			expected: header +
 				"FEATURE_FLAG_A_FIRST=true\n" +
-				"FEATURE_FLAG_Z_LAST=false\n",
+				"FEATURE_FLAG_Z_LAST=false\n" +
+				footer,
 		},
 		{
 			name:  "value with spaces is quoted",
 			flags: map[string]string{flagKey: "hello world"},
 			expected: header +
-				"FLAG=\"hello world\"\n",
+				"FLAG=\"hello world\"\n" +
+				footer,
 		},
 		{
 			name:  "value with double quote is escaped",
 			flags: map[string]string{flagKey: `say "hi"`},
 			expected: header +
-				`FLAG="say \"hi\""` + "\n",
+				`FLAG="say \"hi\""` + "\n" +
+				footer,
 		},
 		{
 			name:  "value with backslash is escaped",
 			flags: map[string]string{flagKey: `a\b`},
 			expected: header +
-				`FLAG="a\\b"` + "\n",
+				`FLAG="a\\b"` + "\n" +
+				footer,
 		},
 		{
 			name:  "value with leading whitespace is quoted",
 			flags: map[string]string{flagKey: " leading"},
 			expected: header +
-				"FLAG=\" leading\"\n",
+				"FLAG=\" leading\"\n" +
+				footer,
 		},
 		{
 			name:     "simple value not quoted",
 			flags:    map[string]string{flagKey: "simple"},
-			expected: header + "FLAG=simple\n",
+			expected: header + "FLAG=simple\n" + footer,
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			result := generateEnvironmentFileContent(tt.flags)
+			result := envSections{}.render(tt.flags)
 			assert.Equal(t, tt.expected, result)
 		})
 	}
 }
 
-func TestApp_processFeatureFlags(t *testing.T) {
-	header := "# Managed by agent updater. Variables are loaded as env vars at agent startup.\n"
+func TestApp_FeatureFlags(t *testing.T) {
+	header := envBlockBegin + "\n"
+	footer := envBlockEnd + "\n"
 
 	t.Run("empty env path skips processing", func(t *testing.T) {
 		agent := &MockAgentData{}
@@ -471,7 +1191,7 @@ func TestApp_processFeatureFlags(t *testing.T) {
 		agent.On("GetEnvironmentFilePath").Return("")
 
 		app := newTestApp(nil, oh)
-		restarted := app.processFeatureFlags(&agentmanager.GetVersionResponse{
+		restarted, _ := apply(context.Background(), app, &agentmanager.GetVersionResponse{
 			FeatureFlags: map[string]string{flagKey: flagValTrue},
 		}, agent)
 
@@ -490,7 +1210,7 @@ func TestApp_processFeatureFlags(t *testing.T) {
 		agent.On("GetServiceName").Return("test-agent")
 
 		app := newTestApp(nil, oh)
-		restarted := app.processFeatureFlags(&agentmanager.GetVersionResponse{
+		restarted, _ := apply(context.Background(), app, &agentmanager.GetVersionResponse{
 			FeatureFlagsUnavailable: true,
 		}, agent)
 
@@ -511,7 +1231,7 @@ func TestApp_processFeatureFlags(t *testing.T) {
 		agent.On("GetEnvironmentFilePath").Return(envPath)
 
 		app := newTestApp(nil, oh)
-		restarted := app.processFeatureFlags(&agentmanager.GetVersionResponse{}, agent)
+		restarted, _ := apply(context.Background(), app, &agentmanager.GetVersionResponse{}, agent)
 
 		assert.False(t, restarted)
 		_, err := os.Stat(envPath)
@@ -532,14 +1252,14 @@ func TestApp_processFeatureFlags(t *testing.T) {
 		agent.On("Restart").Return(nil)
 
 		app := newTestApp(nil, oh)
-		restarted := app.processFeatureFlags(&agentmanager.GetVersionResponse{
+		restarted, _ := apply(context.Background(), app, &agentmanager.GetVersionResponse{
 			FeatureFlags: map[string]string{"FEATURE_FLAG_GPU_LOGS_COLLECTION_ENABLED": flagValTrue},
 		}, agent)
 
 		assert.True(t, restarted)
 		content, err := os.ReadFile(envPath)
 		assert.NoError(t, err)
-		assert.Equal(t, header+"FEATURE_FLAG_GPU_LOGS_COLLECTION_ENABLED=true\n", string(content))
+		assert.Equal(t, header+"FEATURE_FLAG_GPU_LOGS_COLLECTION_ENABLED=true\n"+footer, string(content))
 		agent.AssertExpectations(t)
 		oh.AssertExpectations(t)
 	})
@@ -553,20 +1273,46 @@ func TestApp_processFeatureFlags(t *testing.T) {
 		agent.On("GetServiceName").Return("test-agent")
 		oh.On("GetServiceUptime", "test-agent").Return(5*time.Minute, nil)
 		oh.On("GetSystemUptime").Return(1*time.Hour, nil)
+		agent.On("AddNotice", "restart after feature flags change deferred: refused by policy: agent uptime 5m0s is below 15m0s").Return().Once()
 
 		app := newTestApp(nil, oh)
-		restarted := app.processFeatureFlags(&agentmanager.GetVersionResponse{
+		restarted, _ := apply(context.Background(), app, &agentmanager.GetVersionResponse{
 			FeatureFlags: map[string]string{flagKey: flagValTrue},
 		}, agent)
 
 		assert.False(t, restarted)
 		content, err := os.ReadFile(envPath)
 		assert.NoError(t, err)
-		assert.Equal(t, header+"FLAG=true\n", string(content))
+		assert.Equal(t, header+"FLAG=true\n"+footer, string(content))
 		agent.AssertNotCalled(t, "Restart")
 		oh.AssertExpectations(t)
 	})
 
+	t.Run("equivalent hand-edited file is not rewritten", func(t *testing.T) {
+		agent := &MockAgentData{}
+		oh := &MockOSHelper{}
+		envPath := t.TempDir() + "/environment"
+
+		edited := "# tuned by hand\nexport OTHER='hello world'\n  FLAG = true  \n"
+		writeEnvFile(t, envPath, edited, time.Now().Add(-1*time.Hour))
+
+		agent.On("GetEnvironmentFilePath").Return(envPath)
+		agent.On("GetServiceName").Return("test-agent")
+		oh.On("GetServiceUptime", "test-agent").Return(30*time.Minute, nil)
+		oh.On("GetSystemUptime").Return(2*time.Hour, nil)
+
+		app := newTestApp(nil, oh)
+		restarted, _ := apply(context.Background(), app, &agentmanager.GetVersionResponse{
+			FeatureFlags: map[string]string{flagKey: flagValTrue, "OTHER": "hello world"},
+		}, agent)
+
+		assert.False(t, restarted)
+		content, err := os.ReadFile(envPath)
+		assert.NoError(t, err)
+		assert.Equal(t, edited, string(content))
+		agent.AssertNotCalled(t, "Restart")
+	})
+
 	t.Run("no restart when content unchanged and file older than agent", func(t *testing.T) {
 		agent := &MockAgentData{}
 		oh := &MockOSHelper{}
@@ -580,7 +1326,7 @@ func TestApp_processFeatureFlags(t *testing.T) {
 		oh.On("GetSystemUptime").Return(2*time.Hour, nil)
 
 		app := newTestApp(nil, oh)
-		restarted := app.processFeatureFlags(&agentmanager.GetVersionResponse{
+		restarted, _ := apply(context.Background(), app, &agentmanager.GetVersionResponse{
 			FeatureFlags: map[string]string{flagKey: flagValTrue},
 		}, agent)
 
@@ -602,7 +1348,7 @@ func TestApp_processFeatureFlags(t *testing.T) {
 		oh.On("GetSystemUptime").Return(1*time.Hour, nil)
 
 		app := newTestApp(nil, oh)
-		restarted := app.processFeatureFlags(&agentmanager.GetVersionResponse{
+		restarted, _ := apply(context.Background(), app, &agentmanager.GetVersionResponse{
 			FeatureFlags: map[string]string{flagKey: flagValTrue},
 		}, agent)
 
@@ -623,14 +1369,14 @@ func TestApp_processFeatureFlags(t *testing.T) {
 		agent.On("Restart").Return(nil)
 
 		app := newTestApp(nil, oh)
-		restarted := app.processFeatureFlags(&agentmanager.GetVersionResponse{
+		restarted, _ := apply(context.Background(), app, &agentmanager.GetVersionResponse{
 			FeatureFlags: map[string]string{flagKey: flagValTrue},
 		}, agent)
 
 		assert.True(t, restarted)
 		content, err := os.ReadFile(envPath)
 		assert.NoError(t, err)
-		assert.Equal(t, header+"FLAG=true\n", string(content))
+		assert.Equal(t, header+"FLAG=true\n"+footer, string(content))
 		agent.AssertExpectations(t)
 		oh.AssertExpectations(t)
 	})
@@ -649,7 +1395,7 @@ func TestApp_processFeatureFlags(t *testing.T) {
 		agent.On("Restart").Return(nil)
 
 		app := newTestApp(nil, oh)
-		restarted := app.processFeatureFlags(&agentmanager.GetVersionResponse{
+		restarted, _ := apply(context.Background(), app, &agentmanager.GetVersionResponse{
 			FeatureFlags: map[string]string{flagKey: flagValTrue},
 		}, agent)
 
@@ -668,7 +1414,7 @@ func TestApp_processFeatureFlags(t *testing.T) {
 		agent.On("GetEnvironmentFilePath").Return(envPath)
 
 		app := newTestApp(nil, oh)
-		restarted := app.processFeatureFlags(&agentmanager.GetVersionResponse{}, agent)
+		restarted, _ := apply(context.Background(), app, &agentmanager.GetVersionResponse{}, agent)
 
 		assert.False(t, restarted)
 		agent.AssertNotCalled(t, "Restart")
@@ -686,7 +1432,7 @@ func TestApp_processFeatureFlags(t *testing.T) {
 		agent.On("GetEnvironmentFilePath").Return(envPath)
 
 		app := newTestApp(nil, oh)
-		restarted := app.processFeatureFlags(&agentmanager.GetVersionResponse{}, agent)
+		restarted, _ := apply(context.Background(), app, &agentmanager.GetVersionResponse{}, agent)
 
 		assert.False(t, restarted)
 		agent.AssertNotCalled(t, "Restart")
@@ -708,7 +1454,7 @@ func TestApp_processFeatureFlags(t *testing.T) {
 		oh.On("GetSystemUptime").Return(2*time.Hour, nil)
 
 		app := newTestApp(nil, oh)
-		restarted := app.processFeatureFlags(&agentmanager.GetVersionResponse{
+		restarted, _ := apply(context.Background(), app, &agentmanager.GetVersionResponse{
 			FeatureFlags: map[string]string{flagKey: flagValTrue},
 		}, agent)
 
@@ -735,14 +1481,14 @@ func TestApp_processFeatureFlags(t *testing.T) {
 		agent.On("Restart").Return(nil)
 
 		app := newTestApp(nil, oh)
-		restarted := app.processFeatureFlags(&agentmanager.GetVersionResponse{
+		restarted, _ := apply(context.Background(), app, &agentmanager.GetVersionResponse{
 			FeatureFlags: map[string]string{flagKey: "new"},
 		}, agent)
 
 		assert.True(t, restarted)
 		content, err := os.ReadFile(envPath)
 		assert.NoError(t, err)
-		assert.Equal(t, header+"FLAG=new\n", string(content))
+		assert.Equal(t, header+"FLAG=new\n"+footer, string(content))
 		agent.AssertExpectations(t)
 		oh.AssertExpectations(t)
 	})
@@ -758,9 +1504,10 @@ func TestApp_processFeatureFlags(t *testing.T) {
 		agent.On("GetServiceName").Return("test-agent")
 		oh.On("GetServiceUptime", "test-agent").Return(5*time.Minute, nil)
 		oh.On("GetSystemUptime").Return(1*time.Hour, nil)
+		agent.On("AddNotice", "restart after feature flags change deferred: refused by policy: agent uptime 5m0s is below 15m0s").Return().Once()
 
 		app := newTestApp(nil, oh)
-		restarted := app.processFeatureFlags(&agentmanager.GetVersionResponse{
+		restarted, _ := apply(context.Background(), app, &agentmanager.GetVersionResponse{
 			FeatureFlags: map[string]string{flagKey: flagValTrue},
 		}, agent)
 
@@ -770,62 +1517,214 @@ func TestApp_processFeatureFlags(t *testing.T) {
 	})
 }
 
-func TestStripComments(t *testing.T) {
+func TestSplitEnvironmentFile(t *testing.T) {
+	header := envBlockBegin + "\n"
+	footer := envBlockEnd + "\n"
+
 	tests := []struct {
 		name     string
-		input    string
-		expected string
+		content  string
+		expected envSections
 	}{
+		{"empty", "", envSections{}},
+		{"unmarked file is managed in full", "# Old header\nFLAG=1\n", envSections{managed: "# Old header\nFLAG=1\n"}},
+		{"legacy header runs to the end", header + "FLAG=1\n", envSections{managed: "FLAG=1\n"}},
 		{
-			name:     "empty string",
-			input:    "",
-			expected: "",
-		},
-		{
-			name:     "only comments",
-			input:    "# comment one\n# comment two\n",
-			expected: "",
-		},
-		{
-			name:     "only blank lines",
-			input:    "\n\n\n",
-			expected: "",
-		},
-		{
-			name:     "comments and blank lines",
-			input:    "# header\n\n# another comment\n",
-			expected: "",
-		},
-		{
-			name:     "content with comments",
-			input:    "# header\nFLAG=true\n",
-			expected: "FLAG=true\n",
-		},
-		{
-			name:     "content without comments",
-			input:    "FLAG=true\nOTHER=false\n",
-			expected: "FLAG=true\nOTHER=false\n",
-		},
-		{
-			name:     "comment with leading whitespace",
-			input:    "  # indented comment\nFLAG=true\n",
-			expected: "FLAG=true\n",
-		},
-		{
-			name:     "value containing hash is not a comment",
-			input:    "FLAG=val#ue\n",
-			expected: "FLAG=val#ue\n",
+			"operator lines around the block",
+			"DEBUG=1\n" + header + "FLAG=1\n" + footer + "# mine\nEXTRA=2\n",
+			envSections{before: "DEBUG=1\n", managed: "FLAG=1\n", after: "# mine\nEXTRA=2\n"},
 		},
 	}
-
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			result := stripComments(tt.input)
-			assert.Equal(t, tt.expected, result)
+			sections := splitEnvironmentFile(tt.content)
+			assert.Equal(t, tt.expected, sections)
+			if tt.expected.before != "" || tt.expected.after != "" {
+				assert.Equal(t, tt.content, sections.render(envfile.Parse(sections.managed)), "render must round-trip")
+			}
 		})
 	}
 }
 
+func TestApp_FeatureFlags_OperatorSections(t *testing.T) {
+	header := envBlockBegin + "\n"
+	footer := envBlockEnd + "\n"
+
+	setup := func(t *testing.T, content, overrides string) (*App, *MockAgentData, string) {
+		envPath := t.TempDir() + "/environment"
+		writeEnvFile(t, envPath, content, time.Now().Add(-1*time.Hour))
+		if overrides != "" {
+			require.NoError(t, os.WriteFile(envPath+envOverridesSuffix, []byte(overrides), 0640))
+		}
+		agent := &MockAgentData{}
+		oh := &MockOSHelper{}
+		agent.On("GetEnvironmentFilePath").Return(envPath)
+		agent.On("GetServiceName").Return("test-agent")
+		oh.On("GetServiceUptime", "test-agent").Return(30*time.Minute, nil)
+		oh.On("GetSystemUptime").Return(2*time.Hour, nil)
+		agent.On("Restart").Return(nil)
+		return newTestApp(nil, oh), agent, envPath
+	}
+
+	t.Run("lines outside the block survive a flag change", func(t *testing.T) {
+		app, agent, envPath := setup(t, "# set by SRE\nDEBUG=1\n"+header+"FLAG=old\n"+footer+"TRACE=on\n", "")
+		agent.On("AddNotice", "local environment overrides in effect: DEBUG=1, TRACE=on").Return().Once()
+
+		apply(context.Background(), app, &agentmanager.GetVersionResponse{
+			FeatureFlags: map[string]string{flagKey: "new"},
+		}, agent)
+
+		content, err := os.ReadFile(envPath)
+		require.NoError(t, err)
+		assert.Equal(t, "# set by SRE\nDEBUG=1\n"+header+"FLAG=new\n"+footer+"TRACE=on\n", string(content))
+		agent.AssertExpectations(t)
+	})
+
+	t.Run("overrides file takes precedence over feature flags", func(t *testing.T) {
+		app, agent, envPath := setup(t, header+"FLAG=true\n"+footer, "FLAG=false\nexport DEBUG='yes please'\n")
+		agent.On("AddNotice", "local environment overrides in effect: DEBUG=yes please, FLAG=false").Return().Once()
+
+		apply(context.Background(), app, &agentmanager.GetVersionResponse{
+			FeatureFlags: map[string]string{flagKey: flagValTrue},
+		}, agent)
+
+		content, err := os.ReadFile(envPath)
+		require.NoError(t, err)
+		assert.Equal(t, header+"DEBUG=\"yes please\"\nFLAG=false\n"+footer, string(content))
+		agent.AssertExpectations(t)
+	})
+
+	t.Run("applied overrides do not cause another rewrite", func(t *testing.T) {
+		content := header + "DEBUG=1\nFLAG=true\n" + footer
+		app, agent, envPath := setup(t, content, "DEBUG=1\n")
+		agent.On("AddNotice", "local environment overrides in effect: DEBUG=1").Return().Once()
+
+		restarted, _ := apply(context.Background(), app, &agentmanager.GetVersionResponse{
+			FeatureFlags: map[string]string{flagKey: flagValTrue},
+		}, agent)
+
+		assert.False(t, restarted)
+		written, err := os.ReadFile(envPath)
+		require.NoError(t, err)
+		assert.Equal(t, content, string(written))
+		agent.AssertNotCalled(t, "Restart")
+	})
+}
+
+func TestApp_FeatureFlags_RunningEnvironment(t *testing.T) {
+	header := envBlockBegin + "\n"
+	footer := envBlockEnd + "\n"
+	flags := map[string]string{flagKey: flagValTrue}
+
+	// The file is always newer than the agent, so the mtime heuristic alone
+	// would restart in every case.
+	setup := func(t *testing.T, content string) (*App, *MockAgentData, *MockOSHelper) {
+		envPath := t.TempDir() + "/environment"
+		writeEnvFile(t, envPath, content, time.Now())
+		agent := &MockAgentData{}
+		oh := &MockOSHelper{environ: true}
+		agent.On("GetEnvironmentFilePath").Return(envPath)
+		agent.On("GetServiceName").Return("test-agent")
+		oh.On("GetServiceUptime", "test-agent").Return(30*time.Minute, nil)
+		oh.On("GetSystemUptime").Return(2*time.Hour, nil)
+		return newTestApp(nil, oh), agent, oh
+	}
+
+	t.Run("no restart when running agent already has the flags", func(t *testing.T) {
+		app, agent, oh := setup(t, header+"FLAG=true\n"+footer)
+		oh.On("GetServiceEnviron", "test-agent").Return(map[string]string{"PATH": "/usr/bin", flagKey: flagValTrue}, nil).Once()
+
+		restarted, _ := apply(context.Background(), app, &agentmanager.GetVersionResponse{FeatureFlags: flags}, agent)
+
+		assert.False(t, restarted)
+		agent.AssertNotCalled(t, "Restart")
+		oh.AssertExpectations(t)
+	})
+
+	t.Run("no restart when agent is not running", func(t *testing.T) {
+		app, agent, oh := setup(t, header+"FLAG=true\n"+footer)
+		oh.On("GetServiceEnviron", "test-agent").Return(nil, fmt.Errorf("test-agent: %w", osutils.ErrServiceNotRunning)).Once()
+
+		restarted, _ := apply(context.Background(), app, &agentmanager.GetVersionResponse{FeatureFlags: flags}, agent)
+
+		assert.False(t, restarted)
+		agent.AssertNotCalled(t, "Restart")
+	})
+
+	t.Run("stale value restarts and is verified", func(t *testing.T) {
+		app, agent, oh := setup(t, header+"FLAG=false\n"+footer)
+		oh.On("GetServiceEnviron", "test-agent").Return(map[string]string{flagKey: "false"}, nil).Once()
+		oh.On("GetServiceEnviron", "test-agent").Return(map[string]string{flagKey: flagValTrue}, nil).Once()
+		agent.On("Restart").Return(nil).Once()
+
+		restarted, _ := apply(context.Background(), app, &agentmanager.GetVersionResponse{FeatureFlags: flags}, agent)
+
+		assert.True(t, restarted)
+		agent.AssertNotCalled(t, "AddNotice", mock.Anything)
+		agent.AssertExpectations(t)
+		oh.AssertExpectations(t)
+	})
+
+	t.Run("removed flag still set in the running agent restarts", func(t *testing.T) {
+		app, agent, oh := setup(t, header+"FLAG=true\nOLD=1\n"+footer)
+		oh.On("GetServiceEnviron", "test-agent").Return(map[string]string{flagKey: flagValTrue, "OLD": "1"}, nil).Once()
+		oh.On("GetServiceEnviron", "test-agent").Return(map[string]string{flagKey: flagValTrue}, nil).Once()
+		agent.On("Restart").Return(nil).Once()
+
+		restarted, _ := apply(context.Background(), app, &agentmanager.GetVersionResponse{FeatureFlags: flags}, agent)
+
+		assert.True(t, restarted)
+		agent.AssertExpectations(t)
+	})
+
+	t.Run("mismatch after restart is reported", func(t *testing.T) {
+		app, agent, oh := setup(t, header+"FLAG=false\n"+footer)
+		oh.On("GetServiceEnviron", "test-agent").Return(map[string]string{flagKey: "false"}, nil)
+		agent.On("Restart").Return(nil).Once()
+		agent.On("AddNotice", "agent restarted but running environment is stale: FLAG").Return().Once()
+
+		restarted, _ := apply(context.Background(), app, &agentmanager.GetVersionResponse{FeatureFlags: flags}, agent)
+
+		assert.True(t, restarted)
+		agent.AssertExpectations(t)
+	})
+
+	t.Run("keys still stale after a restart are not restarted for again", func(t *testing.T) {
+		app, agent, oh := setup(t, header+"FLAG=false\n"+footer)
+		oh.On("GetServiceEnviron", "test-agent").Return(map[string]string{flagKey: "false"}, nil)
+		agent.On("Restart").Return(nil).Once()
+		agent.On("AddNotice", "agent restarted but running environment is stale: FLAG").Return().Once()
+		agent.On("AddNotice", "running environment is stale after restart, not restarting again: FLAG").Return().Twice()
+
+		for i := range 3 {
+			restarted, _ := apply(context.Background(), app, &agentmanager.GetVersionResponse{FeatureFlags: flags}, agent)
+			assert.Equal(t, i == 0, restarted)
+		}
+		agent.AssertNumberOfCalls(t, "Restart", 1)
+
+		// A new flag set is worth another restart.
+		agent.On("Restart").Return(nil).Once()
+		agent.On("AddNotice", "agent restarted but running environment is stale: FLAG").Return().Once()
+		restarted, _ := apply(context.Background(), app, &agentmanager.GetVersionResponse{FeatureFlags: map[string]string{flagKey: "other"}}, agent)
+		assert.True(t, restarted)
+		agent.AssertExpectations(t)
+	})
+
+	t.Run("only managed keys are compared", func(t *testing.T) {
+		// OTHER comes from an operator line, and the unit overrides it;
+		// LEVEL is managed but an operator line after the block wins.
+		app, agent, oh := setup(t, "OTHER=$HOME/x\n"+header+"FLAG=true\nLEVEL=info\n"+footer+"LEVEL=debug\n")
+		oh.On("GetServiceEnviron", "test-agent").Return(map[string]string{flagKey: flagValTrue, "OTHER": "/root/x", "LEVEL": "warn"}, nil).Once()
+		agent.On("AddNotice", mock.Anything).Return().Maybe()
+
+		restarted, _ := apply(context.Background(), app, &agentmanager.GetVersionResponse{FeatureFlags: map[string]string{flagKey: flagValTrue, "LEVEL": "info"}}, agent)
+
+		assert.False(t, restarted)
+		agent.AssertNotCalled(t, "Restart")
+		oh.AssertExpectations(t)
+	})
+}
+
 func TestApp_validateFeatureFlags(t *testing.T) {
 	app := newTestApp(nil, nil)
 
@@ -908,9 +1807,286 @@ func TestApp_poll_restart_with_feature_flag_change(t *testing.T) {
 
 	app := newTestApp(client, oh)
 
-	app.poll(agent)
+	app.poll(context.Background(), agent)
 
 	client.AssertExpectations(t)
 	agent.AssertExpectations(t)
 	oh.AssertExpectations(t)
 }
+
+func TestApp_poll_update_with_feature_flag_change(t *testing.T) {
+	setup := func(t *testing.T) (*App, *MockAgentData, *MockOSHelper) {
+		client := &MockUpdaterClient{}
+		agent := &MockAgentData{}
+		oh := &MockOSHelper{environ: true}
+		envPath := t.TempDir() + "/environment"
+
+		client.On("SendAgentData", mock.Anything).Return(&agentmanager.GetVersionResponse{
+			Action:       agentmanager.Action_UPDATE,
+			Response:     &agentmanager.GetVersionResponse_Update{Update: &agentmanager.UpdateActionParams{Version: testVersion}},
+			FeatureFlags: map[string]string{flagKey: flagValTrue},
+		}, nil)
+		agent.On("GetServiceName").Return("test-agent")
+		agent.On("GetEnvironmentFilePath").Return(envPath)
+		agent.On("GetLastSeenConfigVersion").Return(uint64(0))
+		agent.On("Update", mock.Anything, testVersion).Run(func(mock.Arguments) {
+			content, err := os.ReadFile(envPath)
+			require.NoError(t, err)
+			assert.Contains(t, string(content), "FLAG=true", "environment must be written before the install")
+		}).Return(nil).Once()
+		oh.On("GetSystemUptime").Return(time.Hour, nil)
+		oh.On("GetDebVersion", mock.Anything).Return(testVersion, nil)
+		oh.On("GetServiceUptime", "test-agent").Return(20*time.Minute, nil)
+		return newTestApp(client, oh), agent, oh
+	}
+
+	t.Run("install restart picks up the flags", func(t *testing.T) {
+		app, agent, oh := setup(t)
+		oh.On("GetServiceEnviron", "test-agent").Return(map[string]string{flagKey: flagValTrue}, nil).Once()
+
+		app.poll(context.Background(), agent)
+
+		agent.AssertNotCalled(t, "Restart")
+		agent.AssertExpectations(t)
+		oh.AssertExpectations(t)
+	})
+
+	t.Run("agent still stale after install is restarted once", func(t *testing.T) {
+		app, agent, oh := setup(t)
+		oh.On("GetServiceEnviron", "test-agent").Return(map[string]string{}, nil).Once()
+		oh.On("GetServiceEnviron", "test-agent").Return(map[string]string{flagKey: flagValTrue}, nil).Once()
+		agent.On("Restart").Return(nil).Once()
+
+		app.poll(context.Background(), agent)
+
+		agent.AssertNumberOfCalls(t, "Restart", 1)
+		agent.AssertExpectations(t)
+		oh.AssertExpectations(t)
+	})
+}
+
+func TestApp_MaintenanceWindowDefersActions(t *testing.T) {
+	t.Run("update deferred", func(t *testing.T) {
+		agent := &MockAgentData{}
+		oh := &MockOSHelper{}
+		agent.On("GetServiceName").Return("test-agent")
+		agent.On("GetEnvironmentFilePath").Return("")
+		agent.On("AddNotice", "update to 1.0.1 deferred: outside maintenance window").Once()
+		oh.On("GetSystemUptime").Return(20*time.Minute, nil)
+
+		app := newTestApp(nil, oh)
+		app.config.MaintenanceWindows = closedMaintenanceWindows()
+		apply(context.Background(), app, &agentmanager.GetVersionResponse{
+			Action:   agentmanager.Action_UPDATE,
+			Response: &agentmanager.GetVersionResponse_Update{Update: &agentmanager.UpdateActionParams{Version: testVersion}},
+		}, agent)
+
+		agent.AssertNotCalled(t, "Update", mock.Anything, mock.Anything)
+		agent.AssertExpectations(t)
+		oh.AssertExpectations(t)
+	})
+
+	t.Run("restart deferred", func(t *testing.T) {
+		agent := &MockAgentData{}
+		agent.On("GetServiceName").Return("test-agent")
+		agent.On("GetEnvironmentFilePath").Return("")
+		agent.On("AddNotice", "restart deferred: outside maintenance window").Once()
+
+		app := newTestApp(nil, nil)
+		app.config.MaintenanceWindows = closedMaintenanceWindows()
+		apply(context.Background(), app, restartResponse, agent)
+
+		agent.AssertNotCalled(t, "Restart")
+		agent.AssertExpectations(t)
+	})
+
+	t.Run("feature flag restart deferred but file written", func(t *testing.T) {
+		header := envBlockBegin + "\n"
+		footer := envBlockEnd + "\n"
+		agent := &MockAgentData{}
+		oh := &MockOSHelper{}
+		envPath := t.TempDir() + "/environment"
+
+		agent.On("GetEnvironmentFilePath").Return(envPath)
+		agent.On("GetServiceName").Return("test-agent")
+		agent.On("AddNotice", "restart after feature flags change deferred: outside maintenance window").Once()
+		oh.On("GetServiceUptime", "test-agent").Return(20*time.Minute, nil)
+		oh.On("GetSystemUptime").Return(1*time.Hour, nil)
+
+		app := newTestApp(nil, oh)
+		app.config.MaintenanceWindows = closedMaintenanceWindows()
+		restarted, _ := apply(context.Background(), app, &agentmanager.GetVersionResponse{
+			FeatureFlags: map[string]string{flagKey: flagValTrue},
+		}, agent)
+
+		assert.False(t, restarted)
+		content, err := os.ReadFile(envPath)
+		assert.NoError(t, err)
+		assert.Equal(t, header+"FLAG=true\n"+footer, string(content))
+		agent.AssertNotCalled(t, "Restart")
+		agent.AssertExpectations(t)
+		oh.AssertExpectations(t)
+	})
+}
+
+func readJournal(t *testing.T, stateDir string) []journal.Entry {
+	t.Helper()
+	f, err := os.Open(stateDir + "/actions.jsonl")
+	if !assert.NoError(t, err) {
+		return nil
+	}
+	defer f.Close()
+	var entries []journal.Entry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e journal.Entry
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), &e))
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func TestApp_JournalRecordsActions(t *testing.T) {
+	client := &MockUpdaterClient{}
+	agent := &MockAgentData{}
+	oh := &MockOSHelper{}
+	stateDir := t.TempDir()
+	envPath := t.TempDir() + "/environment"
+
+	writeEnvFile(t, envPath, "OLD=1\nKEEP=1\n", time.Now().Add(-1*time.Hour))
+
+	client.On("SendAgentData", mock.Anything).Return(&agentmanager.GetVersionResponse{
+		Action:        agentmanager.Action_RESTART,
+		ConfigVersion: 5,
+		FeatureFlags:  map[string]string{"KEEP": "2", "NEW": "1"},
+	}, nil)
+	agent.On("GetServiceName").Return("test-agent")
+	agent.On("GetEnvironmentFilePath").Return(envPath)
+	agent.On("GetLastSeenConfigVersion").Return(uint64(4))
+	agent.On("SetLastSeenConfigVersion", uint64(5)).Return()
+	agent.On("Restart").Return(nil).Once()
+	oh.On("GetServiceUptime", "test-agent").Return(20*time.Minute, nil)
+	oh.On("GetSystemUptime").Return(1*time.Hour, nil)
+
+	app := newTestApp(client, oh)
+	app.journal = journal.New(stateDir, app.logger, app.fileGuard)
+	app.poll(context.Background(), agent)
+
+	entries := readJournal(t, stateDir)
+	if assert.Len(t, entries, 3) {
+		assert.Equal(t, journal.ActionEnvWrite, entries[0].Action)
+		assert.Equal(t, journal.TriggerFeatureFlags, entries[0].Trigger)
+		assert.Equal(t, map[string]string{"flags_added": "NEW", "flags_removed": "OLD", "flags_changed": "KEEP"}, entries[0].Input)
+
+		assert.Equal(t, journal.ActionRestart, entries[1].Action)
+		assert.Equal(t, journal.TriggerFeatureFlags, entries[1].Trigger)
+		assert.Equal(t, journal.OutcomeOK, entries[1].Outcome)
+
+		assert.Equal(t, journal.ActionConfigAck, entries[2].Action)
+		assert.Equal(t, "5", entries[2].Input["config_version"])
+		assert.Equal(t, "test-agent", entries[2].Agent)
+	}
+	agent.AssertExpectations(t)
+}
+
+func TestApp_RestartLimit(t *testing.T) {
+	t.Run("restarts over budget are refused and reported", func(t *testing.T) {
+		agent := &MockAgentData{}
+		agent.On("GetServiceName").Return("test-agent")
+		agent.On("GetEnvironmentFilePath").Return("")
+		agent.On("Restart").Return(nil).Twice()
+		agent.On("AddNotice", mock.MatchedBy(func(msg string) bool {
+			return strings.Contains(msg, "budget of 2 restarts per 1h0m0s exhausted")
+		})).Once()
+
+		app := newTestApp(nil, nil)
+		app.restarts = restartlimit.New(restartlimit.Config{MaxRestarts: 2, Window: time.Hour}, t.TempDir(), nil, app.logger, app.fileGuard)
+		apply(context.Background(), app, restartResponse, agent)
+		apply(context.Background(), app, restartResponse, agent)
+		apply(context.Background(), app, restartResponse, agent)
+
+		agent.AssertNumberOfCalls(t, "Restart", 2)
+		agent.AssertExpectations(t)
+	})
+
+	t.Run("feature flag restart refused while crash-looping", func(t *testing.T) {
+		agent := &MockAgentData{}
+		oh := &MockOSHelper{}
+		envPath := t.TempDir() + "/environment"
+
+		agent.On("GetEnvironmentFilePath").Return(envPath)
+		agent.On("GetServiceName").Return("test-agent")
+		agent.On("AddNotice", mock.MatchedBy(func(msg string) bool { return strings.Contains(msg, "crash-looping") })).Once()
+		oh.On("GetServiceUptime", "test-agent").Return(time.Minute, nil)
+		oh.On("GetSystemUptime").Return(10*time.Minute, nil)
+		oh.On("GetServiceRestartCount", "test-agent").Return(5, nil)
+
+		app := newTestApp(nil, oh)
+		app.restarts = restartlimit.New(restartlimit.GetDefaultConfig(), "", oh, app.logger, app.fileGuard)
+		restarted, _ := apply(context.Background(), app, &agentmanager.GetVersionResponse{
+			FeatureFlags: map[string]string{flagKey: flagValTrue},
+		}, agent)
+
+		assert.False(t, restarted)
+		agent.AssertNotCalled(t, "Restart")
+		agent.AssertExpectations(t)
+		oh.AssertExpectations(t)
+	})
+}
+
+func TestApp_ObserveOnly(t *testing.T) {
+	updateResponse := &agentmanager.GetVersionResponse{
+		Action:        agentmanager.Action_UPDATE,
+		Response:      &agentmanager.GetVersionResponse_Update{Update: &agentmanager.UpdateActionParams{Version: testVersion}},
+		ConfigVersion: 3,
+		FeatureFlags:  map[string]string{flagKey: flagValTrue},
+	}
+
+	t.Run("config switch suspends every mutation", func(t *testing.T) {
+		client := &MockUpdaterClient{}
+		agent := &MockAgentData{}
+		oh := &MockOSHelper{}
+		envPath := t.TempDir() + "/environment"
+
+		client.On("SendAgentData", mock.Anything).Return(updateResponse, nil)
+		agent.On("GetServiceName").Return("test-agent")
+		agent.On("GetEnvironmentFilePath").Return(envPath)
+		agent.On("GetLastSeenConfigVersion").Return(uint64(0))
+		agent.On("AddNotice", "observe-only: would have rewritten environment file "+envPath).Once()
+		agent.On("AddNotice", "observe-only: would have updated agent to 1.0.1").Once()
+		agent.On("AddNotice", "observe-only: would have acknowledged config version 3").Once()
+		oh.On("GetSystemUptime").Return(time.Hour, nil)
+		oh.On("GetDebVersion", mock.Anything).Return("1.0.0", nil)
+
+		app := newTestApp(client, oh)
+		app.config.ObserveOnly = true
+		app.poll(context.Background(), agent)
+
+		_, err := os.Stat(envPath)
+		assert.True(t, os.IsNotExist(err), "environment file must not be written")
+		agent.AssertNotCalled(t, "Update", mock.Anything, mock.Anything)
+		agent.AssertNotCalled(t, "SetLastSeenConfigVersion", mock.Anything)
+		client.AssertExpectations(t)
+		agent.AssertExpectations(t)
+	})
+
+	t.Run("pause file toggles at runtime", func(t *testing.T) {
+		agent := &MockAgentData{}
+		agent.On("GetServiceName").Return("test-agent")
+		agent.On("GetEnvironmentFilePath").Return("")
+		agent.On("AddNotice", "observe-only: would have restarted agent").Once()
+		agent.On("Restart").Return(nil).Once()
+
+		app := newTestApp(nil, nil)
+		app.config.StateDir = t.TempDir()
+		pausePath := app.config.StateDir + "/" + PauseFileName
+
+		assert.NoError(t, os.WriteFile(pausePath, nil, 0640))
+		apply(context.Background(), app, restartResponse, agent)
+		agent.AssertNotCalled(t, "Restart")
+
+		assert.NoError(t, os.Remove(pausePath))
+		apply(context.Background(), app, restartResponse, agent)
+		agent.AssertExpectations(t)
+	})
+}
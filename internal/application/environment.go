@@ -0,0 +1,394 @@
+package application
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nebius/gosdk/proto/nebius/logging/v1/agentmanager"
+	"github.com/nebius/nebius-observability-agent-updater/internal/agents"
+	"github.com/nebius/nebius-observability-agent-updater/internal/envfile"
+	"github.com/nebius/nebius-observability-agent-updater/internal/journal"
+	"github.com/nebius/nebius-observability-agent-updater/internal/osutils"
+	"github.com/nebius/nebius-observability-agent-updater/internal/policy"
+)
+
+const (
+	// envBlockBegin opens the part of the agent environment file the updater
+	// owns. Earlier versions wrote it as the header of a file they owned
+	// entirely, so such files read as a block running to the end of the file.
+	envBlockBegin = "# Managed by agent updater. Variables are loaded as env vars at agent startup."
+	envBlockEnd   = "# End of agent updater managed block. Lines outside it are kept as is."
+
+	// envOverridesSuffix names the optional operator overrides file next to
+	// the environment file, e.g. /etc/nebius-observability-agent/environment.local.
+	// Its variables take precedence over server feature flags.
+	envOverridesSuffix = ".local"
+)
+
+// envSections is an environment file split around the managed block.
+type envSections struct {
+	before  string
+	managed string
+	after   string
+}
+
+// splitEnvironmentFile splits content around the managed block. Content
+// without a begin marker predates the block and is treated as managed in full;
+// a begin marker without an end marker extends the block to the end.
+func splitEnvironmentFile(content string) envSections {
+	lines := strings.SplitAfter(content, "\n")
+	begin, end := -1, len(lines)
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if begin < 0 && trimmed == envBlockBegin {
+			begin = i
+		} else if begin >= 0 && trimmed == envBlockEnd {
+			end = i
+			break
+		}
+	}
+	if begin < 0 {
+		return envSections{managed: content}
+	}
+	sections := envSections{
+		before:  strings.Join(lines[:begin], ""),
+		managed: strings.Join(lines[begin+1:end], ""),
+	}
+	if end < len(lines) {
+		sections.after = strings.Join(lines[end+1:], "")
+	}
+	return sections
+}
+
+// render returns the file with the managed block holding vars and everything
+// outside it unchanged.
+func (e envSections) render(vars map[string]string) string {
+	var sb strings.Builder
+	sb.WriteString(e.before)
+	if e.before != "" && !strings.HasSuffix(e.before, "\n") {
+		sb.WriteByte('\n')
+	}
+	sb.WriteString(envBlockBegin + "\n")
+	sb.WriteString(envfile.Format(vars))
+	sb.WriteString(envBlockEnd + "\n")
+	sb.WriteString(e.after)
+	return sb.String()
+}
+
+// envStep is the environment file an agent should run with.
+type envStep struct {
+	path         string
+	featureFlags map[string]string
+	// existing holds the variables of the managed block on disk, content
+	// the file as it should be.
+	existing map[string]string
+	content  string
+	changed  bool
+	// desired is what systemd loads from content; removed lists the keys
+	// of existing that content drops.
+	desired map[string]string
+	removed []string
+	// expected holds the managed variables the running agent is checked
+	// against. Variables outside the managed block, and managed keys that
+	// lines outside it override, are the operator's and never compared.
+	expected map[string]string
+}
+
+// unloadedEnv remembers, per agent, the managed keys that were still stale
+// right after a restart. Restarting again would not help, e.g. because the
+// unit overrides them with Environment= or UnsetEnvironment=, so they no
+// longer trigger restarts until the environment file is rewritten.
+type unloadedEnv struct {
+	mu   sync.Mutex
+	keys map[string][]string
+}
+
+func (u *unloadedEnv) set(agent string, keys []string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if len(keys) == 0 {
+		delete(u.keys, agent)
+		return
+	}
+	if u.keys == nil {
+		u.keys = make(map[string][]string)
+	}
+	u.keys[agent] = keys
+}
+
+// split separates the stale keys of agent into those still worth a restart
+// and those that did not load after the last one.
+func (u *unloadedEnv) split(agent string, stale []string) (retry, unloaded []string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for _, k := range stale {
+		if slices.Contains(u.keys[agent], k) {
+			unloaded = append(unloaded, k)
+		} else {
+			retry = append(retry, k)
+		}
+	}
+	return retry, unloaded
+}
+
+// planEnvironment returns the environment file the feature flags in response
+// call for, or nil if the file is not managed or must be left alone. An error
+// means the current file could not be read.
+func (s *App) planEnvironment(response *agentmanager.GetVersionResponse, agent agents.AgentData) (*envStep, error) {
+	if response.GetFeatureFlagsUnavailable() {
+		s.logger.Warn("Server reports feature flags unavailable, keeping current flag set", "agent", agent.GetServiceName())
+		return nil, nil
+	}
+
+	envPath := agent.GetEnvironmentFilePath()
+	if envPath == "" {
+		return nil, nil
+	}
+
+	featureFlags := s.validateFeatureFlags(response.GetFeatureFlags())
+
+	existingContent, err := s.fileGuard.ReadFile(envPath, envFileIOTimeout)
+	fileExists := err == nil
+	if err != nil && !os.IsNotExist(err) {
+		s.logger.Error("Failed to read environment file", "error", err, "path", envPath)
+		return nil, fmt.Errorf("failed to read %s: %w", envPath, err)
+	}
+	// Without the overrides the block would lose the operator's variables, so
+	// leave the file alone until they can be read.
+	overrides, err := s.readEnvOverrides(envPath)
+	if err != nil {
+		s.logger.Error("Failed to read environment overrides", "error", err, "agent", agent.GetServiceName())
+		return nil, err
+	}
+	managed := mergeEnv(featureFlags, overrides)
+
+	// Compare what systemd would load rather than the text, so hand edits that
+	// only reorder lines or change quoting do not cause a rewrite and restart.
+	sections := splitEnvironmentFile(string(existingContent))
+	existingManaged := envfile.Parse(sections.managed)
+
+	// No flags and no existing file (or file without assignments) — nothing to do,
+	// avoid creating a header-only file that would trigger a spurious restart.
+	if len(managed) == 0 && (!fileExists || len(existingManaged) == 0) {
+		return nil, nil
+	}
+
+	step := &envStep{
+		path:         envPath,
+		featureFlags: featureFlags,
+		existing:     existingManaged,
+		content:      string(existingContent),
+		changed:      !maps.Equal(existingManaged, managed),
+	}
+	if step.changed {
+		if !s.mutationAllowed(agent, "rewritten environment file "+envPath) {
+			return nil, nil
+		}
+		step.content = sections.render(managed)
+	}
+	step.desired = envfile.Parse(step.content)
+	for k := range existingManaged {
+		if _, found := step.desired[k]; !found {
+			step.removed = append(step.removed, k)
+		}
+	}
+	step.expected = make(map[string]string, len(managed))
+	for k, v := range managed {
+		if step.desired[k] == v {
+			step.expected[k] = v
+		}
+	}
+	return step, nil
+}
+
+// writeEnvironment writes step to disk if it changed.
+func (s *App) writeEnvironment(agent agents.AgentData, step *envStep) error {
+	if step.changed {
+		s.logger.Info("Feature flags changed, updating environment file", "agent", agent.GetServiceName(), "path", step.path)
+		start := time.Now()
+		err := s.fileGuard.WriteFileAtomic(step.path, []byte(step.content), 0640, envFileIOTimeout)
+		s.journal.Record(agent.GetServiceName(), journal.ActionEnvWrite, journal.TriggerFeatureFlags,
+			flagDiff(step.existing, step.desired), start, err)
+		if err != nil {
+			s.logger.Error("Failed to write environment file", "error", err, "path", step.path)
+			return err
+		}
+		s.unloadedEnv.set(agent.GetServiceName(), nil)
+	}
+	s.reportEffectiveEnvironment(agent, step.desired, step.featureFlags, step.changed)
+	return nil
+}
+
+// envRestartNeeded reports whether the running agent has to be restarted to
+// pick up step. It is evaluated after the install, whose maintainer scripts
+// may already have restarted the agent with the new file. An error means the
+// need could not be determined.
+func (s *App) envRestartNeeded(ctx context.Context, agent agents.AgentData, step *envStep) (bool, error) {
+	agentUptime, err := s.oh.GetServiceUptime(ctx, agent.GetServiceName())
+	if err != nil {
+		s.logger.Error("Failed to get agent uptime", "error", err)
+		return false, fmt.Errorf("failed to get agent uptime: %w", err)
+	}
+
+	systemUptime, sysErr := s.oh.GetSystemUptime(ctx)
+	freshBoot := sysErr == nil && systemUptime < freshBootUptime
+
+	stale, err := s.staleEnvironmentKeys(ctx, agent, step.expected, step.removed)
+	if len(stale) > 0 {
+		var unloaded []string
+		if stale, unloaded = s.unloadedEnv.split(agent.GetServiceName(), stale); len(unloaded) > 0 {
+			s.logger.Warn("Not restarting for environment the agent did not load after the last restart", "keys", unloaded, "agent", agent.GetServiceName())
+			agent.AddNotice("running environment is stale after restart, not restarting again: " + strings.Join(unloaded, ", "))
+		}
+	}
+	switch {
+	case errors.Is(err, osutils.ErrServiceNotRunning):
+		// systemd loads the file when the agent starts.
+		return false, nil
+	case err != nil:
+		s.logger.Warn("Failed to inspect running agent environment, falling back to file modification time", "error", err, "agent", agent.GetServiceName())
+		newer, err := s.envFileNewerThanAgent(step.path, agentUptime, freshBoot)
+		if err != nil {
+			s.logger.Error("Failed to stat environment file", "error", err, "path", step.path)
+			return false, fmt.Errorf("failed to stat %s: %w", step.path, err)
+		}
+		if !newer {
+			return false, nil
+		}
+	case len(stale) == 0:
+		return false, nil
+	default:
+		s.logger.Info("Running agent has stale environment", "keys", stale, "agent", agent.GetServiceName())
+	}
+	if !s.policyAllows(ctx, agent, policy.ActionFlagsRestart, "restart after feature flags change") {
+		return false, nil
+	}
+	if !s.inMaintenanceWindow(agent, "restart after feature flags change") {
+		return false, nil
+	}
+	if !s.mutationAllowed(agent, "restarted agent after feature flags change") {
+		return false, nil
+	}
+	s.logger.Info("Feature flags change requires agent restart",
+		"agent", agent.GetServiceName(), "agent_uptime", agentUptime.String(), "system_uptime", systemUptime.String())
+	return true, nil
+}
+
+// readEnvOverrides returns the variables of the overrides file for envPath,
+// or nil if there is none.
+func (s *App) readEnvOverrides(envPath string) (map[string]string, error) {
+	path := envPath + envOverridesSuffix
+	content, err := s.fileGuard.ReadFile(path, envFileIOTimeout)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read environment overrides %s: %w", path, err)
+	}
+	return envfile.Parse(string(content)), nil
+}
+
+// mergeEnv returns featureFlags with overrides applied on top.
+func mergeEnv(featureFlags, overrides map[string]string) map[string]string {
+	merged := make(map[string]string, len(featureFlags)+len(overrides))
+	maps.Copy(merged, featureFlags)
+	maps.Copy(merged, overrides)
+	return merged
+}
+
+// reportEffectiveEnvironment logs the variables the agent gets from its
+// environment file and reports those that differ from the server feature
+// flags, whether from the overrides file or from operator lines outside the
+// managed block.
+func (s *App) reportEffectiveEnvironment(agent agents.AgentData, effective, featureFlags map[string]string, changed bool) {
+	if changed {
+		s.logger.Info("Effective agent environment", "environment", effective, "agent", agent.GetServiceName())
+	} else {
+		s.logger.Debug("Effective agent environment", "environment", effective, "agent", agent.GetServiceName())
+	}
+	var local []string
+	for k, v := range effective {
+		if flag, found := featureFlags[k]; !found || flag != v {
+			local = append(local, k+"="+v)
+		}
+	}
+	if len(local) == 0 {
+		return
+	}
+	sort.Strings(local)
+	agent.AddNotice("local environment overrides in effect: " + strings.Join(local, ", "))
+}
+
+// staleEnvironmentKeys compares the environment of the running agent process
+// with expected and returns, sorted, the keys it lacks or has a different
+// value for, plus the removed keys it still has. It returns an error wrapping
+// osutils.ErrServiceNotRunning if the agent has no main process.
+func (s *App) staleEnvironmentKeys(ctx context.Context, agent agents.AgentData, expected map[string]string, removed []string) ([]string, error) {
+	running, err := s.oh.GetServiceEnviron(ctx, agent.GetServiceName())
+	if err != nil {
+		return nil, err
+	}
+	var stale []string
+	for k, v := range expected {
+		if current, found := running[k]; !found || current != v {
+			stale = append(stale, k)
+		}
+	}
+	for _, k := range removed {
+		if _, found := running[k]; found {
+			stale = append(stale, k)
+		}
+	}
+	sort.Strings(stale)
+	return stale, nil
+}
+
+// envFileNewerThanAgent is the fallback when the running environment cannot
+// be read: the file counts as newer if it was modified after the agent
+// started, allowing restartGracePeriod for clock skew unless the node has
+// just booted.
+func (s *App) envFileNewerThanAgent(envPath string, agentUptime time.Duration, freshBoot bool) (bool, error) {
+	fileInfo, err := s.fileGuard.Stat(envPath, envFileIOTimeout)
+	if err != nil {
+		return false, err
+	}
+	gracePeriod := restartGracePeriod
+	if freshBoot {
+		gracePeriod = 0
+	}
+	agentStartTime := time.Now().Add(-agentUptime)
+	return fileInfo.ModTime().After(agentStartTime.Add(gracePeriod)), nil
+}
+
+// verifyRunningEnvironment checks that the restarted agent picked up step and
+// reports the keys it did not, which are not restarted for again. An error
+// means the restart did not take effect; an agent whose environment cannot be
+// read is not a failure.
+func (s *App) verifyRunningEnvironment(ctx context.Context, agent agents.AgentData, step *envStep) error {
+	stale, err := s.staleEnvironmentKeys(ctx, agent, step.expected, step.removed)
+	if err == nil {
+		s.unloadedEnv.set(agent.GetServiceName(), stale)
+	}
+	switch {
+	case errors.Is(err, osutils.ErrServiceNotRunning):
+		s.logger.Warn("Agent not running after restart, cannot verify environment", "agent", agent.GetServiceName())
+		return err
+	case err != nil:
+		s.logger.Warn("Failed to verify agent environment after restart", "error", err, "agent", agent.GetServiceName())
+	case len(stale) > 0:
+		s.logger.Error("Restarted agent did not pick up environment", "keys", stale, "agent", agent.GetServiceName())
+		agent.AddNotice("agent restarted but running environment is stale: " + strings.Join(stale, ", "))
+		return fmt.Errorf("running environment is stale: %s", strings.Join(stale, ", "))
+	default:
+		s.logger.Info("Restarted agent picked up environment", "agent", agent.GetServiceName())
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package application
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/nebius/nebius-observability-agent-updater/internal/agents"
+)
+
+// PauseFileName is the file in StateDir whose presence switches the updater
+// to observe-only mode at runtime; removing it resumes normal operation.
+const PauseFileName = "pause"
+
+// pauseFileIOTimeout bounds the pause-file stat. Declared as var so tests can
+// shorten it.
+var pauseFileIOTimeout = 5 * time.Second
+
+// observeOnly reports whether mutating actions are suspended, either by
+// config or by the pause file. If the pause file cannot be checked the
+// updater errs on the side of not touching the agent.
+func (s *App) observeOnly() bool {
+	paused := s.config.ObserveOnly
+	if !paused && s.config.StateDir != "" {
+		path := filepath.Join(s.config.StateDir, PauseFileName)
+		_, err := s.fileGuard.Stat(path, pauseFileIOTimeout)
+		switch {
+		case err == nil:
+			paused = true
+		case !os.IsNotExist(err):
+			s.logger.Warn("Failed to check pause file, assuming observe-only mode", "error", err, "path", path)
+			paused = true
+		}
+	}
+	if s.paused.Swap(paused) != paused {
+		if paused {
+			s.logger.Warn("Observe-only mode enabled, mutating actions are suspended")
+		} else {
+			s.logger.Info("Observe-only mode disabled, resuming normal operation")
+		}
+	}
+	return paused
+}
+
+// mutationAllowed returns false in observe-only mode, logging and reporting
+// the action that would otherwise have been taken.
+func (s *App) mutationAllowed(agent agents.AgentData, wouldHave string) bool {
+	if !s.observeOnly() {
+		return true
+	}
+	s.logger.Info("Observe-only mode, skipping action", "would_have", wouldHave, "agent", agent.GetServiceName())
+	agent.AddNotice("observe-only: would have " + wouldHave)
+	return false
+}
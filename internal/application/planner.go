@@ -0,0 +1,178 @@
+package application
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/nebius/gosdk/proto/nebius/logging/v1/agentmanager"
+	"github.com/nebius/nebius-observability-agent-updater/internal/agents"
+	"github.com/nebius/nebius-observability-agent-updater/internal/journal"
+	"github.com/nebius/nebius-observability-agent-updater/internal/restartlimit"
+)
+
+// actionPlan is what one poll response asks of an agent, in the order it is
+// carried out: write the environment file, install, restart at most once,
+// verify. Writing the environment before the install means a restart done by
+// the package maintainer scripts already loads the new flags, so a second
+// restart for the flags is only needed if the running agent is still stale.
+type actionPlan struct {
+	// env is the environment file the agent should run with; nil if the
+	// file is not managed for this response.
+	env *envStep
+	// install is the package version to install; nil if no update is due.
+	install *installStep
+	// restart is set when the server asked for a restart.
+	restart bool
+}
+
+type installStep struct {
+	targetVersion   string
+	previousVersion string
+}
+
+func (p actionPlan) empty() bool {
+	return p.env == nil && p.install == nil && !p.restart
+}
+
+// steps describes the plan for the log.
+func (p actionPlan) steps() []string {
+	var steps []string
+	if p.env != nil && p.env.changed {
+		steps = append(steps, "write environment file")
+	}
+	if p.install != nil {
+		steps = append(steps, "install "+p.install.targetVersion)
+	}
+	switch {
+	case p.restart:
+		steps = append(steps, "restart")
+	case p.env != nil:
+		steps = append(steps, "restart if running environment is stale")
+	}
+	if p.install != nil {
+		steps = append(steps, "verify update")
+	}
+	if p.env != nil {
+		steps = append(steps, "verify environment after restart")
+	}
+	return steps
+}
+
+// stepErrors collects the steps of a plan that failed. Deliberate deferrals
+// (maintenance window, uptime gates, restart budget, observe-only) are not
+// failures: the next poll evaluates them again.
+type stepErrors []error
+
+func (e stepErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (e stepErrors) Unwrap() []error {
+	return e
+}
+
+// err returns e as an error, or nil if no step failed.
+func (e stepErrors) err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+// plan decides what response asks of agent. Gates that do not depend on the
+// outcome of earlier steps (policy, maintenance window, observe-only) are
+// evaluated here; whether the flags need a restart is only known after the
+// install and is decided by execute. Steps that could not be planned are
+// returned as failures.
+func (s *App) plan(ctx context.Context, response *agentmanager.GetVersionResponse, agent agents.AgentData) (actionPlan, stepErrors) {
+	var p actionPlan
+	var failed stepErrors
+	var err error
+	if p.env, err = s.planEnvironment(response, agent); err != nil {
+		failed = append(failed, fmt.Errorf("environment file: %w", err))
+	}
+	switch response.Action {
+	case agentmanager.Action_UPDATE:
+		if p.install, err = s.planInstall(ctx, response, agent); err != nil {
+			failed = append(failed, fmt.Errorf("update: %w", err))
+		}
+	case agentmanager.Action_RESTART:
+		p.restart = s.planRestart(ctx, agent)
+	}
+	if response.Action != agentmanager.Action_UPDATE {
+		s.clearQuarantineReport(agent)
+	}
+	return p, failed
+}
+
+// execute carries out p. It reports whether the agent was restarted by the
+// updater and which steps failed.
+func (s *App) execute(ctx context.Context, agent agents.AgentData, p actionPlan) (bool, stepErrors) {
+	if p.empty() {
+		return false, nil
+	}
+	s.logger.Info("Executing action plan", "steps", p.steps(), "agent", agent.GetServiceName())
+
+	var failed stepErrors
+	if p.env != nil {
+		if err := s.writeEnvironment(agent, p.env); err != nil {
+			failed = append(failed, fmt.Errorf("write environment file: %w", err))
+			p.env = nil
+		}
+	}
+	installed := false
+	if p.install != nil {
+		if err := s.install(ctx, agent, p.install); err != nil {
+			failed = append(failed, fmt.Errorf("install %s: %w", p.install.targetVersion, err))
+		} else {
+			installed = true
+		}
+	}
+
+	restarted := false
+	var trigger string
+	if p.env != nil {
+		needed, err := s.envRestartNeeded(ctx, agent, p.env)
+		if err != nil {
+			failed = append(failed, fmt.Errorf("restart after feature flags change: %w", err))
+		}
+		if needed {
+			trigger = journal.TriggerFeatureFlags
+		}
+	}
+	if trigger == "" && p.restart {
+		trigger = journal.TriggerServerAction
+	}
+	if trigger != "" {
+		s.logger.Info("Restarting agent", "trigger", trigger, "agent", agent.GetServiceName())
+		err := s.restartAgent(ctx, agent, trigger)
+		switch {
+		case errors.Is(err, restartlimit.ErrRestartRefused):
+			// Reported by restartAgent; retried on the next poll.
+			s.logger.Warn("Agent restart refused", "error", err, "trigger", trigger, "agent", agent.GetServiceName())
+		case err != nil:
+			s.logger.Error("Failed to restart agent", "error", err, "trigger", trigger, "agent", agent.GetServiceName())
+			failed = append(failed, fmt.Errorf("restart: %w", err))
+		default:
+			restarted = true
+		}
+	}
+
+	if installed {
+		if err := s.verifyInstall(ctx, agent, p.install); err != nil {
+			failed = append(failed, fmt.Errorf("verify update to %s: %w", p.install.targetVersion, err))
+		}
+	}
+	if restarted && p.env != nil {
+		if err := s.verifyRunningEnvironment(ctx, agent, p.env); err != nil {
+			failed = append(failed, fmt.Errorf("verify environment: %w", err))
+		}
+	}
+	return restarted, failed
+}
@@ -0,0 +1,80 @@
+package application
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// errShuttingDown is returned for installs requested after Shutdown began.
+var errShuttingDown = errors.New("updater is shutting down")
+
+// installGuard lets the package manager steps that change installed packages
+// outlive the run context. A shutdown signal cancels polling, lock waits and
+// read-only commands at once, but apt-get killed mid-install can leave dpkg
+// half-configured, so drain instead waits for running steps and aborts them
+// only once the drain timeout expires. Its run method is passed to installs
+// as their osutils.Protect. A nil *installGuard runs steps on the caller's
+// context.
+type installGuard struct {
+	ctx          context.Context
+	abort        context.CancelFunc
+	drainTimeout time.Duration
+
+	mu       sync.Mutex
+	draining bool
+	running  sync.WaitGroup
+}
+
+func newInstallGuard(drainTimeout time.Duration) *installGuard {
+	ctx, abort := context.WithCancel(context.Background())
+	return &installGuard{ctx: ctx, abort: abort, drainTimeout: drainTimeout}
+}
+
+// run calls fn with a context that is not cancelled with ctx. No new install
+// starts once ctx is cancelled or a drain has begun.
+func (g *installGuard) run(ctx context.Context, fn func(ctx context.Context) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if g == nil {
+		return fn(ctx)
+	}
+	g.mu.Lock()
+	if g.draining {
+		g.mu.Unlock()
+		return errShuttingDown
+	}
+	g.running.Add(1)
+	g.mu.Unlock()
+	defer g.running.Done()
+	return fn(g.ctx)
+}
+
+// drain refuses new installs and waits for running ones. If they outlast the
+// drain timeout they are aborted and an error is returned.
+func (g *installGuard) drain() error {
+	if g == nil {
+		return nil
+	}
+	g.mu.Lock()
+	g.draining = true
+	g.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		g.running.Wait()
+		close(done)
+	}()
+	timer := time.NewTimer(g.drainTimeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return nil
+	case <-timer.C:
+		g.abort()
+		return fmt.Errorf("package install still running after %s, aborted", g.drainTimeout)
+	}
+}
@@ -0,0 +1,97 @@
+package application
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nebius/nebius-observability-agent-updater/internal/agents"
+)
+
+// updateJob is an action plan with a package install running in the
+// background.
+type updateJob struct {
+	version string
+	// configVersion is acknowledged once the job finished without failures.
+	configVersion uint64
+	since         time.Time
+	// failed holds the plan failures, then those of the execution.
+	failed stepErrors
+}
+
+func (j updateJob) progress() string {
+	return fmt.Sprintf("update to %s in progress since %s", j.version, j.since.UTC().Format(time.RFC3339))
+}
+
+// updateWorker runs the install plans of one agent in the background, so the
+// agent keeps being polled and its progress reported while apt works, which
+// can take minutes. At most one job runs at a time; its result is held until
+// a later poll picks it up. A nil *updateWorker runs nothing in the
+// background and callers execute inline.
+type updateWorker struct {
+	mu       sync.Mutex
+	running  *updateJob
+	finished *updateJob
+	wg       sync.WaitGroup
+}
+
+func newUpdateWorkers(list []agents.AgentData) map[agents.AgentData]*updateWorker {
+	workers := make(map[agents.AgentData]*updateWorker, len(list))
+	for _, agent := range list {
+		workers[agent] = &updateWorker{}
+	}
+	return workers
+}
+
+// start runs execute for job in the background.
+func (w *updateWorker) start(job *updateJob, execute func() stepErrors) {
+	w.mu.Lock()
+	w.running = job
+	w.mu.Unlock()
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		failed := execute()
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		job.failed = append(job.failed, failed...)
+		w.running = nil
+		w.finished = job
+	}()
+}
+
+// current returns the running job, if any.
+func (w *updateWorker) current() (updateJob, bool) {
+	if w == nil {
+		return updateJob{}, false
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.running == nil {
+		return updateJob{}, false
+	}
+	return *w.running, true
+}
+
+// takeFinished returns the finished job not yet picked up, if any.
+func (w *updateWorker) takeFinished() (updateJob, bool) {
+	if w == nil {
+		return updateJob{}, false
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.finished == nil {
+		return updateJob{}, false
+	}
+	job := *w.finished
+	w.finished = nil
+	return job, true
+}
+
+// wait blocks until the running job, if any, returned.
+func (w *updateWorker) wait() {
+	if w == nil {
+		return
+	}
+	w.wg.Wait()
+}
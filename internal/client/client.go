@@ -2,12 +2,12 @@ package client
 
 import (
 	"context"
-	"crypto/tls"
 	"errors"
 	"fmt"
 	"log/slog"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/cenkalti/backoff/v4"
@@ -20,39 +20,42 @@ import (
 	"github.com/nebius/nebius-observability-agent-updater/internal/osutils"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/insecure"
 	"google.golang.org/grpc/keepalive"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/durationpb"
 )
 
 type metadataReader interface {
-	GetParentId() (string, error)
-	GetInstanceId() (string, bool, error)
-	GetIamToken() (string, error)
+	GetParentId(ctx context.Context) (string, error)
+	GetInstanceId(ctx context.Context) (string, bool, error)
+	GetIamToken(ctx context.Context) (string, error)
+	GetEndpointOverride(ctx context.Context) (string, error)
 }
 
 type packageManager interface {
-	GetDebVersion(packageName string) (string, error)
+	GetDebVersion(ctx context.Context, packageName string) (string, error)
 }
 
 type systemInfo interface {
-	GetServiceUptime(serviceName string) (time.Duration, error)
-	GetSystemUptime() (time.Duration, error)
-	GetSystemdStatus(serviceName string) (string, error)
-	GetOsName() (string, error)
-	GetUname() (string, error)
-	GetArch() (string, error)
+	GetServiceUptime(ctx context.Context, serviceName string) (time.Duration, error)
+	GetSystemUptime(ctx context.Context) (time.Duration, error)
+	GetSystemdStatus(ctx context.Context, serviceName string) (string, error)
+	GetOsName(ctx context.Context) (string, error)
+	GetUname(ctx context.Context) (string, error)
+	GetArch(ctx context.Context) (string, error)
 }
 
 type systemLogger interface {
-	GetLastLogs(serviceName string, lines int) (string, error)
+	GetLastLogs(ctx context.Context, serviceName string, lines int) (string, error)
 }
 
 type storageInfo interface {
-	GetDirectorySize(path string) (int64, error)
-	GetMountpointSize(path string) (int64, error)
+	GetDirectorySize(ctx context.Context, path string) (int64, error)
+	GetMountpointSize(ctx context.Context, path string) (int64, error)
 }
 
 type clusterInfo interface {
@@ -68,8 +71,8 @@ type oshelper interface {
 }
 
 type dcgmhelper interface {
-	GetDCGMVersion() (string, error)
-	GetGpuInfo() (model string, number int, err error)
+	GetDCGMVersion(ctx context.Context) (string, error)
+	GetGpuInfo(ctx context.Context) (model string, number int, err error)
 }
 
 const (
@@ -87,33 +90,57 @@ const (
 	NcclMetricsHealthKey       = "nccl_metrics"
 )
 
+// Client is safe for concurrent use: App polls the backend from one goroutine
+// per agent. Retry state is kept per call; the endpoints, failover and
+// endpoint override state are guarded by their mutexes, and config is not
+// modified after New.
 type Client struct {
-	metadata         metadataReader
-	config           *config.Config
-	conn             *grpc.ClientConn
-	client           agentmanager.VersionServiceClient
+	metadata    metadataReader
+	config      *config.Config
+	configured  []string
+	dialOptions []grpc.DialOption
+
+	// connMu guards endpoints and failover, which are replaced when the
+	// endpoint override changes, and the endpoints' in-flight call counts.
+	connMu    sync.Mutex
+	endpoints []*backendEndpoint
+	failover  *failover
+
+	// overrideMu guards the endpoint override state and serializes switching
+	// to a new override.
+	overrideMu        sync.Mutex
+	override          string
+	overrideCheckedAt time.Time
+
 	logger           *slog.Logger
 	oh               oshelper
 	dh               dcgmhelper
 	fileGuard        *osutils.FileGuard
-	retryBackoff     backoff.BackOff
-	getTokenCallback func() (string, error)
+	getTokenCallback func(ctx context.Context) (string, error)
 }
 
-func New(metadata metadataReader, oh oshelper, dh dcgmhelper, fileGuard *osutils.FileGuard, config *config.Config, logger *slog.Logger, getTokenCallback func() (string, error)) (*Client, error) {
-	if config.GRPC.Endpoint == "" {
-		endpoint := os.Getenv(ENDPOINT_ENV)
-		if endpoint == "" {
-			return nil, fmt.Errorf("endpoint is not set")
+func New(metadata metadataReader, oh oshelper, dh dcgmhelper, fileGuard *osutils.FileGuard, config *config.Config, logger *slog.Logger, getTokenCallback func(ctx context.Context) (string, error)) (*Client, error) {
+	configured := config.GRPC.Endpoints
+	if len(configured) == 0 {
+		if config.GRPC.Endpoint == "" {
+			config.GRPC.Endpoint = os.Getenv(ENDPOINT_ENV)
+		}
+		if config.GRPC.Endpoint != "" {
+			configured = []string{config.GRPC.Endpoint}
 		}
-		config.GRPC.Endpoint = endpoint
 	}
 	dialOptions := make([]grpc.DialOption, 0, 3)
 	if config.GRPC.Insecure {
+		if config.GRPC.TLS != (clientconfig.TLSConfig{}) {
+			logger.Warn("grpc.tls is ignored because grpc.insecure is set")
+		}
 		dialOptions = append(dialOptions, grpc.WithTransportCredentials(insecure.NewCredentials()))
 	} else {
-		creds := credentials.NewTLS(&tls.Config{})
-		dialOptions = append(dialOptions, grpc.WithTransportCredentials(creds))
+		tlsConfig, err := newTLSConfig(config.GRPC.TLS, fileGuard, logger)
+		if err != nil {
+			return nil, fmt.Errorf("failed to configure TLS: %w", err)
+		}
+		dialOptions = append(dialOptions, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
 	}
 
 	dialOptions = append(dialOptions, grpc.WithKeepaliveParams(keepalive.ClientParameters{
@@ -124,24 +151,37 @@ func New(metadata metadataReader, oh oshelper, dh dcgmhelper, fileGuard *osutils
 
 	dialOptions = append(dialOptions, grpc.WithUserAgent(UserAgent))
 
-	conn, err := grpc.NewClient("dns:///"+config.GRPC.Endpoint, dialOptions...)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create grpc client to %s: %w", config.GRPC.Endpoint, err)
-	}
-	client := agentmanager.NewVersionServiceClient(conn)
-
-	return &Client{
+	s := &Client{
 		metadata:         metadata,
 		config:           config,
-		conn:             conn,
-		client:           client,
+		configured:       configured,
+		dialOptions:      dialOptions,
 		logger:           logger,
 		oh:               oh,
 		dh:               dh,
 		fileGuard:        fileGuard,
-		retryBackoff:     getRetryBackoff(config.GRPC.Retry),
 		getTokenCallback: getTokenCallback,
-	}, nil
+	}
+	addresses := configured
+	if config.GRPC.EndpointOverrideRefreshInterval > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), endpointOverrideTimeout)
+		defer cancel()
+		s.overrideCheckedAt = time.Now()
+		override, err := metadata.GetEndpointOverride(ctx)
+		if err != nil {
+			logger.Warn("failed to read backend endpoint override, using configured endpoints", "error", err)
+		} else if override != "" {
+			logger.Info("using backend endpoint override from IMDS", "endpoint", override)
+			s.override, addresses = override, []string{override}
+		}
+	}
+	if len(addresses) == 0 {
+		return nil, fmt.Errorf("endpoint is not set")
+	}
+	if err := s.connect(addresses, ""); err != nil {
+		return nil, err
+	}
+	return s, nil
 }
 
 func getRetryBackoff(config clientconfig.RetryConfig) backoff.BackOff {
@@ -153,52 +193,101 @@ func getRetryBackoff(config clientconfig.RetryConfig) backoff.BackOff {
 	return retryBackoff
 }
 
-func (s *Client) Close() {
-	if s.conn != nil {
-		_ = s.conn.Close()
+// isEndpointFailure reports whether err, returned by a call under ctx, points
+// at the endpoint rather than at the request or at the caller giving up.
+func isEndpointFailure(ctx context.Context, err error) bool {
+	if err == nil || ctx.Err() != nil {
+		return false
+	}
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded:
+		return true
 	}
+	return false
 }
 
-func (s *Client) SendAgentData(agent agents.AgentData) (*agentmanager.GetVersionResponse, error) {
+// SendAgentData reports agent state and returns the server's instructions.
+// Cancelling ctx aborts the call, including any pending retries. The agent's
+// notices are removed only once the report was delivered.
+func (s *Client) SendAgentData(ctx context.Context, agent agents.AgentData) (*agentmanager.GetVersionResponse, error) {
 	s.logger.Debug("Sending agent data", "agent", agent.GetServiceName())
-	req := s.fillRequest(agent)
+	s.refreshEndpointOverride(ctx)
+	notices := agent.PendingNotices()
+	req := s.fillRequest(ctx, agent, notices)
 	var response *agentmanager.GetVersionResponse
+	retryBackoff := &serverDelayBackOff{BackOff: getRetryBackoff(s.config.GRPC.Retry)}
 	operation := func() error {
-		ctx, cancel := context.WithTimeout(context.Background(), s.config.GRPC.Timeout)
-		defer cancel()
+		// The token is fetched before the call deadline starts: a refresh
+		// takes IMDS round trips that must not eat into the RPC budget, or a
+		// slow IMDS would count against a healthy endpoint.
+		callCtx := ctx
 		if s.getTokenCallback != nil {
-			authToken, err := s.getTokenCallback()
+			authToken, err := s.getTokenCallback(ctx)
 			if err != nil {
 				s.logger.Warn("failed to get auth token, sending request with empty token", "error", err)
 				authToken = ""
 			}
-			ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+authToken)
+			callCtx = metadata.AppendToOutgoingContext(callCtx, "authorization", "Bearer "+authToken)
 		}
-		r, err := s.client.GetVersion(ctx, req)
+		r, address, err := s.callBackend(callCtx, req)
 		if err != nil {
-			s.logger.Warn("gRPC call failed", "error", err)
+			if !isRetryable(err) {
+				s.logger.Error("gRPC call failed with a permanent error, not retrying", "error", err, "code", status.Code(err), "endpoint", address)
+				return backoff.Permanent(err)
+			}
+			s.logger.Warn("gRPC call failed", "error", err, "endpoint", address)
+			if delay, ok := serverRetryDelay(err); ok {
+				s.logger.Info("server asked to delay the retry", "delay", delay)
+				retryBackoff.delayNext(delay)
+			}
 			return err
 		}
 		response = r
 		return nil
 	}
 	if s.config.GRPC.Retry.Enabled {
-		err := backoff.Retry(operation, s.retryBackoff)
-		s.retryBackoff.Reset()
+		err := backoff.Retry(operation, backoff.WithContext(retryBackoff, ctx))
 		if err != nil {
 			return nil, fmt.Errorf("all retries failed: %w", err)
 		}
 	} else {
 		err := operation()
+		var permanent *backoff.PermanentError
+		if errors.As(err, &permanent) {
+			err = permanent.Err
+		}
 		if err != nil {
 			return nil, fmt.Errorf("failed to send agent data: %w", err)
 		}
 	}
 
+	agent.RemoveNotices(notices)
 	s.logger.Debug("Received response", "action", response.Action)
 	return response, nil
 }
 
+// callBackend sends req to the endpoint the failover picks, within
+// GRPC.Timeout, and reports the outcome. When a failback probe of the primary
+// fails, the request is sent to the active fallback as well, so the probe does
+// not cost the poll. It returns the address of the endpoint that answered.
+func (s *Client) callBackend(ctx context.Context, req *agentmanager.GetVersionRequest) (*agentmanager.GetVersionResponse, string, error) {
+	call := func(allowProbe bool) (*agentmanager.GetVersionResponse, string, bool, error) {
+		endpoint, i, probe, fo := s.acquire(time.Now(), allowProbe)
+		defer s.release(endpoint)
+		callCtx, cancel := context.WithTimeout(ctx, s.config.GRPC.Timeout)
+		defer cancel()
+		r, err := endpoint.client.GetVersion(callCtx, req)
+		failed := isEndpointFailure(ctx, err)
+		fo.report(time.Now(), i, probe, failed, fmt.Sprint(err))
+		return r, endpoint.address, probe && failed, err
+	}
+	r, address, probeFailed, err := call(true)
+	if probeFailed {
+		r, address, _, err = call(false)
+	}
+	return r, address, err
+}
+
 func (s *Client) processModuleHealth(healthKey string, statuses map[string]healthcheck.CheckStatus) (isError bool, moduleHealth *agentmanager.ModuleHealth) {
 	if health, found := statuses[healthKey]; found {
 		state := agentmanager.AgentState_STATE_HEALTHY
@@ -222,8 +311,8 @@ func (s *Client) processModuleHealth(healthKey string, statuses map[string]healt
 	return false, nil
 }
 
-func (s *Client) fillVersionInfo(req *agentmanager.GetVersionRequest, agent agents.AgentData) {
-	agentVersion, err := s.oh.GetDebVersion(agent.GetDebPackageName())
+func (s *Client) fillVersionInfo(ctx context.Context, req *agentmanager.GetVersionRequest, agent agents.AgentData) {
+	agentVersion, err := s.oh.GetDebVersion(ctx, agent.GetDebPackageName())
 	if err != nil {
 		if !errors.Is(err, osutils.ErrDebNotFound) {
 			s.logger.Error("failed to get agent version", "error", err)
@@ -234,7 +323,7 @@ func (s *Client) fillVersionInfo(req *agentmanager.GetVersionRequest, agent agen
 		req.AgentVersion = agentVersion
 	}
 
-	updaterVersion, err := s.oh.GetDebVersion(constants.UpdaterDebPackageName)
+	updaterVersion, err := s.oh.GetDebVersion(ctx, constants.UpdaterDebPackageName)
 	if err != nil {
 		if !errors.Is(err, osutils.ErrDebNotFound) {
 			s.logger.Error("failed to get updater version", "error", err)
@@ -246,15 +335,15 @@ func (s *Client) fillVersionInfo(req *agentmanager.GetVersionRequest, agent agen
 	}
 }
 
-func (s *Client) fillMetadataInfo(req *agentmanager.GetVersionRequest) {
-	parentId, err := s.metadata.GetParentId()
+func (s *Client) fillMetadataInfo(ctx context.Context, req *agentmanager.GetVersionRequest) {
+	parentId, err := s.metadata.GetParentId(ctx)
 	if err != nil {
 		s.logger.Error("failed to get parent id", "error", err)
 	} else {
 		req.ParentId = parentId
 	}
 
-	instanceId, instanceIdFallback, err := s.metadata.GetInstanceId()
+	instanceId, instanceIdFallback, err := s.metadata.GetInstanceId(ctx)
 	if err != nil {
 		s.logger.Error("failed to get instance id", "error", err)
 	} else {
@@ -263,23 +352,23 @@ func (s *Client) fillMetadataInfo(req *agentmanager.GetVersionRequest) {
 	req.InstanceIdUsedFallback = instanceIdFallback
 }
 
-func (s *Client) fillOSInfo(req *agentmanager.GetVersionRequest) {
+func (s *Client) fillOSInfo(ctx context.Context, req *agentmanager.GetVersionRequest) {
 	osinfo := agentmanager.OSInfo{}
-	osName, err := s.oh.GetOsName()
+	osName, err := s.oh.GetOsName(ctx)
 	if err != nil {
 		s.logger.Error("failed to get os name", "error", err)
 	} else {
 		osinfo.Name = osName
 	}
 
-	uname, err := s.oh.GetUname()
+	uname, err := s.oh.GetUname(ctx)
 	if err != nil {
 		s.logger.Error("failed to get uname", "error", err)
 	} else {
 		osinfo.Uname = uname
 	}
 
-	arch, err := s.oh.GetArch()
+	arch, err := s.oh.GetArch(ctx)
 	if err != nil {
 		s.logger.Error("failed to get arch", "error", err)
 	} else {
@@ -288,7 +377,7 @@ func (s *Client) fillOSInfo(req *agentmanager.GetVersionRequest) {
 	req.OsInfo = &osinfo
 }
 
-func (s *Client) fillHealthInfo(req *agentmanager.GetVersionRequest, agent agents.AgentData) {
+func (s *Client) fillHealthInfo(ctx context.Context, req *agentmanager.GetVersionRequest, agent agents.AgentData) {
 	healthy, response := agent.IsAgentHealthy()
 	if healthy {
 		req.AgentState = agentmanager.AgentState_STATE_HEALTHY
@@ -332,7 +421,7 @@ func (s *Client) fillHealthInfo(req *agentmanager.GetVersionRequest, agent agent
 		commonServiceLogsError || vmServiceLogsError || computeGpuLogsError ||
 		journaldError || ncclMetricsError
 	if req.AgentState != agentmanager.AgentState_STATE_HEALTHY && !anyPipelineError {
-		lastLogs, err := s.oh.GetLastLogs(agent.GetServiceName(), 10)
+		lastLogs, err := s.oh.GetLastLogs(ctx, agent.GetServiceName(), 10)
 		if err != nil {
 			s.logger.Error("failed to get last logs", "error", err)
 		} else {
@@ -341,22 +430,22 @@ func (s *Client) fillHealthInfo(req *agentmanager.GetVersionRequest, agent agent
 	}
 }
 
-func (s *Client) fillUptimeInfo(req *agentmanager.GetVersionRequest, agent agents.AgentData) {
-	agentUptime, err := s.oh.GetServiceUptime(agent.GetServiceName())
+func (s *Client) fillUptimeInfo(ctx context.Context, req *agentmanager.GetVersionRequest, agent agents.AgentData) {
+	agentUptime, err := s.oh.GetServiceUptime(ctx, agent.GetServiceName())
 	if err != nil {
 		s.logger.Error("failed to get agent uptime", "error", err)
 	} else {
 		req.AgentUptime = durationpb.New(agentUptime)
 	}
 
-	updaterUptime, err := s.oh.GetServiceUptime(constants.UpdaterServiceName)
+	updaterUptime, err := s.oh.GetServiceUptime(ctx, constants.UpdaterServiceName)
 	if err != nil {
 		s.logger.Error("failed to get updater uptime", "error", err)
 	} else {
 		req.UpdaterUptime = durationpb.New(updaterUptime)
 	}
 
-	systemUptime, err := s.oh.GetSystemUptime()
+	systemUptime, err := s.oh.GetSystemUptime(ctx)
 	if err != nil {
 		s.logger.Error("failed to get system uptime", "error", err)
 	} else {
@@ -364,15 +453,15 @@ func (s *Client) fillUptimeInfo(req *agentmanager.GetVersionRequest, agent agent
 	}
 }
 
-func (s *Client) fillGPUInfo(req *agentmanager.GetVersionRequest) {
-	dcgmVersion, err := s.dh.GetDCGMVersion()
+func (s *Client) fillGPUInfo(ctx context.Context, req *agentmanager.GetVersionRequest) {
+	dcgmVersion, err := s.dh.GetDCGMVersion(ctx)
 	if err != nil {
 		s.logger.Error("failed to get DCGM version", "error", err)
 	} else {
 		req.DcgmVersion = dcgmVersion
 	}
 
-	gpuModel, gpuNumber, err := s.dh.GetGpuInfo()
+	gpuModel, gpuNumber, err := s.dh.GetGpuInfo(ctx)
 	if err != nil {
 		s.logger.Error("failed to get GPU info", "error", err)
 	} else {
@@ -381,17 +470,17 @@ func (s *Client) fillGPUInfo(req *agentmanager.GetVersionRequest) {
 	}
 }
 
-func (s *Client) fillHealthCheckLogsInfo(req *agentmanager.GetVersionRequest) {
+func (s *Client) fillHealthCheckLogsInfo(ctx context.Context, req *agentmanager.GetVersionRequest) {
 	if s.config.HealthCheckPath != "" {
 		req.HealthcheckLogs = &agentmanager.HealthCheckLogs{}
-		dirSize, err := s.oh.GetDirectorySize(s.config.HealthCheckPath)
+		dirSize, err := s.oh.GetDirectorySize(ctx, s.config.HealthCheckPath)
 		if err != nil {
 			s.logger.Error("failed to get healthcheck directory size", "error", err)
 		} else {
 			req.HealthcheckLogs.DirectorySizeBytes = dirSize
 		}
 
-		mountpointSize, err := s.oh.GetMountpointSize(s.config.HealthCheckPath)
+		mountpointSize, err := s.oh.GetMountpointSize(ctx, s.config.HealthCheckPath)
 		if err != nil {
 			s.logger.Error("failed to get healthcheck mountpoint size", "error", err)
 		} else {
@@ -400,16 +489,16 @@ func (s *Client) fillHealthCheckLogsInfo(req *agentmanager.GetVersionRequest) {
 	}
 }
 
-func (s *Client) fillRequest(agent agents.AgentData) *agentmanager.GetVersionRequest {
+func (s *Client) fillRequest(ctx context.Context, agent agents.AgentData, notices []string) *agentmanager.GetVersionRequest {
 	req := agentmanager.GetVersionRequest{}
 	req.Type = agent.GetAgentType()
 	req.LastSeenConfigVersion = agent.GetLastSeenConfigVersion()
 
-	s.fillVersionInfo(&req, agent)
-	s.fillMetadataInfo(&req)
-	s.fillOSInfo(&req)
-	s.fillHealthInfo(&req, agent)
-	s.fillUptimeInfo(&req, agent)
+	s.fillVersionInfo(ctx, &req, agent)
+	s.fillMetadataInfo(ctx, &req)
+	s.fillOSInfo(ctx, &req)
+	s.fillHealthInfo(ctx, &req, agent)
+	s.fillUptimeInfo(ctx, &req, agent)
 
 	req.Mk8SClusterId = s.oh.GetMk8sClusterId(s.config.Mk8sClusterIdPath)
 
@@ -420,17 +509,29 @@ func (s *Client) fillRequest(agent agents.AgentData) *agentmanager.GetVersionReq
 	if lastError := agent.GetLastUpdateError(); lastError != nil {
 		parts = append(parts, lastError.Error())
 	}
+	_, fo := s.backends()
+	if active, primary, since := fo.status(); !primary {
+		parts = append(parts, fmt.Sprintf("using fallback backend endpoint %s since %s", active, since.UTC().Format(time.RFC3339)))
+	}
+	if events := fo.events(); len(events) > 0 {
+		switches := make([]string, len(events))
+		for i, e := range events {
+			switches[i] = e.String()
+		}
+		parts = append(parts, "recent backend endpoint switches: "+strings.Join(switches, "; "))
+	}
+	parts = append(parts, notices...)
 	req.LastUpdateError = strings.Join(parts, "\n")
 
-	cloudInitStatus, err := s.oh.GetSystemdStatus(constants.CloudInitServiceName)
+	cloudInitStatus, err := s.oh.GetSystemdStatus(ctx, constants.CloudInitServiceName)
 	if err != nil {
 		s.logger.Error("failed to get cloud-init status", "error", err)
 	} else {
 		req.CloudInitStatus = cloudInitStatus
 	}
 
-	s.fillGPUInfo(&req)
-	s.fillHealthCheckLogsInfo(&req)
+	s.fillGPUInfo(ctx, &req)
+	s.fillHealthCheckLogsInfo(ctx, &req)
 
 	return &req
 }
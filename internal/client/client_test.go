@@ -6,6 +6,7 @@ import (
 	"log/slog"
 	"os"
 	"path/filepath"
+	"slices"
 	"syscall"
 	"testing"
 	"time"
@@ -16,15 +17,17 @@ import (
 	"github.com/nebius/nebius-observability-agent-updater/internal/healthcheck"
 	"github.com/nebius/nebius-observability-agent-updater/internal/osutils"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 	"google.golang.org/grpc"
 	"google.golang.org/protobuf/types/known/durationpb"
 )
 
-func tokenFunc() (string, error) {
+func tokenFunc(context.Context) (string, error) {
 	return "token", nil
 }
 
@@ -33,17 +36,22 @@ type mockMetadataReader struct {
 	mock.Mock
 }
 
-func (m *mockMetadataReader) GetParentId() (string, error) {
+func (m *mockMetadataReader) GetParentId(context.Context) (string, error) {
 	args := m.Called()
 	return args.String(0), args.Error(1)
 }
 
-func (m *mockMetadataReader) GetInstanceId() (string, bool, error) {
+func (m *mockMetadataReader) GetInstanceId(context.Context) (string, bool, error) {
 	args := m.Called()
 	return args.String(0), args.Bool(1), args.Error(2)
 }
 
-func (m *mockMetadataReader) GetIamToken() (string, error) {
+func (m *mockMetadataReader) GetIamToken(context.Context) (string, error) {
+	args := m.Called()
+	return args.String(0), args.Error(1)
+}
+
+func (m *mockMetadataReader) GetEndpointOverride(context.Context) (string, error) {
 	args := m.Called()
 	return args.String(0), args.Error(1)
 }
@@ -52,32 +60,32 @@ type mockOSHelper struct {
 	mock.Mock
 }
 
-func (m *mockOSHelper) GetDebVersion(packageName string) (string, error) {
+func (m *mockOSHelper) GetDebVersion(_ context.Context, packageName string) (string, error) {
 	args := m.Called(packageName)
 	return args.String(0), args.Error(1)
 }
 
-func (m *mockOSHelper) GetServiceUptime(serviceName string) (time.Duration, error) {
+func (m *mockOSHelper) GetServiceUptime(_ context.Context, serviceName string) (time.Duration, error) {
 	args := m.Called(serviceName)
 	return args.Get(0).(time.Duration), args.Error(1)
 }
 
-func (m *mockOSHelper) GetSystemUptime() (time.Duration, error) {
+func (m *mockOSHelper) GetSystemUptime(context.Context) (time.Duration, error) {
 	args := m.Called()
 	return args.Get(0).(time.Duration), args.Error(1)
 }
 
-func (m *mockOSHelper) GetOsName() (string, error) {
+func (m *mockOSHelper) GetOsName(context.Context) (string, error) {
 	args := m.Called()
 	return args.String(0), args.Error(1)
 }
 
-func (m *mockOSHelper) GetUname() (string, error) {
+func (m *mockOSHelper) GetUname(context.Context) (string, error) {
 	args := m.Called()
 	return args.String(0), args.Error(1)
 }
 
-func (m *mockOSHelper) GetArch() (string, error) {
+func (m *mockOSHelper) GetArch(context.Context) (string, error) {
 	args := m.Called()
 	return args.String(0), args.Error(1)
 }
@@ -87,19 +95,19 @@ func (m *mockOSHelper) GetMk8sClusterId(string) string {
 	return args.String(0)
 }
 
-func (m *mockOSHelper) GetSystemdStatus(string) (string, error) {
+func (m *mockOSHelper) GetSystemdStatus(context.Context, string) (string, error) {
 	return "active", nil
 }
 
-func (m *mockOSHelper) GetLastLogs(string, int) (string, error) {
+func (m *mockOSHelper) GetLastLogs(context.Context, string, int) (string, error) {
 	return "logs", nil
 }
 
-func (m *mockOSHelper) GetDirectorySize(string) (int64, error) {
+func (m *mockOSHelper) GetDirectorySize(context.Context, string) (int64, error) {
 	return 0, nil
 }
 
-func (m *mockOSHelper) GetMountpointSize(string) (int64, error) {
+func (m *mockOSHelper) GetMountpointSize(context.Context, string) (int64, error) {
 	return 0, nil
 }
 
@@ -107,12 +115,12 @@ type mockDcgmHelper struct {
 	mock.Mock
 }
 
-func (m *mockDcgmHelper) GetDCGMVersion() (string, error) {
+func (m *mockDcgmHelper) GetDCGMVersion(context.Context) (string, error) {
 	args := m.Called()
 	return args.String(0), args.Error(1)
 }
 
-func (m *mockDcgmHelper) GetGpuInfo() (string, int, error) {
+func (m *mockDcgmHelper) GetGpuInfo(context.Context) (string, int, error) {
 	args := m.Called()
 	return args.String(0), args.Int(1), args.Error(2)
 }
@@ -135,6 +143,7 @@ func (m *mockVersionServiceClient) GetVersion(ctx context.Context, req *agentman
 // New mock for agents.AgentData
 type mockAgentData struct {
 	mock.Mock
+	notices []string
 }
 
 func (m *mockAgentData) GetAgentType() agentmanager.AgentType {
@@ -156,11 +165,11 @@ func (m *mockAgentData) IsAgentHealthy() (bool, healthcheck.Response) {
 	return args.Bool(0), args.Get(1).(healthcheck.Response)
 }
 
-func (m *mockAgentData) Update(string, string) error {
+func (m *mockAgentData) Update(context.Context, osutils.Protect, string, string) error {
 	args := m.Called()
 	return args.Error(0)
 }
-func (m *mockAgentData) Restart() error {
+func (m *mockAgentData) Restart(context.Context) error {
 	args := m.Called()
 	return args.Error(0)
 }
@@ -175,6 +184,22 @@ func (m *mockAgentData) GetLastUpdateError() error {
 	return args.Error(0)
 }
 
+func (m *mockAgentData) SetLastUpdateError(err error) {
+	m.Called(err)
+}
+
+func (m *mockAgentData) AddNotice(msg string) {
+	m.notices = append(m.notices, msg)
+}
+
+func (m *mockAgentData) PendingNotices() []string {
+	return append([]string(nil), m.notices...)
+}
+
+func (m *mockAgentData) RemoveNotices(delivered []string) {
+	m.notices = slices.DeleteFunc(m.notices, func(n string) bool { return slices.Contains(delivered, n) })
+}
+
 func (m *mockAgentData) GetLastSeenConfigVersion() uint64 {
 	args := m.Called()
 	return args.Get(0).(uint64)
@@ -183,6 +208,14 @@ func (m *mockAgentData) GetLastSeenConfigVersion() uint64 {
 func (m *mockAgentData) SetLastSeenConfigVersion(version uint64) {
 	m.Called(version)
 }
+func testEndpoints(clients ...agentmanager.VersionServiceClient) []*backendEndpoint {
+	endpoints := make([]*backendEndpoint, len(clients))
+	for i, c := range clients {
+		endpoints[i] = &backendEndpoint{address: fmt.Sprintf("backend-%d:443", i), client: c}
+	}
+	return endpoints
+}
+
 func TestNew(t *testing.T) {
 	metadata := &mockMetadataReader{}
 	oh := &mockOSHelper{}
@@ -197,8 +230,9 @@ func TestNew(t *testing.T) {
 	client, err := New(metadata, oh, dh, osutils.NewFileGuard(osutils.DefaultMaxPendingFileOps), &cfg, nil, tokenFunc)
 	assert.NoError(t, err)
 	assert.NotNil(t, client)
-	assert.NotNil(t, client.conn)
-	assert.NotNil(t, client.client)
+	assert.Len(t, client.endpoints, 1)
+	assert.NotNil(t, client.endpoints[0].conn)
+	assert.Equal(t, "localhost:50051", activeEndpoint(client))
 }
 
 func TestSendAgentData(t *testing.T) {
@@ -208,12 +242,11 @@ func TestSendAgentData(t *testing.T) {
 	mockClient := &mockVersionServiceClient{}
 
 	client := &Client{
-		metadata:     metadata,
-		oh:           oh,
-		dh:           dh,
-		fileGuard:    osutils.NewFileGuard(osutils.DefaultMaxPendingFileOps),
-		client:       mockClient,
-		retryBackoff: getRetryBackoff(clientconfig.GetDefaultRetryConfig()),
+		metadata:  metadata,
+		oh:        oh,
+		dh:        dh,
+		fileGuard: osutils.NewFileGuard(osutils.DefaultMaxPendingFileOps),
+		endpoints: testEndpoints(mockClient),
 		config: &config.Config{
 			GRPC: clientconfig.GRPCConfig{
 				Timeout: 5 * time.Second,
@@ -249,7 +282,7 @@ func TestSendAgentData(t *testing.T) {
 	agentData.On("IsAgentHealthy").Return(true, healthcheck.Response{})
 	agentData.On("GetLastUpdateError").Return(nil)
 
-	response, err := client.SendAgentData(agentData)
+	response, err := client.SendAgentData(context.Background(), agentData)
 
 	assert.NoError(t, err)
 	assert.Equal(t, expectedResponse, response)
@@ -268,13 +301,12 @@ func TestFillRequest(t *testing.T) {
 	dh := &mockDcgmHelper{}
 
 	client := &Client{
-		metadata:     metadata,
-		oh:           oh,
-		dh:           dh,
-		fileGuard:    osutils.NewFileGuard(osutils.DefaultMaxPendingFileOps),
-		retryBackoff: getRetryBackoff(clientconfig.GetDefaultRetryConfig()),
-		logger:       slog.New(slog.NewTextHandler(os.Stdout, nil)),
-		config:       &config.Config{},
+		metadata:  metadata,
+		oh:        oh,
+		dh:        dh,
+		fileGuard: osutils.NewFileGuard(osutils.DefaultMaxPendingFileOps),
+		logger:    slog.New(slog.NewTextHandler(os.Stdout, nil)),
+		config:    &config.Config{},
 	}
 
 	// Set up mock expectations
@@ -341,7 +373,7 @@ func TestFillRequest(t *testing.T) {
 	agentData.On("IsAgentHealthy").Return(true, healthResponse)
 	agentData.On("GetLastUpdateError").Return(fmt.Errorf("some-error"))
 
-	req := client.fillRequest(agentData)
+	req := client.fillRequest(context.Background(), agentData, nil)
 
 	assert.NotNil(t, req)
 	assert.Equal(t, agentmanager.AgentType_O11Y_AGENT, req.Type)
@@ -396,7 +428,7 @@ func TestSendAgentDataWithRetry(t *testing.T) {
 		oh:        oh,
 		dh:        dh,
 		fileGuard: osutils.NewFileGuard(osutils.DefaultMaxPendingFileOps),
-		client:    mockClient,
+		endpoints: testEndpoints(mockClient),
 		config: &config.Config{
 			GRPC: clientconfig.GRPCConfig{
 				Timeout: 5 * time.Second,
@@ -409,8 +441,6 @@ func TestSendAgentDataWithRetry(t *testing.T) {
 		logger: slog.New(slog.NewTextHandler(os.Stdout, nil)),
 	}
 
-	client.retryBackoff = getRetryBackoff(client.config.GRPC.Retry)
-
 	// Set up mock expectations
 	metadata.On("GetParentId").Return("parent-123", nil)
 	metadata.On("GetInstanceId").Return("instance-456", false, nil)
@@ -444,7 +474,7 @@ func TestSendAgentDataWithRetry(t *testing.T) {
 	agentData.On("IsAgentHealthy").Return(true, healthcheck.Response{})
 	agentData.On("GetLastUpdateError").Return(nil)
 
-	response, err := client.SendAgentData(agentData)
+	response, err := client.SendAgentData(context.Background(), agentData)
 
 	assert.NoError(t, err)
 	assert.Equal(t, expectedResponse, response)
@@ -470,7 +500,7 @@ func TestSendAgentDataWithRetryFailure(t *testing.T) {
 		oh:        oh,
 		dh:        dh,
 		fileGuard: osutils.NewFileGuard(osutils.DefaultMaxPendingFileOps),
-		client:    mockClient,
+		endpoints: testEndpoints(mockClient),
 		config: &config.Config{
 			GRPC: clientconfig.GRPCConfig{
 				Timeout: 5 * time.Second,
@@ -485,7 +515,6 @@ func TestSendAgentDataWithRetryFailure(t *testing.T) {
 		},
 		logger: slog.New(slog.NewTextHandler(os.Stdout, nil)),
 	}
-	client.retryBackoff = getRetryBackoff(client.config.GRPC.Retry)
 
 	// Set up mock expectations (same as in the previous test)
 	metadata.On("GetParentId").Return("parent-123", nil)
@@ -513,7 +542,7 @@ func TestSendAgentDataWithRetryFailure(t *testing.T) {
 	agentData.On("IsAgentHealthy").Return(true, healthcheck.Response{})
 	agentData.On("GetLastUpdateError").Return(nil)
 
-	response, err := client.SendAgentData(agentData)
+	response, err := client.SendAgentData(context.Background(), agentData)
 
 	assert.Error(t, err)
 	assert.Nil(t, response)
@@ -529,19 +558,131 @@ func TestSendAgentDataWithRetryFailure(t *testing.T) {
 	agentData.AssertExpectations(t)
 }
 
+func TestSendAgentDataCancelStopsRetries(t *testing.T) {
+	metadata := &mockMetadataReader{}
+	oh := &mockOSHelper{}
+	dh := &mockDcgmHelper{}
+	mockClient := &mockVersionServiceClient{}
+
+	client := &Client{
+		metadata:  metadata,
+		oh:        oh,
+		dh:        dh,
+		fileGuard: osutils.NewFileGuard(osutils.DefaultMaxPendingFileOps),
+		endpoints: testEndpoints(mockClient),
+		config: &config.Config{
+			GRPC: clientconfig.GRPCConfig{
+				Timeout: 5 * time.Second,
+				Retry: clientconfig.RetryConfig{
+					Enabled:         true,
+					MaxElapsedTime:  time.Minute,
+					InitialInterval: 10 * time.Second,
+					Multiplier:      2,
+				},
+			},
+		},
+		logger: slog.New(slog.NewTextHandler(os.Stdout, nil)),
+	}
+
+	metadata.On("GetParentId").Return("parent-123", nil)
+	metadata.On("GetInstanceId").Return("instance-456", false, nil)
+	oh.On("GetDebVersion", mock.Anything).Return("1.0.0", nil)
+	oh.On("GetServiceUptime", mock.Anything).Return(10*time.Minute, nil)
+	oh.On("GetSystemUptime").Return(1*time.Hour, nil)
+	oh.On("GetOsName").Return("Linux", nil)
+	oh.On("GetUname").Return("Linux 5.4.0-generic", nil)
+	oh.On("GetArch").Return("x86_64", nil)
+	oh.On("GetMk8sClusterId").Return("abcd")
+	dh.On("GetDCGMVersion").Return("3.3.7", nil)
+	dh.On("GetGpuInfo").Return("NVIDIA H200", 2, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	mockClient.On("GetVersion", mock.Anything, mock.Anything, mock.Anything).
+		Run(func(mock.Arguments) { cancel() }).
+		Return(nil, status.Error(codes.Unavailable, "Service unavailable"))
+
+	agentData := &mockAgentData{}
+	agentData.On("GetServiceName").Return("test-agent")
+	agentData.On("GetDebPackageName").Return("test-agent-package")
+	agentData.On("GetAgentType").Return(agentmanager.AgentType_O11Y_AGENT)
+	agentData.On("GetLastSeenConfigVersion").Return(uint64(0))
+	agentData.On("IsAgentHealthy").Return(true, healthcheck.Response{})
+	agentData.On("GetLastUpdateError").Return(nil)
+
+	start := time.Now()
+	response, err := client.SendAgentData(ctx, agentData)
+
+	assert.Error(t, err)
+	assert.Nil(t, response)
+	assert.Less(t, time.Since(start), 5*time.Second, "cancellation must not wait for the retry interval")
+	mockClient.AssertNumberOfCalls(t, "GetVersion", 1)
+}
+
+func TestSendAgentDataTokenOutsideCallTimeout(t *testing.T) {
+	const timeout = 200 * time.Millisecond
+	mockClient := &mockVersionServiceClient{}
+	client, agentData := newRetryTestClient(t, mockClient)
+	client.config.GRPC.Timeout = timeout
+	client.getTokenCallback = func(context.Context) (string, error) {
+		// A token refresh on a slow IMDS.
+		time.Sleep(timeout)
+		return "token", nil
+	}
+	mockClient.On("GetVersion", mock.Anything, mock.Anything, mock.Anything).
+		Run(func(args mock.Arguments) {
+			callCtx := args.Get(0).(context.Context)
+			deadline, ok := callCtx.Deadline()
+			assert.True(t, ok)
+			assert.Greater(t, time.Until(deadline), timeout/2, "the token fetch does not use up the call timeout")
+			md, _ := metadata.FromOutgoingContext(callCtx)
+			assert.Equal(t, []string{"Bearer token"}, md.Get("authorization"))
+		}).
+		Return(&agentmanager.GetVersionResponse{Action: agentmanager.Action_NOP}, nil).Once()
+
+	_, err := client.SendAgentData(context.Background(), agentData)
+
+	assert.NoError(t, err)
+	mockClient.AssertExpectations(t)
+}
+
+func TestSendAgentDataKeepsNoticesUntilDelivered(t *testing.T) {
+	mockClient := &mockVersionServiceClient{}
+	client, agentData := newRetryTestClient(t, mockClient)
+	client.config.GRPC.Retry.Enabled = false
+	agentData.AddNotice("update deferred: outside maintenance window")
+
+	var requests []*agentmanager.GetVersionRequest
+	mockClient.On("GetVersion", mock.Anything, mock.Anything, mock.Anything).
+		Run(func(args mock.Arguments) { requests = append(requests, args.Get(1).(*agentmanager.GetVersionRequest)) }).
+		Return(nil, status.Error(codes.Unavailable, "connection refused")).Once()
+	_, err := client.SendAgentData(context.Background(), agentData)
+	assert.Error(t, err)
+
+	agentData.AddNotice("backend unreachable")
+	mockClient.On("GetVersion", mock.Anything, mock.Anything, mock.Anything).
+		Run(func(args mock.Arguments) { requests = append(requests, args.Get(1).(*agentmanager.GetVersionRequest)) }).
+		Return(&agentmanager.GetVersionResponse{Action: agentmanager.Action_NOP}, nil).Once()
+	_, err = client.SendAgentData(context.Background(), agentData)
+	assert.NoError(t, err)
+
+	require.Len(t, requests, 2)
+	assert.Equal(t, "update deferred: outside maintenance window\nbackend unreachable", requests[1].LastUpdateError, "a notice survives a failed send")
+	assert.Empty(t, agentData.PendingNotices(), "delivered notices are removed")
+	mockClient.AssertExpectations(t)
+}
+
 func TestFillRequestDebNotFound(t *testing.T) {
 	metadata := &mockMetadataReader{}
 	oh := &mockOSHelper{}
 	dh := &mockDcgmHelper{}
 
 	client := &Client{
-		metadata:     metadata,
-		oh:           oh,
-		dh:           dh,
-		fileGuard:    osutils.NewFileGuard(osutils.DefaultMaxPendingFileOps),
-		logger:       slog.New(slog.NewTextHandler(os.Stdout, nil)),
-		retryBackoff: getRetryBackoff(clientconfig.GetDefaultRetryConfig()),
-		config:       &config.Config{},
+		metadata:  metadata,
+		oh:        oh,
+		dh:        dh,
+		fileGuard: osutils.NewFileGuard(osutils.DefaultMaxPendingFileOps),
+		logger:    slog.New(slog.NewTextHandler(os.Stdout, nil)),
+		config:    &config.Config{},
 	}
 
 	agentData := &mockAgentData{}
@@ -567,7 +708,7 @@ func TestFillRequestDebNotFound(t *testing.T) {
 	dh.On("GetDCGMVersion").Return("3.3.7", nil)
 	dh.On("GetGpuInfo").Return("NVIDIA H200", 2, nil)
 
-	req := client.fillRequest(agentData)
+	req := client.fillRequest(context.Background(), agentData, nil)
 
 	assert.NotNil(t, req)
 	assert.Equal(t, "", req.AgentVersion)
@@ -579,18 +720,17 @@ func TestFillRequestDebNotFound(t *testing.T) {
 	agentData.AssertExpectations(t)
 }
 
-func fillRequestWithGuard(guard *osutils.FileGuard, lastUpdateErr error) *agentmanager.GetVersionRequest {
+func fillRequestWithGuard(guard *osutils.FileGuard, lastUpdateErr error, notices ...string) *agentmanager.GetVersionRequest {
 	metadata := &mockMetadataReader{}
 	oh := &mockOSHelper{}
 	dh := &mockDcgmHelper{}
 	c := &Client{
-		metadata:     metadata,
-		oh:           oh,
-		dh:           dh,
-		fileGuard:    guard,
-		retryBackoff: getRetryBackoff(clientconfig.GetDefaultRetryConfig()),
-		logger:       slog.New(slog.NewTextHandler(os.Stdout, nil)),
-		config:       &config.Config{},
+		metadata:  metadata,
+		oh:        oh,
+		dh:        dh,
+		fileGuard: guard,
+		logger:    slog.New(slog.NewTextHandler(os.Stdout, nil)),
+		config:    &config.Config{},
 	}
 	metadata.On("GetParentId").Return("p", nil)
 	metadata.On("GetInstanceId").Return("i", false, nil)
@@ -610,7 +750,7 @@ func fillRequestWithGuard(guard *osutils.FileGuard, lastUpdateErr error) *agentm
 	agentData.On("GetLastSeenConfigVersion").Return(uint64(0))
 	agentData.On("IsAgentHealthy").Return(true, healthcheck.Response{})
 	agentData.On("GetLastUpdateError").Return(lastUpdateErr)
-	return c.fillRequest(agentData)
+	return c.fillRequest(context.Background(), agentData, notices)
 }
 
 // guardWithTimeout returns a FileGuard that has recorded a timeout for a
@@ -651,3 +791,9 @@ func TestFillRequest_DiskUnavailable(t *testing.T) {
 		assert.Equal(t, "", req.LastUpdateError)
 	})
 }
+
+func TestFillRequest_Notices(t *testing.T) {
+	guard := osutils.NewFileGuard(osutils.DefaultMaxPendingFileOps)
+	req := fillRequestWithGuard(guard, fmt.Errorf("update boom"), "restart deferred: outside maintenance window")
+	assert.Equal(t, "update boom\nrestart deferred: outside maintenance window", req.LastUpdateError)
+}
@@ -9,12 +9,30 @@ type KeepAliveConfig struct {
 }
 
 type GRPCConfig struct {
-	Endpoint  string          `yaml:"endpoint"`
+	Endpoint string `yaml:"endpoint"`
+	// Endpoints, if set, replaces Endpoint with an ordered list of backends:
+	// the first is the primary, the others are failed over to in order.
+	Endpoints []string        `yaml:"endpoints"`
+	Failover  FailoverConfig  `yaml:"failover"`
 	TLS       TLSConfig       `yaml:"tls"`
 	Insecure  bool            `yaml:"insecure"`
 	Timeout   time.Duration   `yaml:"timeout"`
 	Retry     RetryConfig     `yaml:"retry"`
 	KeepAlive KeepAliveConfig `yaml:"keep_alive"`
+	// EndpointOverrideRefreshInterval is how often the endpoint override in
+	// the instance metadata is re-checked; the override replaces the
+	// configured endpoints and a change reconnects. Zero disables the
+	// override.
+	EndpointOverrideRefreshInterval time.Duration `yaml:"endpoint_override_refresh_interval"`
+}
+
+// FailoverConfig controls switching between Endpoints. The client moves to
+// the next endpoint after FailureThreshold consecutive calls failed with the
+// backend unavailable or timing out, and while away from the primary retries
+// it every FailbackInterval.
+type FailoverConfig struct {
+	FailureThreshold int           `yaml:"failure_threshold"`
+	FailbackInterval time.Duration `yaml:"failback_interval"`
 }
 
 func GetDefaultGrpcConfig() GRPCConfig {
@@ -23,6 +41,11 @@ func GetDefaultGrpcConfig() GRPCConfig {
 		Insecure: false,
 		Timeout:  5 * time.Second,
 		Retry:    GetDefaultRetryConfig(),
+		Failover: FailoverConfig{
+			FailureThreshold: 3,
+			FailbackInterval: 10 * time.Minute,
+		},
+		EndpointOverrideRefreshInterval: 5 * time.Minute,
 		KeepAlive: KeepAliveConfig{
 			Time:                20 * time.Second,
 			Timeout:             10 * time.Second,
@@ -49,8 +72,15 @@ func GetDefaultRetryConfig() RetryConfig {
 	}
 }
 
+// TLSConfig customizes the TLS connection to the backend; it is ignored when
+// Insecure is set. CAFile replaces the system roots with the PEM bundle it
+// holds, for endpoints behind a private CA. CertFile and KeyFile, set
+// together, are a client certificate presented for mTLS; they are re-read
+// when rotated on disk. ServerName overrides the name the server certificate
+// is verified against, which defaults to the endpoint host.
 type TLSConfig struct {
-	CertFile string `yaml:"cert_file"`
-	KeyFile  string `yaml:"key_file"`
-	CAFile   string `yaml:"ca_file"`
+	CertFile   string `yaml:"cert_file"`
+	KeyFile    string `yaml:"key_file"`
+	CAFile     string `yaml:"ca_file"`
+	ServerName string `yaml:"server_name"`
 }
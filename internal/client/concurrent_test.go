@@ -0,0 +1,120 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nebius/gosdk/proto/nebius/logging/v1/agentmanager"
+	"github.com/nebius/nebius-observability-agent-updater/internal/client/clientconfig"
+	"github.com/nebius/nebius-observability-agent-updater/internal/config"
+	"github.com/nebius/nebius-observability-agent-updater/internal/healthcheck"
+	"github.com/nebius/nebius-observability-agent-updater/internal/osutils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeVersionService fails every other call as unavailable and otherwise
+// echoes the agent's last seen config version, so a response can be matched
+// to the agent that asked for it.
+type fakeVersionService struct {
+	agentmanager.UnimplementedVersionServiceServer
+	calls atomic.Int64
+}
+
+func (f *fakeVersionService) GetVersion(_ context.Context, req *agentmanager.GetVersionRequest) (*agentmanager.GetVersionResponse, error) {
+	if f.calls.Add(1)%2 == 0 {
+		return nil, status.Error(codes.Unavailable, "overloaded")
+	}
+	return &agentmanager.GetVersionResponse{Action: agentmanager.Action_NOP, ConfigVersion: req.LastSeenConfigVersion}, nil
+}
+
+func startFakeVersionService(t *testing.T, service agentmanager.VersionServiceServer) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := grpc.NewServer()
+	agentmanager.RegisterVersionServiceServer(server, service)
+	go func() { _ = server.Serve(ln) }()
+	t.Cleanup(server.Stop)
+	return ln.Addr().String()
+}
+
+func TestSendAgentDataConcurrentAgents(t *testing.T) {
+	const agentCount, polls = 20, 5
+	service := &fakeVersionService{}
+	addr := startFakeVersionService(t, service)
+
+	metadata := &mockMetadataReader{}
+	oh := &mockOSHelper{}
+	dh := &mockDcgmHelper{}
+	metadata.On("GetParentId").Return("parent-123", nil)
+	metadata.On("GetInstanceId").Return("instance-456", false, nil)
+	metadata.On("GetEndpointOverride").Return("", nil)
+	oh.On("GetDebVersion", mock.Anything).Return("1.0.0", nil)
+	oh.On("GetServiceUptime", mock.Anything).Return(10*time.Minute, nil)
+	oh.On("GetSystemUptime").Return(1*time.Hour, nil)
+	oh.On("GetOsName").Return("Linux", nil)
+	oh.On("GetUname").Return("Linux 5.4.0-generic", nil)
+	oh.On("GetArch").Return("x86_64", nil)
+	oh.On("GetMk8sClusterId").Return("abcd")
+	dh.On("GetDCGMVersion").Return("3.3.7", nil)
+	dh.On("GetGpuInfo").Return("NVIDIA H200", 2, nil)
+
+	cfg := config.Config{
+		GRPC: clientconfig.GRPCConfig{
+			// Both endpoints point at the fake, so failovers caused by the
+			// unavailable calls keep reaching it.
+			Endpoints: []string{addr, addr},
+			Insecure:  true,
+			Timeout:   5 * time.Second,
+			Retry: clientconfig.RetryConfig{
+				Enabled:         true,
+				MaxElapsedTime:  10 * time.Second,
+				InitialInterval: time.Millisecond,
+				Multiplier:      1,
+			},
+			Failover:                        clientconfig.FailoverConfig{FailureThreshold: 2, FailbackInterval: time.Millisecond},
+			EndpointOverrideRefreshInterval: time.Nanosecond,
+		},
+	}
+	client, err := New(metadata, oh, dh, osutils.NewFileGuard(osutils.DefaultMaxPendingFileOps), &cfg, slog.New(slog.NewTextHandler(io.Discard, nil)), tokenFunc)
+	require.NoError(t, err)
+	defer client.Close()
+
+	var wg sync.WaitGroup
+	for i := range agentCount {
+		agentData := &mockAgentData{}
+		agentData.On("GetServiceName").Return(fmt.Sprintf("agent-%d", i))
+		agentData.On("GetDebPackageName").Return(fmt.Sprintf("agent-%d-package", i))
+		agentData.On("GetAgentType").Return(agentmanager.AgentType_O11Y_AGENT)
+		agentData.On("GetLastSeenConfigVersion").Return(uint64(i))
+		agentData.On("IsAgentHealthy").Return(true, healthcheck.Response{})
+		agentData.On("GetLastUpdateError").Return(nil)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range polls {
+				response, err := client.SendAgentData(context.Background(), agentData)
+				if assert.NoError(t, err) {
+					assert.Equal(t, uint64(i), response.ConfigVersion)
+				}
+				_ = activeEndpoint(client)
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.GreaterOrEqual(t, service.calls.Load(), int64(2*agentCount*polls-1), "every poll is retried after an unavailable call")
+}
@@ -0,0 +1,176 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/nebius/gosdk/proto/nebius/logging/v1/agentmanager"
+	"google.golang.org/grpc"
+)
+
+// endpointOverrideTimeout bounds an endpoint override lookup, which tries both
+// metadata service URLs.
+const endpointOverrideTimeout = 15 * time.Second
+
+// backendEndpoint is a connection to one of the backends. calls and retired
+// are guarded by Client.connMu: a replaced endpoint is retired and closed once
+// its last in-flight call returns.
+type backendEndpoint struct {
+	address string
+	conn    *grpc.ClientConn
+	client  agentmanager.VersionServiceClient
+
+	calls   int
+	retired bool
+}
+
+// dialEndpoints creates a connection per address. Connections are established
+// lazily, on the first call to an endpoint.
+func dialEndpoints(addresses []string, dialOptions []grpc.DialOption) ([]*backendEndpoint, error) {
+	endpoints := make([]*backendEndpoint, 0, len(addresses))
+	for _, address := range addresses {
+		conn, err := grpc.NewClient("dns:///"+address, dialOptions...)
+		if err != nil {
+			closeEndpoints(endpoints)
+			return nil, fmt.Errorf("failed to create grpc client to %s: %w", address, err)
+		}
+		endpoints = append(endpoints, &backendEndpoint{address: address, conn: conn, client: agentmanager.NewVersionServiceClient(conn)})
+	}
+	return endpoints, nil
+}
+
+func closeEndpoints(endpoints []*backendEndpoint) {
+	for _, e := range endpoints {
+		if e.conn != nil {
+			_ = e.conn.Close()
+		}
+	}
+}
+
+// connect replaces the endpoints calls are sent to and starts over on the
+// first of them. The previous connections are closed once the calls still
+// using them return, so a reconnect does not cancel them. The failover
+// history is carried over, and a non-empty reason is recorded in it.
+func (s *Client) connect(addresses []string, reason string) error {
+	endpoints, err := dialEndpoints(addresses, s.dialOptions)
+	if err != nil {
+		return err
+	}
+	fo := newFailover(addresses, s.config.GRPC.Failover, s.logger)
+	s.connMu.Lock()
+	old, oldFailover := s.endpoints, s.failover
+	fo.history = oldFailover.events()
+	if reason != "" {
+		from, _, _ := oldFailover.status()
+		fo.record(failoverEvent{time: time.Now(), from: from, to: addresses[0], reason: reason})
+	}
+	s.endpoints, s.failover = endpoints, fo
+	idle := make([]*backendEndpoint, 0, len(old))
+	for _, e := range old {
+		e.retired = true
+		if e.calls == 0 {
+			idle = append(idle, e)
+		}
+	}
+	s.connMu.Unlock()
+	closeEndpoints(idle)
+	return nil
+}
+
+// acquire picks the endpoint for the next call, probing the primary for a
+// failback only if allowProbe is set, and keeps its connection open until
+// release. It also returns the endpoint's index, whether the call is a probe,
+// and the failover state to report to.
+func (s *Client) acquire(now time.Time, allowProbe bool) (*backendEndpoint, int, bool, *failover) {
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+	i, probe := s.failover.current(), false
+	if allowProbe {
+		i, probe = s.failover.pick(now)
+	}
+	endpoint := s.endpoints[i]
+	endpoint.calls++
+	return endpoint, i, probe, s.failover
+}
+
+// release ends a call started with acquire and closes the endpoint if it was
+// replaced in the meantime and no other call uses it.
+func (s *Client) release(endpoint *backendEndpoint) {
+	s.connMu.Lock()
+	endpoint.calls--
+	closing := endpoint.retired && endpoint.calls == 0
+	s.connMu.Unlock()
+	if closing {
+		closeEndpoints([]*backendEndpoint{endpoint})
+	}
+}
+
+// backends returns the current endpoints and their failover state.
+func (s *Client) backends() ([]*backendEndpoint, *failover) {
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+	return s.endpoints, s.failover
+}
+
+func (s *Client) Close() {
+	endpoints, _ := s.backends()
+	closeEndpoints(endpoints)
+}
+
+// refreshEndpointOverride re-reads the endpoint override from IMDS once per
+// EndpointOverrideRefreshInterval and reconnects if it changed. An override
+// replaces the configured endpoints; once it is removed they are used again.
+// A failed lookup keeps the current endpoints. The lookup runs without
+// holding overrideMu, so a slow IMDS does not block the other agents' polls.
+func (s *Client) refreshEndpointOverride(ctx context.Context) {
+	interval := s.config.GRPC.EndpointOverrideRefreshInterval
+	if interval <= 0 {
+		return
+	}
+	s.overrideMu.Lock()
+	if time.Since(s.overrideCheckedAt) < interval {
+		s.overrideMu.Unlock()
+		return
+	}
+	s.overrideCheckedAt = time.Now()
+	s.overrideMu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, endpointOverrideTimeout)
+	defer cancel()
+	override, err := s.metadata.GetEndpointOverride(ctx)
+	if err != nil {
+		s.logger.Warn("failed to re-check backend endpoint override, keeping current endpoints", "error", err)
+		return
+	}
+
+	s.overrideMu.Lock()
+	defer s.overrideMu.Unlock()
+	if override == s.override {
+		return
+	}
+	addresses := s.configured
+	if override != "" {
+		addresses = []string{override}
+	}
+	if len(addresses) == 0 {
+		s.logger.Warn("backend endpoint override was removed and no endpoint is configured, keeping current endpoints", "endpoint", s.override)
+		return
+	}
+	endpoints, _ := s.backends()
+	current := make([]string, len(endpoints))
+	for i, e := range endpoints {
+		current[i] = e.address
+	}
+	if slices.Equal(addresses, current) {
+		s.override = override
+		return
+	}
+	s.logger.Info("backend endpoint override changed, reconnecting", "old_override", s.override, "new_override", override, "endpoints", addresses)
+	if err := s.connect(addresses, fmt.Sprintf("endpoint override changed from %q to %q", s.override, override)); err != nil {
+		s.logger.Error("failed to reconnect after endpoint override change", "error", err)
+		return
+	}
+	s.override = override
+}
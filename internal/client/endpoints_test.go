@@ -0,0 +1,172 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/nebius/gosdk/proto/nebius/logging/v1/agentmanager"
+	"github.com/nebius/nebius-observability-agent-updater/internal/client/clientconfig"
+	"github.com/nebius/nebius-observability-agent-updater/internal/config"
+	"github.com/nebius/nebius-observability-agent-updater/internal/healthcheck"
+	"github.com/nebius/nebius-observability-agent-updater/internal/osutils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// activeEndpoint returns the endpoint client sends its calls to.
+func activeEndpoint(client *Client) string {
+	_, fo := client.backends()
+	active, _, _ := fo.status()
+	return active
+}
+
+func TestEndpointOverride(t *testing.T) {
+	metadata := &mockMetadataReader{}
+	cfg := config.Config{
+		GRPC: clientconfig.GRPCConfig{
+			Endpoints:                       []string{"primary:443", "secondary:443"},
+			Insecure:                        true,
+			Timeout:                         5 * time.Second,
+			EndpointOverrideRefreshInterval: time.Hour,
+		},
+	}
+	metadata.On("GetEndpointOverride").Return("override-a:443", nil).Once()
+	client, err := New(metadata, &mockOSHelper{}, &mockDcgmHelper{}, osutils.NewFileGuard(osutils.DefaultMaxPendingFileOps), &cfg, slog.New(slog.NewTextHandler(io.Discard, nil)), tokenFunc)
+	require.NoError(t, err)
+	defer client.Close()
+	assert.Equal(t, "override-a:443", activeEndpoint(client), "the override is read at startup")
+
+	refresh := func() {
+		client.overrideCheckedAt = time.Time{}
+		client.refreshEndpointOverride(context.Background())
+	}
+
+	client.refreshEndpointOverride(context.Background())
+	metadata.AssertNumberOfCalls(t, "GetEndpointOverride", 1)
+
+	metadata.On("GetEndpointOverride").Return("override-b:443", nil).Once()
+	oldConn := client.endpoints[0].conn
+	refresh()
+	assert.Equal(t, "override-b:443", activeEndpoint(client))
+	assert.Equal(t, "SHUTDOWN", oldConn.GetState().String(), "the previous connection is closed")
+
+	metadata.On("GetEndpointOverride").Return("", errors.New("IMDS unreachable")).Once()
+	refresh()
+	assert.Equal(t, "override-b:443", activeEndpoint(client), "a failed lookup keeps the current endpoint")
+
+	metadata.On("GetEndpointOverride").Return("", nil).Once()
+	refresh()
+	assert.Equal(t, "primary:443", activeEndpoint(client), "a removed override returns to the configured endpoints")
+	assert.Len(t, client.endpoints, 2)
+
+	history := client.failover.events()
+	require.Len(t, history, 2)
+	assert.Equal(t, "override-a:443", history[0].from)
+	assert.Equal(t, "override-b:443", history[0].to)
+	assert.Equal(t, `endpoint override changed from "override-b:443" to ""`, history[1].reason)
+	metadata.AssertExpectations(t)
+}
+
+func TestEndpointOverride_RequiredWithoutConfiguredEndpoint(t *testing.T) {
+	t.Setenv(ENDPOINT_ENV, "")
+	cfg := config.Config{
+		GRPC: clientconfig.GRPCConfig{
+			Insecure:                        true,
+			EndpointOverrideRefreshInterval: time.Hour,
+		},
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	fileGuard := osutils.NewFileGuard(osutils.DefaultMaxPendingFileOps)
+
+	metadata := &mockMetadataReader{}
+	metadata.On("GetEndpointOverride").Return("", nil)
+	_, err := New(metadata, &mockOSHelper{}, &mockDcgmHelper{}, fileGuard, &cfg, logger, tokenFunc)
+	assert.EqualError(t, err, "endpoint is not set")
+
+	metadata = &mockMetadataReader{}
+	metadata.On("GetEndpointOverride").Return("override:443", nil)
+	client, err := New(metadata, &mockOSHelper{}, &mockDcgmHelper{}, fileGuard, &cfg, logger, tokenFunc)
+	require.NoError(t, err)
+	defer client.Close()
+	assert.Equal(t, "override:443", activeEndpoint(client))
+}
+
+// blockingVersionService answers GetVersion once unblock is closed.
+type blockingVersionService struct {
+	agentmanager.UnimplementedVersionServiceServer
+	started chan struct{}
+	unblock chan struct{}
+}
+
+func (b *blockingVersionService) GetVersion(ctx context.Context, _ *agentmanager.GetVersionRequest) (*agentmanager.GetVersionResponse, error) {
+	b.started <- struct{}{}
+	select {
+	case <-b.unblock:
+		return &agentmanager.GetVersionResponse{Action: agentmanager.Action_NOP}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func TestEndpointOverride_KeepsInFlightCalls(t *testing.T) {
+	service := &blockingVersionService{started: make(chan struct{}, 1), unblock: make(chan struct{})}
+	addr := startFakeVersionService(t, service)
+
+	metadata := &mockMetadataReader{}
+	oh := &mockOSHelper{}
+	dh := &mockDcgmHelper{}
+	metadata.On("GetParentId").Return("parent-123", nil)
+	metadata.On("GetInstanceId").Return("instance-456", false, nil)
+	oh.On("GetDebVersion", mock.Anything).Return("1.0.0", nil)
+	oh.On("GetServiceUptime", mock.Anything).Return(10*time.Minute, nil)
+	oh.On("GetSystemUptime").Return(1*time.Hour, nil)
+	oh.On("GetOsName").Return("Linux", nil)
+	oh.On("GetUname").Return("Linux 5.4.0-generic", nil)
+	oh.On("GetArch").Return("x86_64", nil)
+	oh.On("GetMk8sClusterId").Return("abcd")
+	dh.On("GetDCGMVersion").Return("3.3.7", nil)
+	dh.On("GetGpuInfo").Return("NVIDIA H200", 2, nil)
+	agentData := &mockAgentData{}
+	agentData.On("GetServiceName").Return("test-service")
+	agentData.On("GetDebPackageName").Return("test-package")
+	agentData.On("GetAgentType").Return(agentmanager.AgentType_O11Y_AGENT)
+	agentData.On("GetLastSeenConfigVersion").Return(uint64(0))
+	agentData.On("IsAgentHealthy").Return(true, healthcheck.Response{})
+	agentData.On("GetLastUpdateError").Return(nil)
+
+	cfg := config.Config{
+		GRPC: clientconfig.GRPCConfig{
+			Endpoints:                       []string{addr},
+			Insecure:                        true,
+			Timeout:                         5 * time.Second,
+			EndpointOverrideRefreshInterval: time.Hour,
+		},
+	}
+	metadata.On("GetEndpointOverride").Return("", nil).Once()
+	client, err := New(metadata, oh, dh, osutils.NewFileGuard(osutils.DefaultMaxPendingFileOps), &cfg, slog.New(slog.NewTextHandler(io.Discard, nil)), tokenFunc)
+	require.NoError(t, err)
+	defer client.Close()
+	oldConn := client.endpoints[0].conn
+
+	result := make(chan error, 1)
+	go func() {
+		_, err := client.SendAgentData(context.Background(), agentData)
+		result <- err
+	}()
+	<-service.started
+
+	metadata.On("GetEndpointOverride").Return("override:443", nil).Once()
+	client.overrideCheckedAt = time.Time{}
+	client.refreshEndpointOverride(context.Background())
+	assert.Equal(t, "override:443", activeEndpoint(client))
+	assert.NotEqual(t, "SHUTDOWN", oldConn.GetState().String(), "the replaced connection stays open for the call in flight")
+
+	close(service.unblock)
+	require.NoError(t, <-result, "the call in flight is not cancelled by the reconnect")
+	assert.Equal(t, "SHUTDOWN", oldConn.GetState().String(), "the replaced connection is closed after its last call")
+}
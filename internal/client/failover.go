@@ -0,0 +1,141 @@
+package client
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/nebius/nebius-observability-agent-updater/internal/client/clientconfig"
+)
+
+// failoverHistorySize bounds the failover events kept, and so reported with
+// every request.
+const failoverHistorySize = 10
+
+// failoverEvent is a switch between backend endpoints.
+type failoverEvent struct {
+	time   time.Time
+	from   string
+	to     string
+	reason string
+}
+
+func (e failoverEvent) String() string {
+	return fmt.Sprintf("%s %s -> %s (%s)", e.time.UTC().Format(time.RFC3339), e.from, e.to, e.reason)
+}
+
+// failover picks the backend endpoint for each call. It stays on the active
+// endpoint while it works, moves to the next one after FailureThreshold
+// consecutive failures, and while away from the primary sends one call to it
+// every FailbackInterval, switching back if that call succeeds. Every switch
+// is logged and kept in a bounded history. A nil *failover always picks the
+// first endpoint.
+type failover struct {
+	addresses []string
+	cfg       clientconfig.FailoverConfig
+	logger    *slog.Logger
+
+	mu        sync.Mutex
+	active    int
+	failures  int
+	lastProbe time.Time
+	since     time.Time
+	history   []failoverEvent
+}
+
+func newFailover(addresses []string, cfg clientconfig.FailoverConfig, logger *slog.Logger) *failover {
+	return &failover{addresses: addresses, cfg: cfg, logger: logger}
+}
+
+// pick returns the endpoint for the next call and whether the call probes the
+// primary for a failback.
+func (f *failover) pick(now time.Time) (int, bool) {
+	if f == nil {
+		return 0, false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.active != 0 && f.cfg.FailbackInterval > 0 && now.Sub(f.lastProbe) >= f.cfg.FailbackInterval {
+		f.lastProbe = now
+		return 0, true
+	}
+	return f.active, false
+}
+
+// current returns the active endpoint, never probing the primary.
+func (f *failover) current() int {
+	if f == nil {
+		return 0
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.active
+}
+
+// report records the outcome of a call to endpoint i. failed is set only for
+// failures that point at the endpoint, such as an unavailable backend, and
+// reason describes them.
+func (f *failover) report(now time.Time, i int, probe, failed bool, reason string) {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if probe {
+		if !failed {
+			f.switchTo(now, 0, "primary endpoint is reachable again")
+		} else {
+			f.logger.Info("primary backend endpoint still failing, staying on fallback", "primary", f.addresses[0], "active", f.addresses[f.active], "reason", reason)
+		}
+		return
+	}
+	if i != f.active {
+		// A call that started before a switch.
+		return
+	}
+	if !failed {
+		f.failures = 0
+		return
+	}
+	f.failures++
+	if len(f.addresses) > 1 && f.failures >= max(f.cfg.FailureThreshold, 1) {
+		f.switchTo(now, (f.active+1)%len(f.addresses), reason)
+	}
+}
+
+func (f *failover) switchTo(now time.Time, i int, reason string) {
+	f.logger.Warn("switching backend endpoint", "from", f.addresses[f.active], "to", f.addresses[i], "reason", reason, "consecutive_failures", f.failures)
+	f.record(failoverEvent{time: now, from: f.addresses[f.active], to: f.addresses[i], reason: reason})
+	f.active, f.failures, f.lastProbe, f.since = i, 0, now, now
+}
+
+// record appends e to the history, dropping the oldest events beyond
+// failoverHistorySize. f.mu must be held, or f not yet shared.
+func (f *failover) record(e failoverEvent) {
+	f.history = append(f.history, e)
+	if len(f.history) > failoverHistorySize {
+		f.history = f.history[len(f.history)-failoverHistorySize:]
+	}
+}
+
+// status returns the active endpoint, whether it is the primary and since
+// when it is active.
+func (f *failover) status() (string, bool, time.Time) {
+	if f == nil {
+		return "", true, time.Time{}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.addresses[f.active], f.active == 0, f.since
+}
+
+// events returns the recent switches, oldest first.
+func (f *failover) events() []failoverEvent {
+	if f == nil {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]failoverEvent(nil), f.history...)
+}
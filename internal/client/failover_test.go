@@ -0,0 +1,154 @@
+package client
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nebius/gosdk/proto/nebius/logging/v1/agentmanager"
+	"github.com/nebius/nebius-observability-agent-updater/internal/client/clientconfig"
+	"github.com/nebius/nebius-observability-agent-updater/internal/config"
+	"github.com/nebius/nebius-observability-agent-updater/internal/healthcheck"
+	"github.com/nebius/nebius-observability-agent-updater/internal/osutils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestFailover(t *testing.T) {
+	f := newFailover([]string{"primary", "secondary", "tertiary"},
+		clientconfig.FailoverConfig{FailureThreshold: 2, FailbackInterval: 10 * time.Minute},
+		slog.New(slog.NewTextHandler(io.Discard, nil)))
+	now := time.Now()
+	call := func(failed bool) int {
+		i, probe := f.pick(now)
+		f.report(now, i, probe, failed, "unavailable")
+		return i
+	}
+
+	assert.Equal(t, 0, call(true))
+	assert.Equal(t, 0, call(false), "a success resets the failure count")
+	assert.Equal(t, 0, call(true))
+	assert.Equal(t, 0, call(true))
+	assert.Equal(t, 1, call(true), "moved to the next endpoint after two consecutive failures")
+	assert.Equal(t, 1, call(true))
+	assert.Equal(t, 2, call(false))
+	active, primary, since := f.status()
+	assert.Equal(t, "tertiary", active)
+	assert.False(t, primary)
+	assert.Equal(t, now, since)
+
+	now = now.Add(10 * time.Minute)
+	assert.Equal(t, 0, call(true), "the primary is probed after the failback interval")
+	assert.Equal(t, 2, call(false), "a failed probe stays on the fallback")
+	now = now.Add(10 * time.Minute)
+	assert.Equal(t, 0, call(false))
+	assert.Equal(t, 0, call(false), "a successful probe fails back")
+	active, primary, _ = f.status()
+	assert.Equal(t, "primary", active)
+	assert.True(t, primary)
+
+	history := f.events()
+	assert.Len(t, history, 3)
+	assert.Equal(t, failoverEvent{time: now, from: "tertiary", to: "primary", reason: "primary endpoint is reachable again"}, history[2])
+	assert.Equal(t, "primary", history[0].from)
+	assert.Equal(t, "unavailable", history[0].reason)
+
+	for range failoverHistorySize {
+		f.switchTo(now, 1, "unavailable")
+	}
+	assert.Len(t, f.events(), failoverHistorySize, "the history is bounded")
+}
+
+func TestFailover_Nil(t *testing.T) {
+	var f *failover
+	i, probe := f.pick(time.Now())
+	assert.Equal(t, 0, i)
+	assert.False(t, probe)
+	f.report(time.Now(), 0, false, true, "unavailable")
+	assert.Equal(t, 0, f.current())
+	assert.Nil(t, f.events())
+}
+
+func TestSendAgentDataFailover(t *testing.T) {
+	metadata := &mockMetadataReader{}
+	oh := &mockOSHelper{}
+	dh := &mockDcgmHelper{}
+	primary := &mockVersionServiceClient{}
+	secondary := &mockVersionServiceClient{}
+	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+
+	endpoints := testEndpoints(primary, secondary)
+	client := &Client{
+		metadata:  metadata,
+		oh:        oh,
+		dh:        dh,
+		fileGuard: osutils.NewFileGuard(osutils.DefaultMaxPendingFileOps),
+		endpoints: endpoints,
+		failover:  newFailover([]string{endpoints[0].address, endpoints[1].address}, clientconfig.FailoverConfig{FailureThreshold: 2, FailbackInterval: time.Hour}, logger),
+		config: &config.Config{
+			GRPC: clientconfig.GRPCConfig{
+				Timeout: 5 * time.Second,
+			},
+		},
+		logger: logger,
+	}
+
+	metadata.On("GetParentId").Return("parent-123", nil)
+	metadata.On("GetInstanceId").Return("instance-456", false, nil)
+	oh.On("GetDebVersion", mock.Anything).Return("1.0.0", nil)
+	oh.On("GetServiceUptime", mock.Anything).Return(10*time.Minute, nil)
+	oh.On("GetSystemUptime").Return(1*time.Hour, nil)
+	oh.On("GetOsName").Return("Linux", nil)
+	oh.On("GetUname").Return("Linux 5.4.0-generic", nil)
+	oh.On("GetArch").Return("x86_64", nil)
+	oh.On("GetMk8sClusterId").Return("abcd")
+	dh.On("GetDCGMVersion").Return("3.3.7", nil)
+	dh.On("GetGpuInfo").Return("NVIDIA H200", 2, nil)
+
+	agentData := &mockAgentData{}
+	agentData.On("GetServiceName").Return("test-agent")
+	agentData.On("GetDebPackageName").Return("test-agent-package")
+	agentData.On("GetAgentType").Return(agentmanager.AgentType_O11Y_AGENT)
+	agentData.On("GetLastSeenConfigVersion").Return(uint64(0))
+	agentData.On("IsAgentHealthy").Return(true, healthcheck.Response{})
+	agentData.On("GetLastUpdateError").Return(nil)
+
+	primary.On("GetVersion", mock.Anything, mock.Anything, mock.Anything).
+		Return(nil, status.Error(codes.PermissionDenied, "denied")).Once()
+	primary.On("GetVersion", mock.Anything, mock.Anything, mock.Anything).
+		Return(nil, status.Error(codes.Unavailable, "connection refused")).Twice()
+	var fallbackRequest *agentmanager.GetVersionRequest
+	secondary.On("GetVersion", mock.Anything, mock.Anything, mock.Anything).
+		Run(func(args mock.Arguments) { fallbackRequest = args.Get(1).(*agentmanager.GetVersionRequest) }).
+		Return(&agentmanager.GetVersionResponse{Action: agentmanager.Action_NOP}, nil)
+
+	for range 3 {
+		_, err := client.SendAgentData(context.Background(), agentData)
+		assert.Error(t, err)
+	}
+	assert.Equal(t, "backend-1:443", activeEndpoint(client), "only unavailable errors count towards the failover")
+	_, err := client.SendAgentData(context.Background(), agentData)
+	assert.NoError(t, err)
+
+	primary.AssertExpectations(t)
+	secondary.AssertNumberOfCalls(t, "GetVersion", 1)
+	assert.Contains(t, fallbackRequest.LastUpdateError, "using fallback backend endpoint backend-1:443 since ")
+	assert.Contains(t, fallbackRequest.LastUpdateError, "recent backend endpoint switches: ")
+	assert.Contains(t, fallbackRequest.LastUpdateError, "backend-0:443 -> backend-1:443 (rpc error: code = Unavailable desc = connection refused)")
+
+	client.failover.lastProbe = time.Time{}
+	primary.On("GetVersion", mock.Anything, mock.Anything, mock.Anything).
+		Return(nil, status.Error(codes.Unavailable, "still down")).Once()
+	response, err := client.SendAgentData(context.Background(), agentData)
+	require.NoError(t, err, "a failed failback probe does not cost the poll")
+	assert.Equal(t, agentmanager.Action_NOP, response.Action)
+	primary.AssertExpectations(t)
+	secondary.AssertNumberOfCalls(t, "GetVersion", 2)
+	assert.Equal(t, "backend-1:443", activeEndpoint(client))
+}
@@ -0,0 +1,58 @@
+package client
+
+import (
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// isRetryable reports whether a call that failed with err may succeed if
+// repeated. Other codes, such as InvalidArgument, PermissionDenied or
+// Unimplemented, fail the same way every time.
+func isRetryable(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.ResourceExhausted, codes.DeadlineExceeded, codes.Aborted:
+		return true
+	}
+	return false
+}
+
+// serverRetryDelay returns the delay the server asked for with a
+// google.rpc.RetryInfo detail on err, if any.
+func serverRetryDelay(err error) (time.Duration, bool) {
+	st, ok := status.FromError(err)
+	if !ok {
+		return 0, false
+	}
+	for _, detail := range st.Details() {
+		if info, ok := detail.(*errdetails.RetryInfo); ok && info.GetRetryDelay() != nil {
+			return info.GetRetryDelay().AsDuration(), true
+		}
+	}
+	return 0, false
+}
+
+// serverDelayBackOff waits at least the delay the server asked for before the
+// next attempt, and otherwise follows the wrapped BackOff, including its
+// MaxElapsedTime.
+type serverDelayBackOff struct {
+	backoff.BackOff
+	delay time.Duration
+}
+
+// delayNext makes the next attempt wait at least d.
+func (b *serverDelayBackOff) delayNext(d time.Duration) {
+	b.delay = d
+}
+
+func (b *serverDelayBackOff) NextBackOff() time.Duration {
+	next := b.BackOff.NextBackOff()
+	if next != backoff.Stop && b.delay > next {
+		next = b.delay
+	}
+	b.delay = 0
+	return next
+}
@@ -0,0 +1,142 @@
+package client
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/nebius/gosdk/proto/nebius/logging/v1/agentmanager"
+	"github.com/nebius/nebius-observability-agent-updater/internal/client/clientconfig"
+	"github.com/nebius/nebius-observability-agent-updater/internal/config"
+	"github.com/nebius/nebius-observability-agent-updater/internal/healthcheck"
+	"github.com/nebius/nebius-observability-agent-updater/internal/osutils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// newRetryTestClient returns a client with retries enabled whose request
+// data is stubbed, and the agent to send.
+func newRetryTestClient(t *testing.T, versionClient agentmanager.VersionServiceClient) (*Client, *mockAgentData) {
+	t.Helper()
+	metadata := &mockMetadataReader{}
+	oh := &mockOSHelper{}
+	dh := &mockDcgmHelper{}
+	metadata.On("GetParentId").Return("parent-123", nil)
+	metadata.On("GetInstanceId").Return("instance-456", false, nil)
+	oh.On("GetDebVersion", mock.Anything).Return("1.0.0", nil)
+	oh.On("GetServiceUptime", mock.Anything).Return(10*time.Minute, nil)
+	oh.On("GetSystemUptime").Return(1*time.Hour, nil)
+	oh.On("GetOsName").Return("Linux", nil)
+	oh.On("GetUname").Return("Linux 5.4.0-generic", nil)
+	oh.On("GetArch").Return("x86_64", nil)
+	oh.On("GetMk8sClusterId").Return("abcd")
+	dh.On("GetDCGMVersion").Return("3.3.7", nil)
+	dh.On("GetGpuInfo").Return("NVIDIA H200", 2, nil)
+
+	agentData := &mockAgentData{}
+	agentData.On("GetServiceName").Return("test-agent")
+	agentData.On("GetDebPackageName").Return("test-agent-package")
+	agentData.On("GetAgentType").Return(agentmanager.AgentType_O11Y_AGENT)
+	agentData.On("GetLastSeenConfigVersion").Return(uint64(0))
+	agentData.On("IsAgentHealthy").Return(true, healthcheck.Response{})
+	agentData.On("GetLastUpdateError").Return(nil)
+
+	retry := clientconfig.RetryConfig{
+		Enabled:         true,
+		MaxElapsedTime:  5 * time.Second,
+		InitialInterval: time.Millisecond,
+		Multiplier:      1,
+	}
+	return &Client{
+		metadata:  metadata,
+		oh:        oh,
+		dh:        dh,
+		fileGuard: osutils.NewFileGuard(osutils.DefaultMaxPendingFileOps),
+		endpoints: testEndpoints(versionClient),
+		config: &config.Config{
+			GRPC: clientconfig.GRPCConfig{Timeout: 5 * time.Second, Retry: retry},
+		},
+		logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}, agentData
+}
+
+func TestSendAgentDataPermanentErrorFailsFast(t *testing.T) {
+	for _, code := range []codes.Code{codes.InvalidArgument, codes.PermissionDenied, codes.Unimplemented, codes.Unauthenticated} {
+		t.Run(code.String(), func(t *testing.T) {
+			mockClient := &mockVersionServiceClient{}
+			client, agentData := newRetryTestClient(t, mockClient)
+			mockClient.On("GetVersion", mock.Anything, mock.Anything, mock.Anything).
+				Return(nil, status.Error(code, "rejected")).Once()
+
+			_, err := client.SendAgentData(context.Background(), agentData)
+
+			assert.Equal(t, code, status.Code(err))
+			mockClient.AssertNumberOfCalls(t, "GetVersion", 1)
+		})
+	}
+}
+
+func TestSendAgentDataRetriesRetryableCodes(t *testing.T) {
+	for _, code := range []codes.Code{codes.Unavailable, codes.ResourceExhausted, codes.DeadlineExceeded, codes.Aborted} {
+		t.Run(code.String(), func(t *testing.T) {
+			mockClient := &mockVersionServiceClient{}
+			client, agentData := newRetryTestClient(t, mockClient)
+			mockClient.On("GetVersion", mock.Anything, mock.Anything, mock.Anything).
+				Return(nil, status.Error(code, "try again")).Once()
+			mockClient.On("GetVersion", mock.Anything, mock.Anything, mock.Anything).
+				Return(&agentmanager.GetVersionResponse{Action: agentmanager.Action_NOP}, nil).Once()
+
+			_, err := client.SendAgentData(context.Background(), agentData)
+
+			assert.NoError(t, err)
+			mockClient.AssertNumberOfCalls(t, "GetVersion", 2)
+		})
+	}
+}
+
+func TestSendAgentDataHonorsRetryInfo(t *testing.T) {
+	const delay = 300 * time.Millisecond
+	st, err := status.New(codes.ResourceExhausted, "slow down").
+		WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(delay)})
+	require.NoError(t, err)
+
+	mockClient := &mockVersionServiceClient{}
+	client, agentData := newRetryTestClient(t, mockClient)
+	var calls []time.Time
+	record := func(mock.Arguments) { calls = append(calls, time.Now()) }
+	mockClient.On("GetVersion", mock.Anything, mock.Anything, mock.Anything).
+		Run(record).Return(nil, st.Err()).Once()
+	mockClient.On("GetVersion", mock.Anything, mock.Anything, mock.Anything).
+		Run(record).Return(nil, status.Error(codes.Unavailable, "unavailable")).Once()
+	mockClient.On("GetVersion", mock.Anything, mock.Anything, mock.Anything).
+		Run(record).Return(&agentmanager.GetVersionResponse{Action: agentmanager.Action_NOP}, nil).Once()
+
+	_, err = client.SendAgentData(context.Background(), agentData)
+
+	require.NoError(t, err)
+	require.Len(t, calls, 3)
+	assert.GreaterOrEqual(t, calls[1].Sub(calls[0]), delay, "the server's retry delay is honored")
+	assert.Less(t, calls[2].Sub(calls[1]), delay, "the delay applies to one retry only")
+}
+
+func TestServerDelayBackOff(t *testing.T) {
+	b := &serverDelayBackOff{BackOff: backoff.NewConstantBackOff(time.Second)}
+	b.delayNext(time.Minute)
+	assert.Equal(t, time.Minute, b.NextBackOff())
+	assert.Equal(t, time.Second, b.NextBackOff())
+
+	b.delayNext(time.Millisecond)
+	assert.Equal(t, time.Second, b.NextBackOff(), "a shorter server delay does not speed up the backoff")
+
+	stopped := &serverDelayBackOff{BackOff: &backoff.StopBackOff{}}
+	stopped.delayNext(time.Minute)
+	assert.Equal(t, backoff.Stop, stopped.NextBackOff(), "the server delay does not extend MaxElapsedTime")
+}
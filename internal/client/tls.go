@@ -0,0 +1,110 @@
+package client
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/nebius/nebius-observability-agent-updater/internal/client/clientconfig"
+	"github.com/nebius/nebius-observability-agent-updater/internal/osutils"
+)
+
+// tlsFileTimeout bounds reads of the CA bundle and the client certificate so
+// an unresponsive disk cannot hang startup or a TLS handshake. Declared as var
+// so tests can shorten it.
+var tlsFileTimeout = 5 * time.Second
+
+// newTLSConfig builds the client TLS configuration from cfg. The CA bundle
+// and the client certificate are loaded eagerly, so a misconfiguration fails
+// startup rather than every poll.
+func newTLSConfig(cfg clientconfig.TLSConfig, fileGuard *osutils.FileGuard, logger *slog.Logger) (*tls.Config, error) {
+	tlsConfig := &tls.Config{ServerName: cfg.ServerName}
+	if cfg.CAFile != "" {
+		pem, err := fileGuard.ReadFile(cfg.CAFile, tlsFileTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", cfg.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if (cfg.CertFile == "") != (cfg.KeyFile == "") {
+		return nil, errors.New("cert_file and key_file must be set together")
+	}
+	if cfg.CertFile != "" {
+		certs := &clientCertificate{certFile: cfg.CertFile, keyFile: cfg.KeyFile, fileGuard: fileGuard, logger: logger}
+		if err := certs.reload(); err != nil {
+			return nil, err
+		}
+		tlsConfig.GetClientCertificate = certs.get
+	}
+	return tlsConfig, nil
+}
+
+// clientCertificate serves the mTLS client certificate and reloads it when
+// the cert or key file changes, so rotated certificates are picked up by the
+// next handshake without restarting the updater. Established connections keep
+// the certificate they were opened with.
+type clientCertificate struct {
+	certFile  string
+	keyFile   string
+	fileGuard *osutils.FileGuard
+	logger    *slog.Logger
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	certMod time.Time
+	keyMod  time.Time
+}
+
+// get is the tls.Config.GetClientCertificate callback. A rotated pair that
+// fails to load, e.g. because only one of the files was replaced yet, is
+// logged and the previous certificate is presented.
+func (c *clientCertificate) get(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	if err := c.reload(); err != nil {
+		c.logger.Warn("failed to reload client certificate, presenting the previous one", "error", err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cert, nil
+}
+
+// reload loads the pair if either file changed since the last load.
+func (c *clientCertificate) reload() error {
+	certInfo, err := c.fileGuard.Stat(c.certFile, tlsFileTimeout)
+	if err != nil {
+		return fmt.Errorf("failed to stat client certificate: %w", err)
+	}
+	keyInfo, err := c.fileGuard.Stat(c.keyFile, tlsFileTimeout)
+	if err != nil {
+		return fmt.Errorf("failed to stat client key: %w", err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cert != nil && certInfo.ModTime().Equal(c.certMod) && keyInfo.ModTime().Equal(c.keyMod) {
+		return nil
+	}
+	certPEM, err := c.fileGuard.ReadFile(c.certFile, tlsFileTimeout)
+	if err != nil {
+		return fmt.Errorf("failed to read client certificate: %w", err)
+	}
+	keyPEM, err := c.fileGuard.ReadFile(c.keyFile, tlsFileTimeout)
+	if err != nil {
+		return fmt.Errorf("failed to read client key: %w", err)
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return fmt.Errorf("failed to load client certificate %s: %w", c.certFile, err)
+	}
+	if c.cert != nil {
+		c.logger.Info("reloaded rotated client certificate", "cert_file", c.certFile)
+	}
+	c.cert, c.certMod, c.keyMod = &cert, certInfo.ModTime(), keyInfo.ModTime()
+	return nil
+}
@@ -0,0 +1,199 @@
+package client
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log/slog"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nebius/nebius-observability-agent-updater/internal/client/clientconfig"
+	"github.com/nebius/nebius-observability-agent-updater/internal/osutils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns a PEM certificate and key signed by the CA.
+func (ca *testCA) issue(t *testing.T, commonName string, usage x509.ExtKeyUsage) (certPEM, keyPEM []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// startMTLSServer accepts TLS connections that present a client certificate
+// signed by ca and sends the client certificate's common name on names.
+func startMTLSServer(t *testing.T, ca *testCA) (string, <-chan string) {
+	t.Helper()
+	certPEM, keyPEM := ca.issue(t, "backend.internal", x509.ExtKeyUsageServerAuth)
+	serverCert, err := tls.X509KeyPair(certPEM, keyPEM)
+	require.NoError(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = ln.Close() })
+
+	names := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			tlsConn := conn.(*tls.Conn)
+			if err := tlsConn.Handshake(); err == nil {
+				names <- tlsConn.ConnectionState().PeerCertificates[0].Subject.CommonName
+			}
+			_ = conn.Close()
+		}
+	}()
+	return ln.Addr().String(), names
+}
+
+func writeFile(t *testing.T, path string, content []byte, mtime time.Time) {
+	t.Helper()
+	require.NoError(t, os.WriteFile(path, content, 0600))
+	require.NoError(t, os.Chtimes(path, mtime, mtime))
+}
+
+func handshake(t *testing.T, addr string, tlsConfig *tls.Config) error {
+	t.Helper()
+	conn, err := tls.Dial("tcp", addr, tlsConfig)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = conn.Close() }()
+	// The server verifies the client certificate after the client finished
+	// its side of the handshake; a read surfaces its verdict.
+	_, err = conn.Read(make([]byte, 1))
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+func TestNewTLSConfig_MTLS(t *testing.T) {
+	ca := newTestCA(t)
+	addr, names := startMTLSServer(t, ca)
+	dir := t.TempDir()
+	cfg := clientconfig.TLSConfig{
+		CAFile:     filepath.Join(dir, "ca.pem"),
+		CertFile:   filepath.Join(dir, "client.pem"),
+		KeyFile:    filepath.Join(dir, "client.key"),
+		ServerName: "backend.internal",
+	}
+	writeFile(t, cfg.CAFile, ca.pem, time.Now())
+	certPEM, keyPEM := ca.issue(t, "client-1", x509.ExtKeyUsageClientAuth)
+	writeFile(t, cfg.CertFile, certPEM, time.Now().Add(-time.Minute))
+	writeFile(t, cfg.KeyFile, keyPEM, time.Now().Add(-time.Minute))
+
+	fileGuard := osutils.NewFileGuard(osutils.DefaultMaxPendingFileOps)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	tlsConfig, err := newTLSConfig(cfg, fileGuard, logger)
+	require.NoError(t, err)
+
+	require.NoError(t, handshake(t, addr, tlsConfig))
+	assert.Equal(t, "client-1", <-names)
+
+	// Rotate the pair on disk: the next handshake presents the new one.
+	certPEM, keyPEM = ca.issue(t, "client-2", x509.ExtKeyUsageClientAuth)
+	writeFile(t, cfg.CertFile, certPEM, time.Now())
+	writeFile(t, cfg.KeyFile, keyPEM, time.Now())
+	require.NoError(t, handshake(t, addr, tlsConfig))
+	assert.Equal(t, "client-2", <-names)
+
+	// A half-rotated pair keeps presenting the last good certificate.
+	otherCert, _ := ca.issue(t, "client-3", x509.ExtKeyUsageClientAuth)
+	writeFile(t, cfg.CertFile, otherCert, time.Now().Add(time.Minute))
+	require.NoError(t, handshake(t, addr, tlsConfig))
+	assert.Equal(t, "client-2", <-names)
+
+	// Without the private CA the server certificate is not trusted.
+	untrusting, err := newTLSConfig(clientconfig.TLSConfig{ServerName: "backend.internal"}, fileGuard, logger)
+	require.NoError(t, err)
+	assert.Error(t, handshake(t, addr, untrusting))
+}
+
+func TestNewTLSConfig_Invalid(t *testing.T) {
+	dir := t.TempDir()
+	notPEM := filepath.Join(dir, "not-pem")
+	writeFile(t, notPEM, []byte("not a certificate"), time.Now())
+	fileGuard := osutils.NewFileGuard(osutils.DefaultMaxPendingFileOps)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	tests := []struct {
+		name string
+		cfg  clientconfig.TLSConfig
+	}{
+		{"missing CA file", clientconfig.TLSConfig{CAFile: filepath.Join(dir, "missing")}},
+		{"CA file without certificates", clientconfig.TLSConfig{CAFile: notPEM}},
+		{"cert without key", clientconfig.TLSConfig{CertFile: notPEM}},
+		{"invalid key pair", clientconfig.TLSConfig{CertFile: notPEM, KeyFile: notPEM}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newTLSConfig(tt.cfg, fileGuard, logger)
+			assert.Error(t, err)
+		})
+	}
+
+	tlsConfig, err := newTLSConfig(clientconfig.TLSConfig{}, fileGuard, logger)
+	require.NoError(t, err)
+	assert.Nil(t, tlsConfig.RootCAs, "system roots are used by default")
+	assert.Nil(t, tlsConfig.GetClientCertificate)
+}
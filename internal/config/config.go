@@ -5,19 +5,58 @@ import (
 
 	"github.com/nebius/nebius-observability-agent-updater/internal/client/clientconfig"
 	"github.com/nebius/nebius-observability-agent-updater/internal/loggerhelper"
+	"github.com/nebius/nebius-observability-agent-updater/internal/maintenance"
 	"github.com/nebius/nebius-observability-agent-updater/internal/metadata"
+	"github.com/nebius/nebius-observability-agent-updater/internal/policy"
+	"github.com/nebius/nebius-observability-agent-updater/internal/restartlimit"
+	"github.com/nebius/nebius-observability-agent-updater/internal/updateattempts"
 )
 
 type Config struct {
-	PollInterval         time.Duration           `yaml:"poll_interval"`
-	PollJitter           time.Duration           `yaml:"poll_jitter"`
-	Metadata             metadata.Config         `yaml:"metadata"`
-	GRPC                 clientconfig.GRPCConfig `yaml:"grpc"`
-	Logger               loggerhelper.LogConfig  `yaml:"logger"`
-	UpdateRepoScriptPath string                  `yaml:"update_repo_script_path"`
-	Mk8sClusterIdPath    string                  `yaml:"mk8s_cluster_id_path"`
-	HealthCheckPath      string                  `yaml:"healthcheck_path"`
-	StateDir             string                  `yaml:"state_dir"`
+	PollInterval         time.Duration            `yaml:"poll_interval"`
+	PollJitter           time.Duration            `yaml:"poll_jitter"`
+	Metadata             metadata.Config          `yaml:"metadata"`
+	GRPC                 clientconfig.GRPCConfig  `yaml:"grpc"`
+	Logger               loggerhelper.LogConfig   `yaml:"logger"`
+	UpdateRepoScriptPath string                   `yaml:"update_repo_script_path"`
+	Mk8sClusterIdPath    string                   `yaml:"mk8s_cluster_id_path"`
+	HealthCheckPath      string                   `yaml:"healthcheck_path"`
+	StateDir             string                   `yaml:"state_dir"`
+	UpdateVerification   UpdateVerificationConfig `yaml:"update_verification"`
+	MaintenanceWindows   maintenance.Config       `yaml:"maintenance_windows"`
+	RestartLimit         restartlimit.Config      `yaml:"restart_limit"`
+	// ObserveOnly keeps polling and reporting but suspends package installs,
+	// restarts and environment file rewrites. It can also be toggled at
+	// runtime with a pause file in StateDir.
+	ObserveOnly bool `yaml:"observe_only"`
+	// PollBackoffMaxInterval caps the poll interval while the backend is
+	// unreachable: each consecutive failure doubles the interval up to this
+	// value, and the first success resets it. Zero disables the backoff.
+	PollBackoffMaxInterval time.Duration `yaml:"poll_backoff_max_interval"`
+	// ShutdownDrainTimeout is how long shutdown waits for a package install
+	// in progress before aborting it.
+	ShutdownDrainTimeout time.Duration `yaml:"shutdown_drain_timeout"`
+	// UpdateAttempts backs off and eventually quarantines a target version
+	// whose installs keep failing.
+	UpdateAttempts updateattempts.Config `yaml:"update_attempts"`
+	// Policy lists the conditions the node must meet before installs and
+	// restarts, per action.
+	Policy policy.Config `yaml:"policy"`
+	// VersionPolicyPath is the local version policy file that pins agents or
+	// restricts the versions they are updated to. It is re-read before every
+	// install, and without it downgrades are refused.
+	VersionPolicyPath string `yaml:"version_policy_path"`
+}
+
+// UpdateVerificationConfig controls the post-update health check. After an
+// install the updater polls the agent health endpoint every CheckInterval for
+// up to Window; unless the agent reports healthy on HealthyChecks consecutive
+// checks without being restarted by systemd in between, the previous version
+// is reinstalled. A zero Window disables verification.
+type UpdateVerificationConfig struct {
+	Window        time.Duration `yaml:"window"`
+	CheckInterval time.Duration `yaml:"check_interval"`
+	HealthyChecks int           `yaml:"healthy_checks"`
 }
 
 func GetDefaultConfig() *Config {
@@ -42,5 +81,16 @@ func GetDefaultConfig() *Config {
 		Logger: loggerhelper.LogConfig{
 			LogLevel: "INFO",
 		},
+		UpdateVerification: UpdateVerificationConfig{
+			Window:        3 * time.Minute,
+			CheckInterval: 10 * time.Second,
+			HealthyChecks: 3,
+		},
+		RestartLimit:           restartlimit.GetDefaultConfig(),
+		PollBackoffMaxInterval: 15 * time.Minute,
+		ShutdownDrainTimeout:   5 * time.Minute,
+		UpdateAttempts:         updateattempts.GetDefaultConfig(),
+		Policy:                 policy.GetDefaultConfig(),
+		VersionPolicyPath:      "/etc/nebius-observability-agent-updater/version-policy.yaml",
 	}
 }
@@ -17,8 +17,8 @@ func NewDcgmHelper() *Helper {
 	return &Helper{}
 }
 
-func (h *Helper) GetDCGMVersion() (string, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+func (h *Helper) GetDCGMVersion(ctx context.Context) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
 	defer cancel()
 
 	cmd := exec.CommandContext(ctx, "dcgmi", "-v")
@@ -31,8 +31,8 @@ func (h *Helper) GetDCGMVersion() (string, error) {
 	return h.getDCGMHostengineVersion(string(output))
 }
 
-func (h *Helper) GetGpuInfo() (model string, number int, err error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+func (h *Helper) GetGpuInfo(ctx context.Context) (model string, number int, err error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
 	defer cancel()
 
 	cmd := exec.CommandContext(ctx, "dcgmi", "discovery", "-l")
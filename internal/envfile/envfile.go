@@ -0,0 +1,218 @@
+// Package envfile reads and writes files in the format of systemd's
+// EnvironmentFile= (see systemd.exec(5)).
+package envfile
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var validKeyRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// IsValidKey reports whether key is a valid environment variable name.
+func IsValidKey(key string) bool {
+	return validKeyRegexp.MatchString(key)
+}
+
+type state int
+
+const (
+	preKey state = iota
+	inKey
+	preValue
+	inValue
+	valueEscape
+	singleQuoted
+	doubleQuoted
+	doubleQuotedEscape
+	inComment
+	commentEscape
+)
+
+// Parse returns the variables defined by content, interpreted the way systemd
+// loads an EnvironmentFile:
+//   - lines starting with '#' or ';' are comments, blank lines and lines
+//     without '=' are ignored, and a key may be prefixed with "export";
+//   - whitespace around keys and around unquoted values is dropped;
+//   - in unquoted values a backslash escapes the next character and a
+//     trailing backslash continues the value on the next line;
+//   - single quotes preserve everything up to the closing quote;
+//   - in double quotes a backslash escapes only " \ ` $ and newline, and is
+//     kept literally before any other character;
+//   - quoted and unquoted parts of one value are concatenated.
+//
+// Assignments with invalid keys are skipped, and a later assignment of a key
+// overrides an earlier one. Like systemd, Parse accepts an unterminated quote
+// at the end of content.
+func Parse(content string) map[string]string {
+	vars := make(map[string]string)
+	var key, value strings.Builder
+	// valueEnd is the length of value without trailing unquoted whitespace.
+	valueEnd := 0
+	st := preKey
+
+	push := func() {
+		k := strings.TrimRight(key.String(), " \t")
+		if rest, ok := strings.CutPrefix(k, "export"); ok && rest != "" && (rest[0] == ' ' || rest[0] == '\t') {
+			k = strings.TrimLeft(rest, " \t")
+		}
+		if IsValidKey(k) {
+			vars[k] = value.String()[:valueEnd]
+		}
+		key.Reset()
+		value.Reset()
+		valueEnd = 0
+	}
+	appendValue := func(s string) {
+		value.WriteString(s)
+		valueEnd = value.Len()
+	}
+
+	for _, c := range content {
+		switch st {
+		case preKey:
+			switch {
+			case c == '#' || c == ';':
+				st = inComment
+			case isSpace(c) || isNewline(c):
+			default:
+				st = inKey
+				key.WriteRune(c)
+			}
+		case inKey:
+			switch {
+			case isNewline(c):
+				st = preKey
+				key.Reset()
+			case c == '=':
+				st = preValue
+			default:
+				key.WriteRune(c)
+			}
+		case preValue:
+			switch {
+			case isNewline(c):
+				st = preKey
+				push()
+			case c == '\'':
+				st = singleQuoted
+			case c == '"':
+				st = doubleQuoted
+			case c == '\\':
+				st = valueEscape
+			case isSpace(c):
+			default:
+				st = inValue
+				appendValue(string(c))
+			}
+		case inValue:
+			switch {
+			case isNewline(c):
+				st = preKey
+				push()
+			case c == '\\':
+				st = valueEscape
+			case isSpace(c):
+				value.WriteRune(c)
+			default:
+				appendValue(string(c))
+			}
+		case valueEscape:
+			st = inValue
+			if !isNewline(c) {
+				appendValue(string(c))
+			}
+		case singleQuoted:
+			if c == '\'' {
+				st = preValue
+			} else {
+				appendValue(string(c))
+			}
+		case doubleQuoted:
+			switch c {
+			case '"':
+				st = preValue
+			case '\\':
+				st = doubleQuotedEscape
+			default:
+				appendValue(string(c))
+			}
+		case doubleQuotedEscape:
+			st = doubleQuoted
+			switch {
+			case strings.ContainsRune("\"\\`$", c):
+				appendValue(string(c))
+			case isNewline(c):
+			default:
+				appendValue(`\` + string(c))
+			}
+		case inComment:
+			switch {
+			case c == '\\':
+				st = commentEscape
+			case isNewline(c):
+				st = preKey
+			}
+		case commentEscape:
+			st = inComment
+		}
+	}
+	switch st {
+	case preValue, inValue, valueEscape, singleQuoted, doubleQuoted, doubleQuotedEscape:
+		push()
+	}
+	return vars
+}
+
+func isSpace(c rune) bool {
+	return c == ' ' || c == '\t'
+}
+
+func isNewline(c rune) bool {
+	return c == '\n' || c == '\r'
+}
+
+// Format returns vars as KEY=VALUE lines sorted by key, quoting values where
+// needed so that Parse returns exactly vars.
+func Format(vars map[string]string) string {
+	keys := make([]string, 0, len(vars))
+	for k := range vars {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var sb strings.Builder
+	for _, k := range keys {
+		sb.WriteString(k)
+		sb.WriteByte('=')
+		sb.WriteString(Quote(vars[k]))
+		sb.WriteByte('\n')
+	}
+	return sb.String()
+}
+
+// Quote returns v as it should appear after '=' in an environment file.
+// Values that would not read back unchanged unquoted are double-quoted with
+// backslashes and double quotes escaped; values that a reader might take for
+// shell syntax (spaces, quotes, '$', '`') are quoted too, for clarity.
+func Quote(v string) string {
+	if !needsQuoting(v) {
+		return v
+	}
+	return `"` + strings.ReplaceAll(strings.ReplaceAll(v, `\`, `\\`), `"`, `\"`) + `"`
+}
+
+// needsQuoting returns true if v cannot be written unquoted: it has leading or
+// trailing whitespace (dropped), a backslash (an escape), a leading quote (a
+// quoted value) or a line break (the end of the assignment). Spaces, quotes,
+// '$' and '`' elsewhere are literal to systemd but are quoted as well.
+func needsQuoting(v string) bool {
+	if v == "" {
+		return false
+	}
+	if isSpace(rune(v[0])) || isSpace(rune(v[len(v)-1])) {
+		return true
+	}
+	return strings.ContainsAny(v, " \"'`\\$\n\r")
+}
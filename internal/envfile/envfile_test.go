@@ -0,0 +1,91 @@
+package envfile
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected map[string]string
+	}{
+		{"empty", "", map[string]string{}},
+		{"comments and blank lines", "# header\n\n; other comment\n  # indented\n", map[string]string{}},
+		{"simple", "A=1\nB=two\n", map[string]string{"A": "1", "B": "two"}},
+		{"no trailing newline", "A=1", map[string]string{"A": "1"}},
+		{"empty value", "A=\n", map[string]string{"A": ""}},
+		{"line without equals is ignored", "garbage\nA=1\n", map[string]string{"A": "1"}},
+		{"whitespace around key and value", "  A  =   spaced value  \n", map[string]string{"A": "spaced value"}},
+		{"hash inside value is literal", "A=val#ue\n", map[string]string{"A": "val#ue"}},
+		{"export prefix", "export A=1\nexport\tB=2\n", map[string]string{"A": "1", "B": "2"}},
+		{"key named export", "export=1\n", map[string]string{"export": "1"}},
+		{"invalid key skipped", "1A=x\nA-B=y\nC=z\n", map[string]string{"C": "z"}},
+		{"later assignment wins", "A=1\nA=2\n", map[string]string{"A": "2"}},
+		{"single quotes are literal", `A='a \"b\" $c \d'` + "\n", map[string]string{"A": `a \"b\" $c \d`}},
+		{"single quotes keep newlines", "A='line1\nline2'\n", map[string]string{"A": "line1\nline2"}},
+		{"double quote escapes", `A="q\" b\\ d\$ t\` + "`" + ` x\y"` + "\n", map[string]string{"A": `q" b\ d$ t` + "`" + ` x\y`}},
+		{"double quotes keep surrounding whitespace", `A="  padded  "` + "\n", map[string]string{"A": "  padded  "}},
+		{"double-quoted line continuation", "A=\"one \\\ntwo\"\n", map[string]string{"A": "one two"}},
+		{"unquoted escape", `A=a\ \$b\\c` + "\n", map[string]string{"A": `a $b\c`}},
+		{"unquoted line continuation", "A=one\\\ntwo\nB=3\n", map[string]string{"A": "onetwo", "B": "3"}},
+		{"comment continuation", "# comment \\\nA=hidden\nB=1\n", map[string]string{"B": "1"}},
+		{"concatenated parts", `A="x"'y'z` + "\n", map[string]string{"A": "xyz"}},
+		{"quote inside unquoted value is literal", `A=it's` + "\n", map[string]string{"A": "it's"}},
+		{"unterminated quote at end", `A="open`, map[string]string{"A": "open"}},
+		{"crlf line endings", "A=1\r\nB=2\r\n", map[string]string{"A": "1", "B": "2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, Parse(tt.input))
+		})
+	}
+}
+
+func TestQuote(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected string
+	}{
+		{"", ""},
+		{"simple", "simple"},
+		{"a=b,c:d", "a=b,c:d"},
+		{"hello world", `"hello world"`},
+		{" leading", `" leading"`},
+		{"trailing\t", "\"trailing\t\""},
+		{`say "hi"`, `"say \"hi\""`},
+		{`a\b`, `"a\\b"`},
+		{"'quoted'", `"'quoted'"`},
+		{"$HOME", `"$HOME"`},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, Quote(tt.value), "value %q", tt.value)
+	}
+}
+
+func TestFormatRoundTrip(t *testing.T) {
+	vars := map[string]string{
+		"EMPTY":     "",
+		"PLAIN":     "value",
+		"SPACES":    "  hello  world  ",
+		"QUOTES":    `single ' double " mixed`,
+		"LEADING_Q": `"starts with a quote`,
+		"BACKSLASH": `C:\path\ends\`,
+		"ESCAPES":   `\" \\ \$ \n`,
+		"SHELL":     "$VAR `cmd` ${X}",
+		"HASH":      "# not a comment",
+		"SEMICOLON": "; not a comment either",
+		"NEWLINE":   "line1\nline2\r\n",
+		"UNICODE":   "zürich ✓",
+	}
+	formatted := Format(vars)
+	assert.Equal(t, vars, Parse(formatted))
+	assert.Equal(t, formatted, Format(Parse(formatted)), "formatting is stable")
+}
+
+func TestFormatSortsKeys(t *testing.T) {
+	assert.Equal(t, "A=1\nB=2\nC=3\n", Format(map[string]string{"C": "3", "A": "1", "B": "2"}))
+	assert.Equal(t, "", Format(nil))
+}
@@ -0,0 +1,146 @@
+package journal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/nebius/nebius-observability-agent-updater/internal/osutils"
+)
+
+const (
+	ActionInstall   = "install"
+	ActionRollback  = "rollback"
+	ActionRestart   = "restart"
+	ActionEnvWrite  = "env_write"
+	ActionConfigAck = "config_ack"
+
+	TriggerServerAction = "server_action"
+	TriggerFeatureFlags = "feature_flags"
+	TriggerVerification = "update_verification"
+
+	OutcomeOK     = "ok"
+	OutcomeFailed = "failed"
+)
+
+const (
+	fileName   = "actions.jsonl"
+	maxBackups = 3
+)
+
+// maxFileSize is the size at which the active file is rotated; maxBackups
+// rotated files are kept, so the journal never exceeds roughly
+// (maxBackups+1)*maxFileSize on disk. Declared as var so tests can shrink it.
+var maxFileSize int64 = 1 << 20
+
+// ioTimeout bounds a single append (including rotation) so an unresponsive
+// disk cannot hang the poll loop.
+const ioTimeout = 5 * time.Second
+
+// Entry is one mutating action taken by the updater.
+type Entry struct {
+	Time       time.Time         `json:"time"`
+	Agent      string            `json:"agent"`
+	Action     string            `json:"action"`
+	Trigger    string            `json:"trigger"`
+	Input      map[string]string `json:"input,omitempty"`
+	DurationMs int64             `json:"duration_ms"`
+	Outcome    string            `json:"outcome"`
+	Error      string            `json:"error,omitempty"`
+}
+
+// Journal appends entries as JSON lines to a size-rotated file in the state
+// directory, so the history of what the updater did survives journald
+// rotation and updater restarts. A nil *Journal discards entries.
+type Journal struct {
+	path      string
+	logger    *slog.Logger
+	fileGuard *osutils.FileGuard
+
+	mu sync.Mutex
+}
+
+// New returns a journal in stateDir, or nil (journaling disabled) if stateDir
+// is empty.
+func New(stateDir string, logger *slog.Logger, fileGuard *osutils.FileGuard) *Journal {
+	if stateDir == "" {
+		return nil
+	}
+	return &Journal{
+		path:      filepath.Join(stateDir, fileName),
+		logger:    logger,
+		fileGuard: fileGuard,
+	}
+}
+
+// Record appends an entry that started at start and finished now. A nil err
+// is recorded as success. Write failures are logged, never returned: losing a
+// journal line must not fail the action it describes.
+func (j *Journal) Record(agent, action, trigger string, input map[string]string, start time.Time, err error) {
+	if j == nil {
+		return
+	}
+	e := Entry{
+		Time:       start,
+		Agent:      agent,
+		Action:     action,
+		Trigger:    trigger,
+		Input:      input,
+		DurationMs: time.Since(start).Milliseconds(),
+		Outcome:    OutcomeOK,
+	}
+	if err != nil {
+		e.Outcome = OutcomeFailed
+		e.Error = err.Error()
+	}
+	line, mErr := json.Marshal(e)
+	if mErr != nil {
+		j.logger.Warn("failed to encode action journal entry", "error", mErr)
+		return
+	}
+	line = append(line, '\n')
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if wErr := j.fileGuard.Run(j.path, ioTimeout, func() error { return j.append(line) }); wErr != nil {
+		j.logger.Warn("failed to write action journal entry", "error", wErr, "path", j.path)
+	}
+}
+
+func (j *Journal) append(line []byte) error {
+	if info, err := os.Stat(j.path); err == nil && info.Size()+int64(len(line)) > maxFileSize {
+		if err := j.rotate(); err != nil {
+			return fmt.Errorf("failed to rotate journal: %w", err)
+		}
+	}
+	f, err := os.OpenFile(j.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(line); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// rotate shifts actions.jsonl.N to .N+1, dropping the oldest, and moves the
+// active file to .1.
+func (j *Journal) rotate() error {
+	for i := maxBackups - 1; i >= 1; i-- {
+		err := os.Rename(j.backupPath(i), j.backupPath(i+1))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return os.Rename(j.path, j.backupPath(1))
+}
+
+func (j *Journal) backupPath(n int) string {
+	return fmt.Sprintf("%s.%d", j.path, n)
+}
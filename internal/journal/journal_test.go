@@ -0,0 +1,94 @@
+package journal
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nebius/nebius-observability-agent-updater/internal/osutils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestJournal(t *testing.T) *Journal {
+	t.Helper()
+	return New(t.TempDir(), slog.New(slog.NewTextHandler(io.Discard, nil)), osutils.NewFileGuard(osutils.DefaultMaxPendingFileOps))
+}
+
+func readEntries(t *testing.T, path string) []Entry {
+	t.Helper()
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	var entries []Entry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e Entry
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &e))
+		entries = append(entries, e)
+	}
+	require.NoError(t, scanner.Err())
+	return entries
+}
+
+func TestRecord_AppendsStructuredEntries(t *testing.T) {
+	j := newTestJournal(t)
+	start := time.Now().Add(-2 * time.Second)
+
+	j.Record("agent", ActionInstall, TriggerServerAction, map[string]string{"target_version": "1.2.3"}, start, nil)
+	j.Record("agent", ActionRestart, TriggerFeatureFlags, nil, start, errors.New("boom"))
+
+	entries := readEntries(t, j.path)
+	require.Len(t, entries, 2)
+
+	assert.Equal(t, "agent", entries[0].Agent)
+	assert.Equal(t, ActionInstall, entries[0].Action)
+	assert.Equal(t, TriggerServerAction, entries[0].Trigger)
+	assert.Equal(t, "1.2.3", entries[0].Input["target_version"])
+	assert.Equal(t, OutcomeOK, entries[0].Outcome)
+	assert.GreaterOrEqual(t, entries[0].DurationMs, int64(2000))
+
+	assert.Equal(t, OutcomeFailed, entries[1].Outcome)
+	assert.Equal(t, "boom", entries[1].Error)
+}
+
+func TestRecord_Rotates(t *testing.T) {
+	prev := maxFileSize
+	maxFileSize = 300
+	t.Cleanup(func() { maxFileSize = prev })
+
+	j := newTestJournal(t)
+	for i := 0; i < 20; i++ {
+		j.Record("agent", ActionRestart, TriggerServerAction, nil, time.Now(), nil)
+	}
+
+	for n := 1; n <= maxBackups; n++ {
+		_, err := os.Stat(j.backupPath(n))
+		assert.NoError(t, err, "backup %d should exist", n)
+	}
+	_, err := os.Stat(j.backupPath(maxBackups + 1))
+	assert.True(t, os.IsNotExist(err), "only %d backups are kept", maxBackups)
+
+	info, err := os.Stat(j.path)
+	require.NoError(t, err)
+	assert.LessOrEqual(t, info.Size(), maxFileSize)
+}
+
+func TestNilJournalDiscards(t *testing.T) {
+	j := New("", nil, nil)
+	assert.Nil(t, j)
+	j.Record("agent", ActionRestart, TriggerServerAction, nil, time.Now(), nil)
+}
+
+func TestRecord_UnwritableDirIsLoggedNotFatal(t *testing.T) {
+	j := New(filepath.Join(t.TempDir(), "missing"), slog.New(slog.NewTextHandler(io.Discard, nil)), osutils.NewFileGuard(osutils.DefaultMaxPendingFileOps))
+	j.Record("agent", ActionRestart, TriggerServerAction, nil, time.Now(), nil)
+	_, err := os.Stat(j.path)
+	assert.True(t, os.IsNotExist(err))
+}
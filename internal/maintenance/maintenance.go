@@ -0,0 +1,139 @@
+package maintenance
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config lists the windows in which mutating actions (package update, agent
+// restart) are allowed. With no windows configured actions are always allowed.
+type Config struct {
+	Timezone Location `yaml:"timezone"`
+	Windows  []Window `yaml:"windows"`
+}
+
+// Window is a daily time range on the listed weekdays. An empty Days list
+// means every day. If End is not after Start the window wraps past midnight
+// into the following day, e.g. sat 22:00-02:00 ends on Sunday at 02:00.
+type Window struct {
+	Days  []Weekday `yaml:"days"`
+	Start TimeOfDay `yaml:"start"`
+	End   TimeOfDay `yaml:"end"`
+}
+
+// IsOpen reports whether t falls inside any configured window.
+func (c Config) IsOpen(t time.Time) bool {
+	if len(c.Windows) == 0 {
+		return true
+	}
+	local := t.In(c.Timezone.location())
+	for _, w := range c.Windows {
+		if w.contains(local) {
+			return true
+		}
+	}
+	return false
+}
+
+func (w Window) contains(t time.Time) bool {
+	minute := TimeOfDay(t.Hour()*60 + t.Minute())
+	today := t.Weekday()
+	yesterday := (today + 6) % 7
+	if w.End > w.Start {
+		return w.onDay(today) && minute >= w.Start && minute < w.End
+	}
+	// Wrapping window: the part after Start belongs to today's window, the
+	// part before End to yesterday's.
+	return (w.onDay(today) && minute >= w.Start) || (w.onDay(yesterday) && minute < w.End)
+}
+
+func (w Window) onDay(day time.Weekday) bool {
+	if len(w.Days) == 0 {
+		return true
+	}
+	for _, d := range w.Days {
+		if time.Weekday(d) == day {
+			return true
+		}
+	}
+	return false
+}
+
+// Location is a time zone name loaded with time.LoadLocation. The zero value
+// is UTC.
+type Location struct {
+	loc *time.Location
+}
+
+func (l Location) location() *time.Location {
+	if l.loc == nil {
+		return time.UTC
+	}
+	return l.loc
+}
+
+func (l *Location) UnmarshalYAML(value *yaml.Node) error {
+	var name string
+	if err := value.Decode(&name); err != nil {
+		return err
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return fmt.Errorf("invalid timezone %q: %w", name, err)
+	}
+	l.loc = loc
+	return nil
+}
+
+// Weekday accepts full or three-letter English day names, case-insensitive.
+type Weekday time.Weekday
+
+func (d *Weekday) UnmarshalYAML(value *yaml.Node) error {
+	var name string
+	if err := value.Decode(&name); err != nil {
+		return err
+	}
+	lower := strings.ToLower(strings.TrimSpace(name))
+	for day := time.Sunday; day <= time.Saturday; day++ {
+		full := strings.ToLower(day.String())
+		if lower == full || lower == full[:3] {
+			*d = Weekday(day)
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid weekday %q", name)
+}
+
+// TimeOfDay is minutes since midnight, written as "HH:MM". "24:00" is
+// accepted as the end of the day.
+type TimeOfDay int
+
+func (t *TimeOfDay) UnmarshalYAML(value *yaml.Node) error {
+	var s string
+	if err := value.Decode(&s); err != nil {
+		return err
+	}
+	parsed, err := ParseTimeOfDay(s)
+	if err != nil {
+		return err
+	}
+	*t = parsed
+	return nil
+}
+
+func ParseTimeOfDay(s string) (TimeOfDay, error) {
+	var hour, minute int
+	if _, err := fmt.Sscanf(s, "%d:%d", &hour, &minute); err != nil {
+		return 0, fmt.Errorf("invalid time of day %q, expected HH:MM: %w", s, err)
+	}
+	if hour == 24 && minute == 0 {
+		return 24 * 60, nil
+	}
+	if hour < 0 || hour > 23 || minute < 0 || minute > 59 {
+		return 0, fmt.Errorf("invalid time of day %q", s)
+	}
+	return TimeOfDay(hour*60 + minute), nil
+}
@@ -0,0 +1,85 @@
+package maintenance
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func mustParse(t *testing.T, doc string) Config {
+	t.Helper()
+	var cfg Config
+	require.NoError(t, yaml.Unmarshal([]byte(doc), &cfg))
+	return cfg
+}
+
+func TestIsOpen_NoWindowsAlwaysOpen(t *testing.T) {
+	assert.True(t, Config{}.IsOpen(time.Now()))
+}
+
+func TestIsOpen(t *testing.T) {
+	cfg := mustParse(t, `
+timezone: Europe/Amsterdam
+windows:
+  - days: [sat, Sunday]
+    start: "01:00"
+    end: "05:00"
+  - days: [fri]
+    start: "22:00"
+    end: "02:00"
+`)
+	ams, err := time.LoadLocation("Europe/Amsterdam")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		at       time.Time
+		expected bool
+	}{
+		// 2026-10-17 is a Saturday.
+		{"inside saturday window", time.Date(2026, 10, 17, 3, 0, 0, 0, ams), true},
+		{"window start is inclusive", time.Date(2026, 10, 17, 1, 0, 0, 0, ams), true},
+		{"window end is exclusive", time.Date(2026, 10, 17, 5, 0, 0, 0, ams), false},
+		{"weekday outside windows", time.Date(2026, 10, 14, 3, 0, 0, 0, ams), false},
+		{"friday wrap before midnight", time.Date(2026, 10, 16, 23, 30, 0, 0, ams), true},
+		{"friday wrap after midnight on saturday", time.Date(2026, 10, 17, 0, 30, 0, 0, ams), true},
+		{"thursday night is not covered by friday wrap", time.Date(2026, 10, 16, 0, 30, 0, 0, ams), false},
+		{"evaluated in configured timezone", time.Date(2026, 10, 17, 4, 0, 0, 0, time.UTC), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, cfg.IsOpen(tt.at))
+		})
+	}
+}
+
+func TestIsOpen_EmptyDaysMeansEveryDayInUTC(t *testing.T) {
+	cfg := mustParse(t, `
+windows:
+  - start: "09:00"
+    end: "24:00"
+`)
+	assert.True(t, cfg.IsOpen(time.Date(2026, 10, 14, 23, 59, 0, 0, time.UTC)))
+	assert.False(t, cfg.IsOpen(time.Date(2026, 10, 14, 8, 59, 0, 0, time.UTC)))
+}
+
+func TestUnmarshal_InvalidValues(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  string
+	}{
+		{"bad timezone", "timezone: Mars/Olympus\n"},
+		{"bad weekday", "windows:\n  - days: [someday]\n    start: \"01:00\"\n    end: \"02:00\"\n"},
+		{"bad time", "windows:\n  - start: \"25:00\"\n    end: \"02:00\"\n"},
+		{"malformed time", "windows:\n  - start: \"noon\"\n    end: \"02:00\"\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg Config
+			assert.Error(t, yaml.Unmarshal([]byte(tt.doc), &cfg))
+		})
+	}
+}
@@ -3,6 +3,7 @@ package metadata
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
@@ -75,9 +76,9 @@ func NewReader(cfg Config, logger *slog.Logger) *Reader {
 	}
 }
 
-func (r *Reader) GetParentId() (string, error) {
+func (r *Reader) GetParentId(ctx context.Context) (string, error) {
 	if r.cfg.UseMetadataService {
-		data, err := r.getInstanceData()
+		data, err := r.getInstanceData(ctx)
 		if err == nil {
 			return data.ParentID, nil
 		}
@@ -86,9 +87,9 @@ func (r *Reader) GetParentId() (string, error) {
 	return r.readAndTrimFile(r.cfg.Path + "/" + r.cfg.ParentIdFilename)
 }
 
-func (r *Reader) GetInstanceId() (instanceId string, isFallback bool, err error) {
+func (r *Reader) GetInstanceId(ctx context.Context) (instanceId string, isFallback bool, err error) {
 	if r.cfg.UseMetadataService {
-		data, imdsErr := r.getInstanceData()
+		data, imdsErr := r.getInstanceData(ctx)
 		if imdsErr == nil {
 			return data.ID, false, nil
 		}
@@ -107,9 +108,9 @@ func (r *Reader) GetInstanceId() (instanceId string, isFallback bool, err error)
 	return instanceId, false, nil
 }
 
-func (r *Reader) GetIamToken() (string, error) {
+func (r *Reader) GetIamToken(ctx context.Context) (string, error) {
 	if r.cfg.UseMetadataService {
-		token, err := r.getCachedIAMToken()
+		token, err := r.getCachedIAMToken(ctx)
 		if err == nil {
 			return token, nil
 		}
@@ -118,7 +119,31 @@ func (r *Reader) GetIamToken() (string, error) {
 	return r.readAndTrimFile(r.cfg.Path + "/" + r.cfg.IamTokenFilename)
 }
 
-func (r *Reader) getCachedIAMToken() (string, error) {
+// endpointOverridePath is the instance-data key that points a node at a
+// different updater backend.
+const endpointOverridePath = "/v1/instance-data/o11y/updater-endpoint-override"
+
+// errNotFound is returned by doMetadataRequest for a key that is not set.
+var errNotFound = errors.New("not found")
+
+// GetEndpointOverride returns the updater backend endpoint set for this
+// instance in IMDS, or "" if none is set or the metadata service is disabled.
+// An error means the override could not be read, not that it is unset.
+func (r *Reader) GetEndpointOverride(ctx context.Context) (string, error) {
+	if !r.cfg.UseMetadataService {
+		return "", nil
+	}
+	body, err := r.fetchFromMetadataService(ctx, endpointOverridePath)
+	if errors.Is(err, errNotFound) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch endpoint override from IMDS: %w", err)
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+func (r *Reader) getCachedIAMToken(ctx context.Context) (string, error) {
 	r.tokenMu.Lock()
 	defer r.tokenMu.Unlock()
 
@@ -127,7 +152,7 @@ func (r *Reader) getCachedIAMToken() (string, error) {
 	}
 
 	tokenPath := fmt.Sprintf("/v1/iam/%s/token/access_token", r.cfg.MetadataTokenType)
-	body, err := r.fetchFromMetadataService(tokenPath)
+	body, err := r.fetchFromMetadataService(ctx, tokenPath)
 	if err != nil {
 		if r.cachedIAM != nil && time.Until(r.cachedIAM.expiresAt) > 0 {
 			r.logger.Warn("Failed to refresh IAM token, using cached token until expiry", "error", err, "expires_at", r.cachedIAM.expiresAt)
@@ -137,7 +162,7 @@ func (r *Reader) getCachedIAMToken() (string, error) {
 	}
 	token := strings.TrimSpace(string(body))
 
-	expiresAt, err := r.fetchTokenExpiresAt()
+	expiresAt, err := r.fetchTokenExpiresAt(ctx)
 	if err != nil {
 		r.logger.Warn("Failed to get token expiry from IMDS, using default TTL", "error", err)
 		expiresAt = time.Now().Add(instanceDataCacheTTL)
@@ -154,9 +179,9 @@ func (r *Reader) getCachedIAMToken() (string, error) {
 	return token, nil
 }
 
-func (r *Reader) fetchTokenExpiresAt() (time.Time, error) {
+func (r *Reader) fetchTokenExpiresAt(ctx context.Context) (time.Time, error) {
 	expiresAtPath := fmt.Sprintf("/v1/iam/%s/token/expires_at", r.cfg.MetadataTokenType)
-	body, err := r.fetchFromMetadataService(expiresAtPath)
+	body, err := r.fetchFromMetadataService(ctx, expiresAtPath)
 	if err != nil {
 		return time.Time{}, fmt.Errorf("failed to fetch token expires_at: %w", err)
 	}
@@ -167,7 +192,7 @@ func (r *Reader) fetchTokenExpiresAt() (time.Time, error) {
 	return expiresAt, nil
 }
 
-func (r *Reader) getInstanceData() (*instanceData, error) {
+func (r *Reader) getInstanceData(ctx context.Context) (*instanceData, error) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
@@ -175,7 +200,7 @@ func (r *Reader) getInstanceData() (*instanceData, error) {
 		return r.cachedInstance, nil
 	}
 
-	body, err := r.fetchFromMetadataService("/v1/instance-data")
+	body, err := r.fetchFromMetadataService(ctx, "/v1/instance-data")
 	if err != nil {
 		if r.cachedInstance != nil {
 			r.logger.Warn("Failed to refresh instance-data from IMDS, using stale cache", "error", err)
@@ -198,22 +223,34 @@ func (r *Reader) getInstanceData() (*instanceData, error) {
 	return r.cachedInstance, nil
 }
 
-func (r *Reader) fetchFromMetadataService(path string) ([]byte, error) {
+// fetchFromMetadataService tries each metadata service URL in turn. If none
+// returns path but one of them answered that it is not set, the error wraps
+// errNotFound.
+func (r *Reader) fetchFromMetadataService(ctx context.Context, path string) ([]byte, error) {
 	urls := []string{r.cfg.MetadataServiceURL, r.cfg.MetadataServiceFallbackURL}
-	var lastErr error
+	var lastErr, notFound error
 	for _, baseURL := range urls {
-		body, err := r.doMetadataRequest(baseURL + path)
+		body, err := r.doMetadataRequest(ctx, baseURL+path)
 		if err == nil {
 			return body, nil
 		}
 		lastErr = err
+		if errors.Is(err, errNotFound) {
+			notFound = err
+		}
 		r.logger.Debug("IMDS request failed", "url", baseURL+path, "error", err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if notFound != nil {
+		lastErr = notFound
 	}
 	return nil, fmt.Errorf("all IMDS URLs failed: %w", lastErr)
 }
 
-func (r *Reader) doMetadataRequest(url string) ([]byte, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+func (r *Reader) doMetadataRequest(ctx context.Context, url string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
@@ -228,6 +265,9 @@ func (r *Reader) doMetadataRequest(url string) ([]byte, error) {
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errNotFound
+	}
 	if resp.StatusCode != http.StatusOK {
 		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
 	}
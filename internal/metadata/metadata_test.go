@@ -1,6 +1,7 @@
 package metadata
 
 import (
+	"context"
 	"fmt"
 	"log/slog"
 	"net/http"
@@ -49,7 +50,7 @@ func TestGetParentId_IMDS(t *testing.T) {
 		MetadataServiceFallbackURL: server.URL,
 	}, testLogger())
 
-	parentId, err := reader.GetParentId()
+	parentId, err := reader.GetParentId(context.Background())
 	require.NoError(t, err)
 	assert.Equal(t, "parent-456", parentId)
 }
@@ -78,7 +79,7 @@ func TestGetInstanceId_FromIMDS(t *testing.T) {
 	}, testLogger())
 
 	// IMDS is primary when UseMetadataService is true; the file must not be touched.
-	instanceId, isFallback, err := reader.GetInstanceId()
+	instanceId, isFallback, err := reader.GetInstanceId(context.Background())
 	require.NoError(t, err)
 	assert.Equal(t, "inst-from-imds", instanceId)
 	assert.False(t, isFallback)
@@ -97,7 +98,7 @@ func TestGetInstanceId_FileFallback_WhenIMDSFails(t *testing.T) {
 		InstanceIdFilename:         instanceIDFile,
 	}, testLogger())
 
-	instanceId, isFallback, err := reader.GetInstanceId()
+	instanceId, isFallback, err := reader.GetInstanceId(context.Background())
 	require.NoError(t, err)
 	assert.Equal(t, "inst-from-file", instanceId)
 	assert.True(t, isFallback)
@@ -123,12 +124,42 @@ func TestGetInstanceId_IMDSFallbackURL(t *testing.T) {
 		InstanceIdFilename:         instanceIDFile,
 	}, testLogger())
 
-	instanceId, isFallback, err := reader.GetInstanceId()
+	instanceId, isFallback, err := reader.GetInstanceId(context.Background())
 	require.NoError(t, err)
 	assert.Equal(t, "inst-fallback", instanceId)
 	assert.False(t, isFallback)
 }
 
+func TestGetInstanceId_CancelledContextSkipsFallbackURL(t *testing.T) {
+	var hits atomic.Int32
+	fallbackServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		_, err := w.Write([]byte(`{"id": "inst-fallback", "parent_id": "parent-fallback"}`))
+		assert.NoError(t, err)
+	}))
+	defer fallbackServer.Close()
+
+	tmpDir := t.TempDir()
+	err := os.WriteFile(filepath.Join(tmpDir, instanceIDFile), []byte("inst-from-file\n"), 0644)
+	require.NoError(t, err)
+
+	reader := NewReader(Config{
+		UseMetadataService:         true,
+		MetadataServiceURL:         unreachableURL,
+		MetadataServiceFallbackURL: fallbackServer.URL,
+		Path:                       tmpDir,
+		InstanceIdFilename:         instanceIDFile,
+	}, testLogger())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	instanceId, isFallback, err := reader.GetInstanceId(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "inst-from-file", instanceId)
+	assert.True(t, isFallback)
+	assert.Zero(t, hits.Load(), "a cancelled call must not move on to the fallback URL")
+}
+
 func TestGetIamToken_IMDS(t *testing.T) {
 	expiresAt := time.Now().Add(12 * time.Hour).UTC().Format(time.RFC3339Nano)
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -153,7 +184,7 @@ func TestGetIamToken_IMDS(t *testing.T) {
 		MetadataTokenType:          tsaTokenType,
 	}, testLogger())
 
-	token, err := reader.GetIamToken()
+	token, err := reader.GetIamToken(context.Background())
 	require.NoError(t, err)
 	assert.Equal(t, "my-iam-token", token)
 }
@@ -184,12 +215,12 @@ func TestGetIamToken_Cached(t *testing.T) {
 	}, testLogger())
 
 	// First call fetches from IMDS
-	token, err := reader.GetIamToken()
+	token, err := reader.GetIamToken(context.Background())
 	require.NoError(t, err)
 	assert.Equal(t, "my-iam-token", token)
 
 	// Second call should use cache
-	token, err = reader.GetIamToken()
+	token, err = reader.GetIamToken(context.Background())
 	require.NoError(t, err)
 	assert.Equal(t, "my-iam-token", token)
 
@@ -222,7 +253,7 @@ func TestGetIamToken_RefreshesWhenNearExpiry(t *testing.T) {
 	}, testLogger())
 
 	// First fetch
-	token, err := reader.GetIamToken()
+	token, err := reader.GetIamToken(context.Background())
 	require.NoError(t, err)
 	assert.Equal(t, "token-1", token)
 	assert.Equal(t, 1, tokenCallCount)
@@ -233,7 +264,7 @@ func TestGetIamToken_RefreshesWhenNearExpiry(t *testing.T) {
 	reader.tokenMu.Unlock()
 
 	// Should re-fetch
-	token, err = reader.GetIamToken()
+	token, err = reader.GetIamToken(context.Background())
 	require.NoError(t, err)
 	assert.Equal(t, "token-2", token)
 	assert.Equal(t, 2, tokenCallCount)
@@ -269,7 +300,7 @@ func TestGetIamToken_UsesStaleTokenOnRefreshFailure(t *testing.T) {
 	}, testLogger())
 
 	// First fetch succeeds
-	token, err := reader.GetIamToken()
+	token, err := reader.GetIamToken(context.Background())
 	require.NoError(t, err)
 	assert.Equal(t, "original-token", token)
 
@@ -279,7 +310,7 @@ func TestGetIamToken_UsesStaleTokenOnRefreshFailure(t *testing.T) {
 	reader.tokenMu.Unlock()
 
 	// Refresh fails — should return stale token since it hasn't expired yet
-	token, err = reader.GetIamToken()
+	token, err = reader.GetIamToken(context.Background())
 	require.NoError(t, err)
 	assert.Equal(t, "original-token", token)
 }
@@ -314,7 +345,7 @@ func TestGetIamToken_AlreadyExpired(t *testing.T) {
 	}, testLogger())
 
 	// Token from IMDS is expired — should error from getCachedIAMToken and fall back to file
-	token, err := reader.GetIamToken()
+	token, err := reader.GetIamToken(context.Background())
 	require.NoError(t, err)
 	assert.Equal(t, "file-token", token)
 
@@ -338,7 +369,7 @@ func TestGetIamToken_FileFallback(t *testing.T) {
 		MetadataTokenType:          tsaTokenType,
 	}, testLogger())
 
-	token, err := reader.GetIamToken()
+	token, err := reader.GetIamToken(context.Background())
 	require.NoError(t, err)
 	assert.Equal(t, "file-token", token)
 }
@@ -363,11 +394,11 @@ func TestGetInstanceData_Cached(t *testing.T) {
 	}, testLogger())
 
 	// Call GetParentId twice - should only hit the server once
-	parentId, err := reader.GetParentId()
+	parentId, err := reader.GetParentId(context.Background())
 	require.NoError(t, err)
 	assert.Equal(t, "parent-456", parentId)
 
-	parentId, err = reader.GetParentId()
+	parentId, err = reader.GetParentId(context.Background())
 	require.NoError(t, err)
 	assert.Equal(t, "parent-456", parentId)
 
@@ -394,7 +425,7 @@ func TestGetInstanceData_RefreshesAfterTTL(t *testing.T) {
 	}, testLogger())
 
 	// First fetch
-	parentId, err := reader.GetParentId()
+	parentId, err := reader.GetParentId(context.Background())
 	require.NoError(t, err)
 	assert.Equal(t, "parent-1", parentId)
 	assert.Equal(t, 1, callCount)
@@ -405,7 +436,7 @@ func TestGetInstanceData_RefreshesAfterTTL(t *testing.T) {
 	reader.mu.Unlock()
 
 	// Should re-fetch
-	parentId, err = reader.GetParentId()
+	parentId, err = reader.GetParentId(context.Background())
 	require.NoError(t, err)
 	assert.Equal(t, "parent-2", parentId)
 	assert.Equal(t, 2, callCount)
@@ -435,7 +466,7 @@ func TestGetInstanceData_StaleCache_OnRefreshFailure(t *testing.T) {
 	}, testLogger())
 
 	// First fetch succeeds
-	parentId, err := reader.GetParentId()
+	parentId, err := reader.GetParentId(context.Background())
 	require.NoError(t, err)
 	assert.Equal(t, "parent-original", parentId)
 
@@ -445,7 +476,7 @@ func TestGetInstanceData_StaleCache_OnRefreshFailure(t *testing.T) {
 	reader.mu.Unlock()
 
 	// Refresh fails — should return stale cached data
-	parentId, err = reader.GetParentId()
+	parentId, err = reader.GetParentId(context.Background())
 	require.NoError(t, err)
 	assert.Equal(t, "parent-original", parentId)
 }
@@ -461,7 +492,7 @@ func TestGetInstanceId_MetadataServiceDisabled(t *testing.T) {
 		InstanceIdFilename: instanceIDFile,
 	}, testLogger())
 
-	instanceId, isFallback, err := reader.GetInstanceId()
+	instanceId, isFallback, err := reader.GetInstanceId(context.Background())
 	require.NoError(t, err)
 	assert.Equal(t, "inst-from-file", instanceId)
 	assert.False(t, isFallback)
@@ -485,11 +516,95 @@ func TestIMDS_ServerError(t *testing.T) {
 		ParentIdFilename:           "parent-id",
 	}, testLogger())
 
-	parentId, err := reader.GetParentId()
+	parentId, err := reader.GetParentId(context.Background())
 	require.NoError(t, err)
 	assert.Equal(t, "parent-from-file", parentId)
 }
 
+func TestGetEndpointOverride(t *testing.T) {
+	const overridePath = "/v1/instance-data/o11y/updater-endpoint-override"
+	tests := []struct {
+		name     string
+		primary  http.HandlerFunc
+		fallback http.HandlerFunc
+		expected string
+		wantErr  bool
+	}{
+		{
+			name: "set",
+			primary: func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, overridePath, r.URL.Path)
+				_, _ = w.Write([]byte("backend.example:443\n"))
+			},
+			expected: "backend.example:443",
+		},
+		{
+			name:     "unset",
+			primary:  http.NotFound,
+			fallback: http.NotFound,
+			expected: "",
+		},
+		{
+			name:     "unset on primary, fallback unavailable",
+			primary:  http.NotFound,
+			fallback: func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusInternalServerError) },
+			expected: "",
+		},
+		{
+			name:     "unset on primary, fallback unreachable",
+			primary:  http.NotFound,
+			expected: "",
+		},
+		{
+			name:     "primary unavailable, unset on fallback",
+			primary:  func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusInternalServerError) },
+			fallback: http.NotFound,
+			expected: "",
+		},
+		{
+			name:     "from fallback URL",
+			primary:  func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusInternalServerError) },
+			fallback: func(w http.ResponseWriter, r *http.Request) { _, _ = w.Write([]byte("fallback.example:443")) },
+			expected: "fallback.example:443",
+		},
+		{
+			name:     "unavailable",
+			primary:  func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusInternalServerError) },
+			fallback: func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusInternalServerError) },
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			primary := httptest.NewServer(tt.primary)
+			defer primary.Close()
+			fallbackURL := unreachableURL
+			if tt.fallback != nil {
+				fallback := httptest.NewServer(tt.fallback)
+				defer fallback.Close()
+				fallbackURL = fallback.URL
+			}
+			reader := NewReader(Config{
+				UseMetadataService:         true,
+				MetadataServiceURL:         primary.URL,
+				MetadataServiceFallbackURL: fallbackURL,
+			}, testLogger())
+
+			override, err := reader.GetEndpointOverride(context.Background())
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, override)
+		})
+	}
+
+	override, err := NewReader(Config{UseMetadataService: false}, testLogger()).GetEndpointOverride(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, override, "no override without the metadata service")
+}
+
 // makeHangingFile returns a path to a FIFO that blocks os.ReadFile in open(2)
 // until a writer appears, which never happens in these tests — simulating a
 // hung mount.
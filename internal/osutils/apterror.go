@@ -0,0 +1,215 @@
+package osutils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// AptErrorCode classifies a failed apt or dpkg run, so the backend can
+// aggregate failure types across the fleet.
+type AptErrorCode string
+
+const (
+	AptErrorLockHeld           AptErrorCode = "lock_held"
+	AptErrorVersionNotFound    AptErrorCode = "version_not_found"
+	AptErrorDependencyConflict AptErrorCode = "dependency_conflict"
+	AptErrorNetwork            AptErrorCode = "network"
+	AptErrorDiskFull           AptErrorCode = "disk_full"
+	AptErrorDpkgInterrupted    AptErrorCode = "dpkg_interrupted"
+	AptErrorGPG                AptErrorCode = "gpg"
+	AptErrorTimeout            AptErrorCode = "timeout"
+	AptErrorScriptFailed       AptErrorCode = "maintainer_script_failed"
+	AptErrorUnknown            AptErrorCode = "unknown"
+)
+
+// aptErrorPatterns map output lines to codes. They are tried in order, so a
+// run failing for several reasons is classified by the root cause apt itself
+// reports first: a lock or an interrupted dpkg stops apt before it fetches
+// anything, and a failing maintainer script is only blamed when nothing on
+// the node or the mirror explains the failure.
+var aptErrorPatterns = []struct {
+	code     AptErrorCode
+	patterns []string
+}{
+	{AptErrorLockHeld, []string{"could not get lock", "unable to acquire the dpkg frontend lock", "unable to lock"}},
+	{AptErrorDpkgInterrupted, []string{"dpkg was interrupted", "dpkg --configure -a"}},
+	{AptErrorDiskFull, []string{"no space left on device", "you don't have enough free space"}},
+	{AptErrorGPG, []string{"no_pubkey", "gpg error", "expkeysig", "signatures couldn't be verified", "is not signed"}},
+	{AptErrorVersionNotFound, []string{"was not found", "unable to locate package", "has no installation candidate"}},
+	{AptErrorDependencyConflict, []string{"unmet dependencies", "held broken packages", "conflicts with", "breaks:", "depends:"}},
+	{AptErrorNetwork, []string{"failed to fetch", "could not resolve", "temporary failure resolving", "connection failed", "connection timed out", "unable to connect", "hash sum mismatch"}},
+	{AptErrorScriptFailed, []string{"dpkg: error processing package", "returned error exit status"}},
+}
+
+// aptExcerptLines and aptExcerptLineLen bound the output kept in an AptError,
+// since it is reported to the backend on every poll.
+const (
+	aptExcerptLines   = 5
+	aptExcerptLineLen = 200
+)
+
+// termLogPath is where dpkg logs the output of package scripts. Declared as
+// var so tests can use their own log.
+var termLogPath = "/var/log/apt/term.log"
+
+// termLogTailBytes bounds how much of term.log is read for an excerpt.
+const termLogTailBytes = 16 * 1024
+
+// AptError is a failed apt or dpkg run. Its message leads with the code,
+// followed by the operation, the cause and trimmed excerpts of the command
+// output and of term.log.
+type AptError struct {
+	Code AptErrorCode
+	Op   string
+	// Package is the name=version an install failed for; empty for other
+	// operations.
+	Package string
+	Err     error
+	Output  string
+	TermLog string
+}
+
+// PackageFault reports whether e is a failed install caused by the package
+// itself: a version that cannot be found, unresolvable dependencies or
+// failing maintainer scripts. Lock contention, fetch and signature errors, a
+// full disk and timeouts depend on the node or the mirror and say nothing
+// about the version, and neither does an unclassified failure, which may be
+// a killed apt-get or a broken sources.list.
+func (e *AptError) PackageFault() bool {
+	if e.Package == "" {
+		return false
+	}
+	switch e.Code {
+	case AptErrorVersionNotFound, AptErrorDependencyConflict, AptErrorScriptFailed:
+		return true
+	}
+	return false
+}
+
+func (e *AptError) Error() string {
+	msg := fmt.Sprintf("%s: %s: %v", e.Code, e.Op, e.Err)
+	if e.Output != "" {
+		msg += ": " + e.Output
+	}
+	if e.TermLog != "" {
+		msg += "; term.log: " + e.TermLog
+	}
+	return msg
+}
+
+func (e *AptError) Unwrap() error {
+	return e.Err
+}
+
+// newAptError classifies err, returned by op with output. ctx is the context
+// the command ran under, so a killed command is reported as a timeout. If
+// withTermLog is set, the last dpkg session of term.log is excerpted as well.
+func (o OsHelper) newAptError(ctx context.Context, op string, err error, output []byte, withTermLog bool) *AptError {
+	code, lines := classifyAptOutput(string(output))
+	switch {
+	case errors.Is(err, ErrDpkgLocked):
+		code = AptErrorLockHeld
+	case errors.Is(ctx.Err(), context.DeadlineExceeded) || errors.Is(err, context.DeadlineExceeded):
+		code = AptErrorTimeout
+	}
+	e := &AptError{Code: code, Op: op, Err: err, Output: excerpt(lines)}
+	if withTermLog {
+		e.TermLog = o.termLogExcerpt()
+	}
+	return e
+}
+
+// classifyAptOutput returns the code of the first pattern matching output and
+// the lines worth reporting: the matching lines, or apt's error lines if none
+// matched.
+func classifyAptOutput(output string) (AptErrorCode, []string) {
+	lines := strings.Split(output, "\n")
+	for _, group := range aptErrorPatterns {
+		var matched []string
+		for _, line := range lines {
+			lower := strings.ToLower(line)
+			for _, pattern := range group.patterns {
+				if strings.Contains(lower, pattern) {
+					matched = append(matched, line)
+					break
+				}
+			}
+		}
+		if len(matched) > 0 {
+			return group.code, matched
+		}
+	}
+	var errorLines []string
+	for _, line := range lines {
+		if strings.HasPrefix(line, "E: ") || strings.HasPrefix(line, "dpkg: error") {
+			errorLines = append(errorLines, line)
+		}
+	}
+	return AptErrorUnknown, errorLines
+}
+
+// excerpt joins the first aptExcerptLines non-empty lines, each cut to
+// aptExcerptLineLen bytes.
+func excerpt(lines []string) string {
+	var kept []string
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if len(kept) == aptExcerptLines {
+			kept = append(kept, "...")
+			break
+		}
+		if len(line) > aptExcerptLineLen {
+			line = line[:aptExcerptLineLen] + "..."
+		}
+		kept = append(kept, line)
+	}
+	return strings.Join(kept, " | ")
+}
+
+// termLogExcerpt returns the last lines of the last session in term.log, or
+// "" if it cannot be read.
+func (o OsHelper) termLogExcerpt() string {
+	tail, err := guarded(o.fileGuard, termLogPath, procReadTimeout, func() ([]byte, error) {
+		f, err := os.Open(termLogPath)
+		if err != nil {
+			return nil, err
+		}
+		defer func() { _ = f.Close() }()
+		info, err := f.Stat()
+		if err != nil {
+			return nil, err
+		}
+		if offset := info.Size() - termLogTailBytes; offset > 0 {
+			if _, err := f.Seek(offset, io.SeekStart); err != nil {
+				return nil, err
+			}
+		}
+		return io.ReadAll(f)
+	})
+	if err != nil {
+		return ""
+	}
+	session := string(tail)
+	if i := strings.LastIndex(session, "Log started:"); i >= 0 {
+		session = session[i:]
+	}
+	var lines []string
+	for _, line := range strings.Split(session, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "Log started:") || strings.HasPrefix(line, "Log ended:") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) > aptExcerptLines {
+		lines = lines[len(lines)-aptExcerptLines:]
+	}
+	return excerpt(lines)
+}
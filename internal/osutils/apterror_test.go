@@ -0,0 +1,151 @@
+package osutils
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClassifyAptOutput(t *testing.T) {
+	testCases := []struct {
+		name    string
+		output  string
+		code    AptErrorCode
+		excerpt string
+	}{
+		{
+			name:    "lock held",
+			output:  "E: Could not get lock /var/lib/dpkg/lock-frontend. It is held by process 1234 (unattended-upgr)\nE: Unable to acquire the dpkg frontend lock (/var/lib/dpkg/lock-frontend), is another process using it?\n",
+			code:    AptErrorLockHeld,
+			excerpt: "E: Could not get lock /var/lib/dpkg/lock-frontend. It is held by process 1234 (unattended-upgr) | E: Unable to acquire the dpkg frontend lock (/var/lib/dpkg/lock-frontend), is another process using it?",
+		},
+		{
+			name:    "version not found",
+			output:  "Reading package lists...\nBuilding dependency tree...\nE: Version '9.9.9' for 'nebius-observability-agent' was not found\n",
+			code:    AptErrorVersionNotFound,
+			excerpt: "E: Version '9.9.9' for 'nebius-observability-agent' was not found",
+		},
+		{
+			name:    "dependency conflict",
+			output:  "The following packages have unmet dependencies:\n nebius-observability-agent : Depends: libc6 (>= 2.38) but 2.35 is to be installed\nE: Unable to correct problems, you have held broken packages.\n",
+			code:    AptErrorDependencyConflict,
+			excerpt: "The following packages have unmet dependencies: | nebius-observability-agent : Depends: libc6 (>= 2.38) but 2.35 is to be installed | E: Unable to correct problems, you have held broken packages.",
+		},
+		{
+			name:    "network",
+			output:  "Err:1 http://repo.example/ubuntu jammy/main amd64 nebius-observability-agent amd64 1.0\n  Temporary failure resolving 'repo.example'\nE: Failed to fetch http://repo.example/pool/a.deb  Temporary failure resolving 'repo.example'\n",
+			code:    AptErrorNetwork,
+			excerpt: "Temporary failure resolving 'repo.example' | E: Failed to fetch http://repo.example/pool/a.deb  Temporary failure resolving 'repo.example'",
+		},
+		{
+			name:    "disk full",
+			output:  "E: You don't have enough free space in /var/cache/apt/archives/.\n",
+			code:    AptErrorDiskFull,
+			excerpt: "E: You don't have enough free space in /var/cache/apt/archives/.",
+		},
+		{
+			name:    "dpkg interrupted",
+			output:  "E: dpkg was interrupted, you must manually run 'dpkg --configure -a' to correct the problem.\n",
+			code:    AptErrorDpkgInterrupted,
+			excerpt: "E: dpkg was interrupted, you must manually run 'dpkg --configure -a' to correct the problem.",
+		},
+		{
+			name:    "gpg",
+			output:  "W: GPG error: http://repo.example stable InRelease: The following signatures couldn't be verified because the public key is not available: NO_PUBKEY 0123456789ABCDEF\n",
+			code:    AptErrorGPG,
+			excerpt: "W: GPG error: http://repo.example stable InRelease: The following signatures couldn't be verified because the public key is not available: NO_PUBKEY 0123456789ABCDEF",
+		},
+		{
+			name:    "maintainer script",
+			output:  "Setting up nebius-observability-agent (1.0.1) ...\ndpkg: error processing package nebius-observability-agent (--configure):\n installed nebius-observability-agent package post-installation script subprocess returned error exit status 1\nE: Sub-process /usr/bin/dpkg returned an error code (1)\n",
+			code:    AptErrorScriptFailed,
+			excerpt: "dpkg: error processing package nebius-observability-agent (--configure): | installed nebius-observability-agent package post-installation script subprocess returned error exit status 1",
+		},
+		{
+			name:    "unknown keeps error lines",
+			output:  "Reading package lists...\nE: Sub-process /usr/bin/dpkg returned an error code (1)\n",
+			code:    AptErrorUnknown,
+			excerpt: "E: Sub-process /usr/bin/dpkg returned an error code (1)",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			code, lines := classifyAptOutput(tc.output)
+			if code != tc.code {
+				t.Errorf("code = %s, want %s", code, tc.code)
+			}
+			if got := excerpt(lines); got != tc.excerpt {
+				t.Errorf("excerpt = %q, want %q", got, tc.excerpt)
+			}
+		})
+	}
+}
+
+func TestExcerptTrims(t *testing.T) {
+	lines := []string{strings.Repeat("x", 300), "", "b", "c", "d", "e", "f"}
+	want := strings.Repeat("x", 200) + "... | b | c | d | e | ..."
+	if got := excerpt(lines); got != want {
+		t.Errorf("excerpt = %q, want %q", got, want)
+	}
+}
+
+func TestNewAptError(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "term.log")
+	content := "Log started: 2026-01-01  10:00:00\nold session\nLog ended: 2026-01-01  10:00:05\n\n" +
+		"Log started: 2026-01-02  10:00:00\nSetting up nebius-observability-agent (1.0.1) ...\n" +
+		"dpkg: error processing package nebius-observability-agent (--configure):\n installed post-installation script subprocess returned error exit status 1\n"
+	if err := os.WriteFile(logPath, []byte(content), 0640); err != nil {
+		t.Fatal(err)
+	}
+	oldPath := termLogPath
+	termLogPath = logPath
+	t.Cleanup(func() { termLogPath = oldPath })
+
+	o := NewOsHelper(NewFileGuard(DefaultMaxPendingFileOps))
+	exitErr := errors.New("exit status 100")
+	err := o.newAptError(context.Background(), "failed to install package a=1", exitErr,
+		[]byte("E: Sub-process /usr/bin/dpkg returned an error code (1)\n"), true)
+	want := "unknown: failed to install package a=1: exit status 100: E: Sub-process /usr/bin/dpkg returned an error code (1); " +
+		"term.log: Setting up nebius-observability-agent (1.0.1) ... | dpkg: error processing package nebius-observability-agent (--configure): | " +
+		"installed post-installation script subprocess returned error exit status 1"
+	if err.Error() != want {
+		t.Errorf("error = %q, want %q", err.Error(), want)
+	}
+	if !errors.Is(err, exitErr) {
+		t.Error("AptError does not unwrap to its cause")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	<-ctx.Done()
+	if err := o.newAptError(ctx, "failed to update repo", errors.New("signal: killed"), nil, false); err.Code != AptErrorTimeout {
+		t.Errorf("killed by deadline: code = %s, want %s", err.Code, AptErrorTimeout)
+	}
+	if err := o.newAptError(context.Background(), "failed to update repo", ErrDpkgLocked, nil, false); err.Code != AptErrorLockHeld {
+		t.Errorf("dpkg lock wait: code = %s, want %s", err.Code, AptErrorLockHeld)
+	}
+}
+
+func TestAptErrorPackageFault(t *testing.T) {
+	tests := []struct {
+		name string
+		err  *AptError
+		want bool
+	}{
+		{"dependency conflict", &AptError{Code: AptErrorDependencyConflict, Package: "a=1"}, true},
+		{"failing maintainer script", &AptError{Code: AptErrorScriptFailed, Package: "a=1"}, true},
+		{"unclassified failure", &AptError{Code: AptErrorUnknown, Package: "a=1"}, false},
+		{"lock held", &AptError{Code: AptErrorLockHeld, Package: "a=1"}, false},
+		{"fetch failure", &AptError{Code: AptErrorNetwork, Package: "a=1"}, false},
+		{"repo update", &AptError{Code: AptErrorUnknown, Op: "failed to update repo"}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.err.PackageFault(); got != tt.want {
+			t.Errorf("%s: PackageFault() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
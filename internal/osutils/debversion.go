@@ -0,0 +1,159 @@
+package osutils
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// DebVersion is a parsed Debian package version, [epoch:]upstream[-revision].
+type DebVersion struct {
+	Epoch    int
+	Upstream string
+	Revision string
+}
+
+// ParseDebVersion parses a version as dpkg does: the epoch is everything
+// before the first colon, the revision everything after the last hyphen.
+func ParseDebVersion(s string) (DebVersion, error) {
+	var v DebVersion
+	rest := strings.TrimSpace(s)
+	if rest == "" {
+		return v, fmt.Errorf("invalid version %q: empty", s)
+	}
+	if epoch, after, found := strings.Cut(rest, ":"); found {
+		n, err := strconv.Atoi(epoch)
+		if err != nil || n < 0 {
+			return v, fmt.Errorf("invalid version %q: epoch is not a number", s)
+		}
+		v.Epoch = n
+		rest = after
+	}
+	if i := strings.LastIndexByte(rest, '-'); i >= 0 {
+		v.Revision = rest[i+1:]
+		rest = rest[:i]
+	}
+	if rest == "" {
+		return v, fmt.Errorf("invalid version %q: empty upstream version", s)
+	}
+	for _, c := range rest + v.Revision {
+		if !isDebVersionChar(c) {
+			return v, fmt.Errorf("invalid version %q: invalid character %q", s, c)
+		}
+	}
+	v.Upstream = rest
+	return v, nil
+}
+
+func isDebVersionChar(c rune) bool {
+	return isDigit(c) || isLetter(c) || strings.ContainsRune(".+~-:", c)
+}
+
+// Compare returns -1, 0 or 1 as v sorts before, equal to or after o.
+func (v DebVersion) Compare(o DebVersion) int {
+	switch {
+	case v.Epoch < o.Epoch:
+		return -1
+	case v.Epoch > o.Epoch:
+		return 1
+	}
+	if c := compareDebFragment(v.Upstream, o.Upstream); c != 0 {
+		return c
+	}
+	return compareDebFragment(v.Revision, o.Revision)
+}
+
+func (v DebVersion) String() string {
+	s := v.Upstream
+	if v.Epoch > 0 {
+		s = strconv.Itoa(v.Epoch) + ":" + s
+	}
+	if v.Revision != "" {
+		s += "-" + v.Revision
+	}
+	return s
+}
+
+// CompareDebVersions parses and compares two versions like
+// dpkg --compare-versions.
+func CompareDebVersions(a, b string) (int, error) {
+	va, err := ParseDebVersion(a)
+	if err != nil {
+		return 0, err
+	}
+	vb, err := ParseDebVersion(b)
+	if err != nil {
+		return 0, err
+	}
+	return va.Compare(vb), nil
+}
+
+// compareDebFragment implements dpkg's verrevcmp: alternating non-digit and
+// digit runs are compared, the former by debOrder, the latter numerically.
+func compareDebFragment(a, b string) int {
+	for a != "" || b != "" {
+		for (a != "" && !isDigit(rune(a[0]))) || (b != "" && !isDigit(rune(b[0]))) {
+			ac, bc := debOrder(a), debOrder(b)
+			if ac != bc {
+				return sign(ac - bc)
+			}
+			a, b = a[1:], b[1:]
+		}
+		a = strings.TrimLeft(a, "0")
+		b = strings.TrimLeft(b, "0")
+		diff := 0
+		for a != "" && isDigit(rune(a[0])) && b != "" && isDigit(rune(b[0])) {
+			if diff == 0 {
+				diff = int(a[0]) - int(b[0])
+			}
+			a, b = a[1:], b[1:]
+		}
+		if a != "" && isDigit(rune(a[0])) {
+			return 1
+		}
+		if b != "" && isDigit(rune(b[0])) {
+			return -1
+		}
+		if diff != 0 {
+			return sign(diff)
+		}
+	}
+	return 0
+}
+
+// debOrder weighs the first character of s for comparison: the end of the
+// string and digits sort before letters, letters before other characters,
+// and a tilde before everything, even the end of the string.
+func debOrder(s string) int {
+	if s == "" {
+		return 0
+	}
+	c := rune(s[0])
+	switch {
+	case isDigit(c):
+		return 0
+	case isLetter(c):
+		return int(c)
+	case c == '~':
+		return -1
+	}
+	return int(c) + 256
+}
+
+func isDigit(c rune) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isLetter(c rune) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func sign(n int) int {
+	switch {
+	case n < 0:
+		return -1
+	case n > 0:
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,60 @@
+package osutils
+
+import "testing"
+
+func TestCompareDebVersions(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		expected int
+	}{
+		{"1.0", "1.0", 0},
+		{"1.0", "1.0-0", 0},
+		{"0:1.0", "1.0", 0},
+		{"1.0", "1.1", -1},
+		{"1.10", "1.9", 1},
+		{"1.010", "1.10", 0},
+		{"1:0.1", "2.0", 1},
+		{"1.0~rc1", "1.0", -1},
+		{"1.0~rc1", "1.0~rc2", -1},
+		{"1.0~", "1.0~~", 1},
+		{"1.0", "1.0a", -1},
+		{"1.0a", "1.0+", -1},
+		{"1.0+1", "1.0.1", -1},
+		{"1.0-1", "1.0-2", -1},
+		{"1.0-1ubuntu1", "1.0-1", 1},
+		{"1.0-1~bpo1", "1.0-1", -1},
+		{"2.3.4-rc-1", "2.3.4-rc-2", -1},
+		{"0.2.150", "0.2.99", 1},
+	}
+	for _, tt := range tests {
+		got, err := CompareDebVersions(tt.a, tt.b)
+		if err != nil {
+			t.Fatalf("%s vs %s: unexpected error: %v", tt.a, tt.b, err)
+		}
+		if got != tt.expected {
+			t.Errorf("%s vs %s: expected %d, got %d", tt.a, tt.b, tt.expected, got)
+		}
+		if reverse, _ := CompareDebVersions(tt.b, tt.a); reverse != -tt.expected {
+			t.Errorf("%s vs %s: expected %d, got %d", tt.b, tt.a, -tt.expected, reverse)
+		}
+	}
+}
+
+func TestParseDebVersion(t *testing.T) {
+	v, err := ParseDebVersion("2:1.2-3-4")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if v.Epoch != 2 || v.Upstream != "1.2-3" || v.Revision != "4" {
+		t.Errorf("unexpected parse result %+v", v)
+	}
+	if v.String() != "2:1.2-3-4" {
+		t.Errorf("expected round trip, got %s", v)
+	}
+
+	for _, invalid := range []string{"", "x:1.0", "1:", "-1", "1.0 beta", "1.0_1"} {
+		if _, err := ParseDebVersion(invalid); err == nil {
+			t.Errorf("%q: expected an error", invalid)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package osutils
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// dpkgUpdatesDir holds the journal of an unfinished dpkg run; apt refuses to
+// install while it is non-empty ("dpkg was interrupted"). Declared as var so
+// tests can use their own directory.
+var dpkgUpdatesDir = "/var/lib/dpkg/updates"
+
+// RepairDpkg finishes a dpkg run left incomplete by a reboot, an OOM kill or
+// a timeout, which would fail every later install. It returns what was found
+// broken, or "" if dpkg was consistent and nothing was run. A failed repair
+// is returned as an *AptError. Cancelling ctx aborts the wait for the dpkg
+// lock and the audit; dpkg --configure -a runs through protect.
+func (o OsHelper) RepairDpkg(ctx context.Context, protect Protect) (string, error) {
+	unlock, err := lockPackageManager(ctx, true)
+	if err != nil {
+		return "", o.newAptError(ctx, "failed to audit dpkg", err, nil, false)
+	}
+	defer unlock()
+
+	problems, err := o.dpkgProblems(ctx)
+	if err != nil {
+		return "", err
+	}
+	if problems == "" {
+		return "", nil
+	}
+
+	return problems, protect.run(ctx, func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+		defer cancel()
+
+		cmd := exec.CommandContext(ctx, "dpkg", "--configure", "-a", "--force-confdef", "--force-confold")
+		cmd.Env = append(os.Environ(), "DEBIAN_FRONTEND=noninteractive")
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			return o.newAptError(ctx, "failed to repair dpkg ("+problems+") with dpkg --configure -a", err, output, true)
+		}
+		return nil
+	})
+}
+
+// dpkgProblems describes an interrupted dpkg run and the packages dpkg --audit
+// reports as not fully installed, or returns "" if there are none.
+func (o OsHelper) dpkgProblems(ctx context.Context) (string, error) {
+	var problems []string
+	pending, err := guarded(o.fileGuard, dpkgUpdatesDir, procReadTimeout, func() ([]os.DirEntry, error) {
+		return os.ReadDir(dpkgUpdatesDir)
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return "", fmt.Errorf("failed to read dpkg journal: %w", err)
+	}
+	if len(pending) > 0 {
+		problems = append(problems, "dpkg was interrupted")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	// dpkg --audit exits non-zero when it found problems, so only a failure
+	// without output is an error.
+	output, err := exec.CommandContext(ctx, "dpkg", "--audit").Output()
+	audit := strings.TrimSpace(string(output))
+	if err != nil && audit == "" {
+		return "", fmt.Errorf("failed to run dpkg --audit: %w", err)
+	}
+	if packages := auditedPackages(audit); len(packages) > 0 {
+		problems = append(problems, "not fully installed: "+strings.Join(packages, ", "))
+	} else if audit != "" {
+		problems = append(problems, "dpkg --audit: "+excerpt(strings.Split(audit, "\n")))
+	}
+	return strings.Join(problems, "; "), nil
+}
+
+// auditedPackages returns the package names listed by dpkg --audit, whose
+// output groups them, indented by one space, under explanatory paragraphs.
+func auditedPackages(audit string) []string {
+	var packages []string
+	for _, line := range strings.Split(audit, "\n") {
+		if !strings.HasPrefix(line, " ") {
+			continue
+		}
+		if fields := strings.Fields(line); len(fields) > 0 {
+			packages = append(packages, fields[0])
+		}
+	}
+	return packages
+}
@@ -0,0 +1,60 @@
+package osutils
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAuditedPackages(t *testing.T) {
+	audit := `The following packages are only half configured, probably due to problems
+configuring them the first time.  The configuration should be retried using
+dpkg --configure <package> or the configure menu option in dselect:
+ nebius-observability-agent Nebius observability agent
+
+The following packages are in a mess due to serious problems during
+installation.  They must be reinstalled for them (and any packages
+that depend on them) to function properly:
+ libfoo1              Foo library`
+	want := []string{"nebius-observability-agent", "libfoo1"}
+	if got := auditedPackages(audit); !reflect.DeepEqual(got, want) {
+		t.Errorf("auditedPackages = %v, want %v", got, want)
+	}
+	if got := auditedPackages(""); got != nil {
+		t.Errorf("auditedPackages of a clean audit = %v, want none", got)
+	}
+}
+
+func TestDpkgProblems_Interrupted(t *testing.T) {
+	if _, err := exec.LookPath("dpkg"); err != nil {
+		t.Skip("dpkg not found, skipping test")
+	}
+	dir := t.TempDir()
+	oldDir := dpkgUpdatesDir
+	dpkgUpdatesDir = dir
+	t.Cleanup(func() { dpkgUpdatesDir = oldDir })
+	o := NewOsHelper(NewFileGuard(DefaultMaxPendingFileOps))
+
+	problems, err := o.dpkgProblems(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(problems, "interrupted") {
+		t.Errorf("empty journal reported as interrupted: %q", problems)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "0001"), []byte("Package: a\n"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	problems, err = o.dpkgProblems(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(problems, "dpkg was interrupted") {
+		t.Errorf("pending journal not reported: %q", problems)
+	}
+}
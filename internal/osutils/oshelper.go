@@ -7,6 +7,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
 	"sort"
 	"strconv"
 	"strings"
@@ -15,6 +16,7 @@ import (
 	"time"
 
 	"github.com/shirou/gopsutil/v3/host"
+	"github.com/shirou/gopsutil/v3/load"
 	"github.com/shirou/gopsutil/v3/process"
 )
 
@@ -33,8 +35,8 @@ var mk8sReadTimeout = 5 * time.Second
 
 var ErrDebNotFound = fmt.Errorf("package not found")
 
-func (o OsHelper) GetDebVersion(name string) (string, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+func (o OsHelper) GetDebVersion(ctx context.Context, name string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
 	defer cancel()
 
 	cmd := exec.CommandContext(ctx, "dpkg-query", "-W", "-f=${Version}", name)
@@ -46,8 +48,8 @@ func (o OsHelper) GetDebVersion(name string) (string, error) {
 	return strings.TrimSpace(string(output)), nil
 }
 
-func (o OsHelper) getSystemdPid(serviceName string) (int32, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+func (o OsHelper) getSystemdPid(ctx context.Context, serviceName string) (int32, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
 	defer cancel()
 
 	cmd := exec.CommandContext(ctx, "systemctl", "show", "--property=MainPID", "--value", serviceName)
@@ -64,8 +66,8 @@ func (o OsHelper) getSystemdPid(serviceName string) (int32, error) {
 	return int32(pid), nil
 }
 
-func (o OsHelper) GetSystemdStatus(serviceName string) (string, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+func (o OsHelper) GetSystemdStatus(ctx context.Context, serviceName string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
 	defer cancel()
 
 	cmd := exec.CommandContext(ctx, "systemctl", "is-active", serviceName)
@@ -77,8 +79,59 @@ func (o OsHelper) GetSystemdStatus(serviceName string) (string, error) {
 	return result, nil
 }
 
-func (o OsHelper) GetLastLogs(serviceName string, lines int) (string, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+// GetCloudInitStatus returns the status cloud-init reports for the current
+// boot: "not started", "running", "done", "error", "disabled" or, on recent
+// versions, "degraded done". Unlike the state of cloud-init.service, which
+// only covers the network stage, it stays "running" until the final stage,
+// which installs packages, finished.
+func (o OsHelper) GetCloudInitStatus(ctx context.Context) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	// cloud-init status exits non-zero when cloud-init failed, but still
+	// prints the status.
+	output, err := exec.CommandContext(ctx, "cloud-init", "status").Output()
+	if status, found := parseCloudInitStatus(output); found {
+		return status, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get cloud-init status: %w", err)
+	}
+	return "", errors.New("no status in cloud-init status output")
+}
+
+// parseCloudInitStatus returns the value of the "status:" line of cloud-init
+// status output.
+func parseCloudInitStatus(output []byte) (string, bool) {
+	for _, line := range strings.Split(string(output), "\n") {
+		if status, found := strings.CutPrefix(strings.TrimSpace(line), "status:"); found {
+			return strings.TrimSpace(status), true
+		}
+	}
+	return "", false
+}
+
+// GetServiceRestartCount returns systemd's NRestarts for the unit: how many
+// times it was restarted automatically (Restart=) since it was last started
+// explicitly.
+func (o OsHelper) GetServiceRestartCount(ctx context.Context, serviceName string) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "systemctl", "show", "--property=NRestarts", "--value", serviceName)
+	output, err := cmd.Output()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get restart count of %s: %w", serviceName, err)
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(string(output)))
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse restart count: %w", err)
+	}
+	return count, nil
+}
+
+func (o OsHelper) GetLastLogs(ctx context.Context, serviceName string, lines int) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
 	defer cancel()
 
 	cmd := exec.CommandContext(ctx, "journalctl", "-u", serviceName, "--no-pager", fmt.Sprintf("--lines=%d", lines))
@@ -89,25 +142,60 @@ func (o OsHelper) GetLastLogs(serviceName string, lines int) (string, error) {
 	return string(output), nil
 }
 
-func (o OsHelper) GetServiceUptime(serviceName string) (time.Duration, error) {
-	pid, err := o.getSystemdPid(serviceName)
+// ErrServiceNotRunning is returned for a unit that has no main process.
+var ErrServiceNotRunning = errors.New("service is not running")
+
+// procReadTimeout bounds reads from /proc. Declared as var so tests can
+// shorten it.
+var procReadTimeout = 5 * time.Second
+
+// GetServiceEnviron returns the environment of the unit's main process, read
+// from /proc/<MainPID>/environ.
+func (o OsHelper) GetServiceEnviron(ctx context.Context, serviceName string) (map[string]string, error) {
+	pid, err := o.getSystemdPid(ctx, serviceName)
+	if err != nil {
+		return nil, err
+	}
+	if pid == 0 {
+		return nil, fmt.Errorf("%s: %w", serviceName, ErrServiceNotRunning)
+	}
+	content, err := o.fileGuard.ReadFile(fmt.Sprintf("/proc/%d/environ", pid), procReadTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read environment of %s: %w", serviceName, err)
+	}
+	return parseEnviron(content), nil
+}
+
+// parseEnviron parses NUL-separated KEY=VALUE entries.
+func parseEnviron(content []byte) map[string]string {
+	env := make(map[string]string)
+	for _, entry := range strings.Split(string(content), "\x00") {
+		if k, v, ok := strings.Cut(entry, "="); ok && k != "" {
+			env[k] = v
+		}
+	}
+	return env
+}
+
+func (o OsHelper) GetServiceUptime(ctx context.Context, serviceName string) (time.Duration, error) {
+	pid, err := o.getSystemdPid(ctx, serviceName)
 	if err != nil {
 		return 0, err
 	}
 	if pid == 0 {
 		return 0, nil
 	}
-	return o.getProcessUptime(pid)
+	return o.getProcessUptime(ctx, pid)
 }
 
-func (o OsHelper) getProcessUptime(pid int32) (time.Duration, error) {
-	p, err := process.NewProcess(pid)
+func (o OsHelper) getProcessUptime(ctx context.Context, pid int32) (time.Duration, error) {
+	p, err := process.NewProcessWithContext(ctx, pid)
 	if err != nil {
 		return 0, fmt.Errorf("failed to create process object: %w", err)
 	}
 
 	// Get the process creation time
-	createTime, err := p.CreateTime()
+	createTime, err := p.CreateTimeWithContext(ctx)
 	if err != nil {
 		return 0, fmt.Errorf("failed to get process creation time: %w", err)
 	}
@@ -117,16 +205,101 @@ func (o OsHelper) getProcessUptime(pid int32) (time.Duration, error) {
 	return uptime, nil
 }
 
-func (o OsHelper) GetSystemUptime() (time.Duration, error) {
-	uptime, err := host.BootTime()
+func (o OsHelper) GetSystemUptime(ctx context.Context) (time.Duration, error) {
+	uptime, err := host.BootTimeWithContext(ctx)
 	if err != nil {
 		return 0, fmt.Errorf("failed to get system uptime: %w", err)
 	}
 	return time.Since(time.Unix(int64(uptime), 0)).Round(time.Second), nil
 }
 
-func (o OsHelper) GetOsName() (string, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+// GetSystemState returns the state reported by systemctl is-system-running,
+// e.g. "running", "degraded" or "stopping".
+func (o OsHelper) GetSystemState(ctx context.Context) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	// is-system-running exits non-zero for every state but "running", so only
+	// an empty output is an error.
+	output, _ := exec.CommandContext(ctx, "systemctl", "is-system-running").Output()
+	state := strings.TrimSpace(string(output))
+	if state == "" {
+		return "", errors.New("failed to get system state")
+	}
+	return state, nil
+}
+
+// GetLoadPerCPU returns the 1-minute load average divided by the number of
+// CPUs.
+func (o OsHelper) GetLoadPerCPU(ctx context.Context) (float64, error) {
+	avg, err := load.AvgWithContext(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get load average: %w", err)
+	}
+	return avg.Load1 / float64(runtime.NumCPU()), nil
+}
+
+// GetPressure returns the share of time, in percent over the last 10 seconds,
+// in which some tasks were stalled on resource ("cpu", "io" or "memory"), as
+// reported by the kernel's pressure stall information.
+func (o OsHelper) GetPressure(ctx context.Context, resource string) (float64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	content, err := o.fileGuard.ReadFile("/proc/pressure/"+resource, procReadTimeout)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read %s pressure: %w", resource, err)
+	}
+	return parsePressure(content)
+}
+
+// parsePressure returns the avg10 value of the "some" line of a
+// /proc/pressure file.
+func parsePressure(content []byte) (float64, error) {
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || fields[0] != "some" {
+			continue
+		}
+		for _, field := range fields[1:] {
+			if value, ok := strings.CutPrefix(field, "avg10="); ok {
+				return strconv.ParseFloat(value, 64)
+			}
+		}
+	}
+	return 0, errors.New("no avg10 value for some tasks in pressure file")
+}
+
+// packageManagerProcesses are the process names that hold or wait for the
+// dpkg lock.
+var packageManagerProcesses = map[string]bool{
+	"apt":             true,
+	"apt-get":         true,
+	"aptitude":        true,
+	"dpkg":            true,
+	"unattended-upgr": true, // unattended-upgrade, truncated to 15 characters
+}
+
+// GetPackageManagerProcesses returns the running apt and dpkg processes as
+// "name (pid N)".
+func (o OsHelper) GetPackageManagerProcesses(ctx context.Context) ([]string, error) {
+	procs, err := process.ProcessesWithContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list processes: %w", err)
+	}
+	var found []string
+	for _, p := range procs {
+		name, err := p.NameWithContext(ctx)
+		if err != nil || !packageManagerProcesses[name] {
+			continue
+		}
+		found = append(found, fmt.Sprintf("%s (pid %d)", name, p.Pid))
+	}
+	return found, nil
+}
+
+func (o OsHelper) GetOsName(ctx context.Context) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
 	defer cancel()
 
 	cmd := exec.CommandContext(ctx, "lsb_release", "-d")
@@ -141,8 +314,8 @@ func (o OsHelper) GetOsName() (string, error) {
 	return strings.TrimSpace(parts[len(parts)-1]), nil
 }
 
-func (o OsHelper) GetUname() (string, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+func (o OsHelper) GetUname(ctx context.Context) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
 	defer cancel()
 
 	cmd := exec.CommandContext(ctx, "uname", "-a")
@@ -153,8 +326,8 @@ func (o OsHelper) GetUname() (string, error) {
 	return strings.TrimSpace(string(output)), nil
 }
 
-func (o OsHelper) GetArch() (string, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+func (o OsHelper) GetArch(ctx context.Context) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
 	defer cancel()
 
 	cmd := exec.CommandContext(ctx, "uname", "-m")
@@ -165,20 +338,39 @@ func (o OsHelper) GetArch() (string, error) {
 	return strings.TrimSpace(string(output)), nil
 }
 
-func (o OsHelper) InstallPackage(packageName string, version string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
-	defer cancel()
-
-	cmd := exec.CommandContext(ctx, "apt-get", "install", "--allow-downgrades", "-y", packageName+"="+version)
-	output, err := cmd.CombinedOutput()
+// InstallPackage installs packageName=version. It first waits for other
+// installs of this process and for other processes holding the dpkg lock, see
+// ErrDpkgLocked; cancelling ctx aborts the wait. apt-get itself runs through
+// protect, since killing it may leave dpkg half-configured. A failure of
+// apt-get is returned as an *AptError.
+func (o OsHelper) InstallPackage(ctx context.Context, protect Protect, packageName string, version string) error {
+	pkg := packageName + "=" + version
+	op := "failed to install package " + pkg
+	unlock, err := lockPackageManager(ctx, true)
 	if err != nil {
-		return fmt.Errorf("failed to install package %s=%s: %w: %s", packageName, version, err, output)
-	}
-	return nil
+		aptErr := o.newAptError(ctx, op, err, nil, false)
+		aptErr.Package = pkg
+		return aptErr
+	}
+	defer unlock()
+
+	return protect.run(ctx, func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+		defer cancel()
+
+		cmd := exec.CommandContext(ctx, "apt-get", "install", "--allow-downgrades", "-y", pkg)
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			aptErr := o.newAptError(ctx, op, err, output, true)
+			aptErr.Package = pkg
+			return aptErr
+		}
+		return nil
+	})
 }
 
-func (o OsHelper) RestartService(serviceName string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+func (o OsHelper) RestartService(ctx context.Context, serviceName string) error {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Minute)
 	defer cancel()
 
 	cmd := exec.CommandContext(ctx, "systemctl", "restart", serviceName)
@@ -189,14 +381,23 @@ func (o OsHelper) RestartService(serviceName string) error {
 	return nil
 }
 
-func (o OsHelper) UpdateRepo(scriptPath string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+// UpdateRepo runs the repository setup script, which refreshes the apt
+// package lists, after other apt runs of this process finished. A failure is
+// returned as an *AptError.
+func (o OsHelper) UpdateRepo(ctx context.Context, scriptPath string) error {
+	unlock, err := lockPackageManager(ctx, false)
+	if err != nil {
+		return o.newAptError(ctx, "failed to update repo", err, nil, false)
+	}
+	defer unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
 	defer cancel()
 
 	cmd := exec.CommandContext(ctx, scriptPath)
 	output, err := cmd.CombinedOutput()
 	if err != nil {
-		return fmt.Errorf("failed to update repo: %w: %s", err, output)
+		return o.newAptError(ctx, "failed to update repo", err, output, false)
 	}
 	return nil
 }
@@ -303,6 +504,15 @@ func (g *FileGuard) Stat(path string, timeout time.Duration) (os.FileInfo, error
 	return guarded(g, path, timeout, func() (os.FileInfo, error) { return os.Stat(path) })
 }
 
+// Run runs an arbitrary filesystem operation on path with a timeout, for
+// callers that need more than a single read, stat or write.
+func (g *FileGuard) Run(path string, timeout time.Duration, fn func() error) error {
+	_, err := guarded(g, path, timeout, func() (struct{}, error) {
+		return struct{}{}, fn()
+	})
+	return err
+}
+
 // WriteFileAtomic runs the atomic write with a timeout.
 func (g *FileGuard) WriteFileAtomic(path string, data []byte, perm os.FileMode, timeout time.Duration) error {
 	_, err := guarded(g, path, timeout, func() (struct{}, error) {
@@ -350,7 +560,7 @@ func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
 	return nil
 }
 
-func (o OsHelper) GetDirectorySize(path string) (int64, error) {
+func (o OsHelper) GetDirectorySize(ctx context.Context, path string) (int64, error) {
 	// Validate that path is not empty
 	if path == "" {
 		return 0, fmt.Errorf("path cannot be empty")
@@ -362,7 +572,7 @@ func (o OsHelper) GetDirectorySize(path string) (int64, error) {
 		return 0, nil
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
 	defer cancel()
 
 	cmd := exec.CommandContext(ctx, "du", "-sb", path)
@@ -385,7 +595,7 @@ func (o OsHelper) GetDirectorySize(path string) (int64, error) {
 	return size, nil
 }
 
-func (o OsHelper) GetMountpointSize(path string) (int64, error) {
+func (o OsHelper) GetMountpointSize(ctx context.Context, path string) (int64, error) {
 	// Validate that path is not empty
 	if path == "" {
 		return 0, fmt.Errorf("path cannot be empty")
@@ -397,7 +607,7 @@ func (o OsHelper) GetMountpointSize(path string) (int64, error) {
 		return 0, nil
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
 	defer cancel()
 
 	cmd := exec.CommandContext(ctx, "df", "--output=size", "-B1", path)
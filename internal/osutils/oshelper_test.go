@@ -1,6 +1,7 @@
 package osutils
 
 import (
+	"context"
 	"errors"
 	"os"
 	"os/exec"
@@ -39,7 +40,7 @@ func TestGetDebPackageVersion(t *testing.T) {
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			result, err := o.GetDebVersion(tc.packageName)
+			result, err := o.GetDebVersion(context.Background(), tc.packageName)
 
 			if tc.expectError && err == nil {
 				t.Errorf("Expected an error for package %s, but got none", tc.packageName)
@@ -132,7 +133,7 @@ func TestGetDirectorySize(t *testing.T) {
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			size, err := o.GetDirectorySize(tc.path)
+			size, err := o.GetDirectorySize(context.Background(), tc.path)
 
 			if tc.expectError && err == nil {
 				t.Errorf("Expected an error for path %s, but got none", tc.path)
@@ -207,7 +208,7 @@ func TestGetMountpointSize(t *testing.T) {
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			size, err := o.GetMountpointSize(tc.path)
+			size, err := o.GetMountpointSize(context.Background(), tc.path)
 
 			if tc.expectError && err == nil {
 				t.Errorf("Expected an error for path %s, but got none", tc.path)
@@ -226,3 +227,50 @@ func TestGetMountpointSize(t *testing.T) {
 		})
 	}
 }
+
+func TestParseEnviron(t *testing.T) {
+	env := parseEnviron([]byte("PATH=/usr/bin\x00FLAG=a=b\x00EMPTY=\x00junk\x00=novalue\x00"))
+	expected := map[string]string{"PATH": "/usr/bin", "FLAG": "a=b", "EMPTY": ""}
+	if len(env) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, env)
+	}
+	for k, v := range expected {
+		if env[k] != v {
+			t.Errorf("%s: expected %q, got %q", k, v, env[k])
+		}
+	}
+}
+
+func TestParseCloudInitStatus(t *testing.T) {
+	tests := []struct {
+		output string
+		want   string
+		found  bool
+	}{
+		{"status: running\n", "running", true},
+		{"\nstatus: error\n", "error", true},
+		{"status: degraded done\nextended_status: degraded done\n", "degraded done", true},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		got, found := parseCloudInitStatus([]byte(tt.output))
+		if got != tt.want || found != tt.found {
+			t.Errorf("parseCloudInitStatus(%q) = %q, %v, want %q, %v", tt.output, got, found, tt.want, tt.found)
+		}
+	}
+}
+
+func TestParsePressure(t *testing.T) {
+	content := []byte("some avg10=12.50 avg60=3.00 avg300=1.00 total=12345\nfull avg10=4.00 avg60=1.00 avg300=0.50 total=678\n")
+	value, err := parsePressure(content)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if value != 12.5 {
+		t.Errorf("expected 12.5, got %v", value)
+	}
+
+	if _, err := parsePressure([]byte("full avg10=4.00\n")); err == nil {
+		t.Error("expected an error without a some line")
+	}
+}
@@ -0,0 +1,130 @@
+package osutils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/shirou/gopsutil/v3/process"
+)
+
+// ErrDpkgLocked is wrapped by the error returned when another process kept
+// the dpkg lock for longer than dpkgLockTimeout.
+var ErrDpkgLocked = errors.New("dpkg lock held")
+
+// dpkgFrontendLockPath is the lock apt and dpkg take for the whole of an
+// install. Declared as var so tests can use their own lock file.
+var dpkgFrontendLockPath = "/var/lib/dpkg/lock-frontend"
+
+// dpkgLockTimeout bounds how long an install waits for unattended-upgrades,
+// cloud-init, the updater self-update cron job or a user to release the dpkg
+// lock. dpkgLockPollInterval is how often the lock is re-checked meanwhile.
+// Declared as var so tests can shorten them.
+var (
+	dpkgLockTimeout      = 10 * time.Minute
+	dpkgLockPollInterval = 5 * time.Second
+)
+
+// Protect runs fn, a package manager step that may leave dpkg half-configured
+// if it is killed midway, on a context that a shutdown does not cancel, and
+// returns an error without running fn if it may not start. A nil Protect runs
+// fn on ctx.
+type Protect func(ctx context.Context, fn func(ctx context.Context) error) error
+
+func (p Protect) run(ctx context.Context, fn func(ctx context.Context) error) error {
+	if p == nil {
+		return fn(ctx)
+	}
+	return p(ctx, fn)
+}
+
+// packageManagerSlot serializes the apt runs of this process, so the updates
+// of several agents never race each other for the dpkg lock.
+var packageManagerSlot = make(chan struct{}, 1)
+
+// lockPackageManager waits for the other apt runs of this process and then,
+// if waitForDpkg is set, for other processes to release the dpkg lock. The
+// returned function releases the process-wide slot.
+func lockPackageManager(ctx context.Context, waitForDpkg bool) (func(), error) {
+	select {
+	case packageManagerSlot <- struct{}{}:
+	case <-ctx.Done():
+		return nil, fmt.Errorf("waiting for another package manager run of the updater: %w", ctx.Err())
+	}
+	unlock := func() { <-packageManagerSlot }
+	if waitForDpkg {
+		if err := waitForDpkgLock(ctx); err != nil {
+			unlock()
+			return nil, err
+		}
+	}
+	return unlock, nil
+}
+
+// waitForDpkgLock returns once no other process holds the dpkg frontend lock.
+// The error names the holders if the lock is still held after
+// dpkgLockTimeout. apt-get takes the lock itself afterwards, so a process
+// grabbing it in between still fails the install, but with apt's own error.
+func waitForDpkgLock(ctx context.Context) error {
+	deadline := time.NewTimer(dpkgLockTimeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(dpkgLockPollInterval)
+	defer ticker.Stop()
+	for {
+		holder, err := DpkgLockHolder(ctx)
+		if err != nil || holder == "" {
+			// An unreadable lock is left for apt-get to report.
+			return nil
+		}
+		select {
+		case <-ticker.C:
+		case <-deadline.C:
+			return fmt.Errorf("%w: %s still held after %s by %s", ErrDpkgLocked, dpkgFrontendLockPath, dpkgLockTimeout, holder)
+		case <-ctx.Done():
+			return fmt.Errorf("waiting for %s held by %s: %w", dpkgFrontendLockPath, holder, ctx.Err())
+		}
+	}
+}
+
+// DpkgLockHolder returns the process holding the dpkg frontend lock as
+// "name (pid N)", or "" if the lock is free. Locks held by this process are
+// not reported.
+func DpkgLockHolder(ctx context.Context) (string, error) {
+	f, err := os.Open(dpkgFrontendLockPath)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to open dpkg lock: %w", err)
+	}
+	defer func() { _ = f.Close() }()
+
+	lock := syscall.Flock_t{Type: syscall.F_WRLCK, Whence: 0}
+	if err := syscall.FcntlFlock(f.Fd(), syscall.F_GETLK, &lock); err != nil {
+		return "", fmt.Errorf("failed to query dpkg lock: %w", err)
+	}
+	if lock.Type == syscall.F_UNLCK {
+		return "", nil
+	}
+	return describeProcess(ctx, lock.Pid), nil
+}
+
+// describeProcess returns "name (pid N)" for pid, which is 0 for a holder in
+// another PID namespace and -1 for an open file description lock.
+func describeProcess(ctx context.Context, pid int32) string {
+	if pid <= 0 {
+		return "an unknown process"
+	}
+	p, err := process.NewProcessWithContext(ctx, pid)
+	if err != nil {
+		return fmt.Sprintf("pid %d", pid)
+	}
+	name, err := p.NameWithContext(ctx)
+	if err != nil {
+		return fmt.Sprintf("pid %d", pid)
+	}
+	return fmt.Sprintf("%s (pid %d)", name, pid)
+}
@@ -0,0 +1,149 @@
+package osutils
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestHoldDpkgLockHelper is not a real test: it runs in a child process
+// started by holdDpkgLock, since fcntl locks of the test process itself are
+// invisible to DpkgLockHolder.
+func TestHoldDpkgLockHelper(t *testing.T) {
+	path := os.Getenv("OSUTILS_HOLD_DPKG_LOCK")
+	if path == "" {
+		t.Skip("helper process only")
+	}
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lock := syscall.Flock_t{Type: syscall.F_WRLCK}
+	if err := syscall.FcntlFlock(f.Fd(), syscall.F_SETLK, &lock); err != nil {
+		t.Fatal(err)
+	}
+	fmt.Println("locked")
+	time.Sleep(time.Minute)
+}
+
+// holdDpkgLock locks path from a child process until the test ends and
+// returns the child's pid.
+func holdDpkgLock(t *testing.T, path string) int {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], "-test.run=^TestHoldDpkgLockHelper$")
+	cmd.Env = append(os.Environ(), "OSUTILS_HOLD_DPKG_LOCK="+path)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	})
+	line, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil || line != "locked\n" {
+		t.Fatalf("helper did not take the lock: %q, %v", line, err)
+	}
+	return cmd.Process.Pid
+}
+
+func useDpkgLock(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "lock-frontend")
+	if err := os.WriteFile(path, nil, 0640); err != nil {
+		t.Fatal(err)
+	}
+	oldPath, oldTimeout, oldInterval := dpkgFrontendLockPath, dpkgLockTimeout, dpkgLockPollInterval
+	dpkgFrontendLockPath, dpkgLockTimeout, dpkgLockPollInterval = path, 200*time.Millisecond, 10*time.Millisecond
+	t.Cleanup(func() {
+		dpkgFrontendLockPath, dpkgLockTimeout, dpkgLockPollInterval = oldPath, oldTimeout, oldInterval
+	})
+	return path
+}
+
+func TestDpkgLockHolder(t *testing.T) {
+	path := useDpkgLock(t)
+
+	holder, err := DpkgLockHolder(context.Background())
+	if err != nil || holder != "" {
+		t.Fatalf("free lock: got %q, %v", holder, err)
+	}
+
+	pid := holdDpkgLock(t, path)
+	holder, err = DpkgLockHolder(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(holder, fmt.Sprintf("(pid %d)", pid)) {
+		t.Errorf("holder %q does not name pid %d", holder, pid)
+	}
+
+	dpkgFrontendLockPath = filepath.Join(t.TempDir(), "missing")
+	holder, err = DpkgLockHolder(context.Background())
+	if err != nil || holder != "" {
+		t.Errorf("missing lock file: got %q, %v", holder, err)
+	}
+}
+
+func TestLockPackageManager(t *testing.T) {
+	path := useDpkgLock(t)
+
+	unlock, err := lockPackageManager(context.Background(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := lockPackageManager(ctx, false); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("second run of this process: got %v, want deadline exceeded", err)
+	}
+	unlock()
+
+	pid := holdDpkgLock(t, path)
+	_, err = lockPackageManager(context.Background(), true)
+	if !errors.Is(err, ErrDpkgLocked) || !strings.Contains(err.Error(), fmt.Sprintf("(pid %d)", pid)) {
+		t.Errorf("held dpkg lock: got %v", err)
+	}
+
+	unlock, err = lockPackageManager(context.Background(), false)
+	if err != nil {
+		t.Fatalf("the slot is released after a dpkg lock timeout: %v", err)
+	}
+	unlock()
+}
+
+func TestInstallPackageCancelledWhileWaitingForDpkgLock(t *testing.T) {
+	path := useDpkgLock(t)
+	dpkgLockTimeout = time.Minute
+	holdDpkgLock(t, path)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	protected := false
+	protect := func(ctx context.Context, fn func(context.Context) error) error {
+		protected = true
+		return fn(ctx)
+	}
+	start := time.Now()
+	err := NewOsHelper(NewFileGuard(DefaultMaxPendingFileOps)).InstallPackage(ctx, protect, "pkg", "1.0")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want deadline exceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("the lock wait outlived ctx by %s", elapsed)
+	}
+	if protected {
+		t.Error("apt-get was started after the lock wait was cancelled")
+	}
+}
@@ -0,0 +1,193 @@
+package policy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// ErrRefused is wrapped by every error Check returns.
+var ErrRefused = errors.New("refused by policy")
+
+// Action is a mutating action gated by the policy.
+type Action int
+
+const (
+	// ActionInstall is a package install requested by the server.
+	ActionInstall Action = iota
+	// ActionRestart is an agent restart requested by the server.
+	ActionRestart
+	// ActionFlagsRestart is an agent restart to pick up changed feature flags.
+	ActionFlagsRestart
+)
+
+// Rules are the predicates that must hold before an action runs. Zero values
+// disable a predicate.
+//
+// MinAgentUptime is waived while the system uptime is below it as well: on a
+// freshly booted node the agent cannot have run any longer. CloudInitDone
+// waits for every cloud-init stage, including the final one that installs
+// packages, and refuses while cloud-init reports an error until it is
+// resolved or the rule is disabled. MaxLoadPerCPU
+// applies to the 1-minute load average divided by the number of CPUs.
+// MaxPressure applies to the kernel pressure stall information: the share of
+// the last 10 seconds, in percent, in which some tasks were stalled on CPU,
+// IO or memory.
+type Rules struct {
+	MinSystemUptime   time.Duration `yaml:"min_system_uptime"`
+	MinAgentUptime    time.Duration `yaml:"min_agent_uptime"`
+	CloudInitDone     bool          `yaml:"cloud_init_done"`
+	SystemNotStopping bool          `yaml:"system_not_stopping"`
+	MaxLoadPerCPU     float64       `yaml:"max_load_per_cpu"`
+	MaxPressure       float64       `yaml:"max_pressure"`
+	NoPackageManager  bool          `yaml:"no_package_manager_running"`
+}
+
+// Config holds the rules per action, so node pools with different workloads
+// can be gated differently.
+type Config struct {
+	Install      Rules `yaml:"install"`
+	Restart      Rules `yaml:"restart"`
+	FlagsRestart Rules `yaml:"flags_restart"`
+}
+
+// GetDefaultConfig returns the gating of earlier versions: installs wait for
+// 15 minutes of system uptime and restarts for changed flags for 15 minutes
+// of agent uptime.
+func GetDefaultConfig() Config {
+	return Config{
+		Install:      Rules{MinSystemUptime: 15 * time.Minute},
+		FlagsRestart: Rules{MinAgentUptime: 15 * time.Minute},
+	}
+}
+
+func (c Config) rules(action Action) Rules {
+	switch action {
+	case ActionInstall:
+		return c.Install
+	case ActionRestart:
+		return c.Restart
+	case ActionFlagsRestart:
+		return c.FlagsRestart
+	}
+	return Rules{}
+}
+
+// Probe reads the node state the predicates are evaluated against.
+type Probe interface {
+	GetSystemUptime(ctx context.Context) (time.Duration, error)
+	GetServiceUptime(ctx context.Context, serviceName string) (time.Duration, error)
+	GetCloudInitStatus(ctx context.Context) (string, error)
+	GetSystemState(ctx context.Context) (string, error)
+	GetLoadPerCPU(ctx context.Context) (float64, error)
+	GetPressure(ctx context.Context, resource string) (float64, error)
+	GetPackageManagerProcesses(ctx context.Context) ([]string, error)
+}
+
+// pressureResources are the resources MaxPressure applies to.
+var pressureResources = []string{"cpu", "io", "memory"}
+
+// Engine evaluates the configured rules. A predicate whose input cannot be
+// read is logged and treated as satisfied, so a node without, say, pressure
+// stall information is not blocked forever. A nil *Engine allows every action.
+type Engine struct {
+	cfg    Config
+	probe  Probe
+	logger *slog.Logger
+}
+
+func New(cfg Config, probe Probe, logger *slog.Logger) *Engine {
+	return &Engine{cfg: cfg, probe: probe, logger: logger}
+}
+
+// Check returns nil if action may run on serviceName now, or an error wrapping
+// ErrRefused that lists every predicate that does not hold.
+func (e *Engine) Check(ctx context.Context, action Action, serviceName string) error {
+	if e == nil {
+		return nil
+	}
+	rules := e.cfg.rules(action)
+	var reasons []string
+	refuse := func(format string, args ...any) {
+		reasons = append(reasons, fmt.Sprintf(format, args...))
+	}
+
+	var systemUptime time.Duration
+	systemUptimeKnown := false
+	if rules.MinSystemUptime > 0 || rules.MinAgentUptime > 0 {
+		uptime, err := e.probe.GetSystemUptime(ctx)
+		if err != nil {
+			e.unknown("system uptime", err)
+		} else {
+			systemUptime, systemUptimeKnown = uptime, true
+		}
+	}
+	if rules.MinSystemUptime > 0 && systemUptimeKnown && systemUptime < rules.MinSystemUptime {
+		refuse("system uptime %s is below %s", systemUptime, rules.MinSystemUptime)
+	}
+	if rules.MinAgentUptime > 0 && !(systemUptimeKnown && systemUptime < rules.MinAgentUptime) {
+		agentUptime, err := e.probe.GetServiceUptime(ctx, serviceName)
+		if err != nil {
+			e.unknown("agent uptime", err)
+		} else if agentUptime < rules.MinAgentUptime {
+			refuse("agent uptime %s is below %s", agentUptime, rules.MinAgentUptime)
+		}
+	}
+	if rules.CloudInitDone {
+		status, err := e.probe.GetCloudInitStatus(ctx)
+		switch {
+		case err != nil:
+			e.unknown("cloud-init status", err)
+		case status == "running" || status == "not started":
+			refuse("cloud-init is still running")
+		case status == "error":
+			refuse("cloud-init finished with errors")
+		}
+	}
+	if rules.SystemNotStopping {
+		state, err := e.probe.GetSystemState(ctx)
+		if err != nil {
+			e.unknown("system state", err)
+		} else if state == "stopping" {
+			refuse("system is shutting down")
+		}
+	}
+	if rules.MaxLoadPerCPU > 0 {
+		load, err := e.probe.GetLoadPerCPU(ctx)
+		if err != nil {
+			e.unknown("load average", err)
+		} else if load > rules.MaxLoadPerCPU {
+			refuse("load average per CPU %.2f is above %.2f", load, rules.MaxLoadPerCPU)
+		}
+	}
+	if rules.MaxPressure > 0 {
+		for _, resource := range pressureResources {
+			pressure, err := e.probe.GetPressure(ctx, resource)
+			if err != nil {
+				e.unknown(resource+" pressure", err)
+			} else if pressure > rules.MaxPressure {
+				refuse("%s pressure %.1f%% is above %.1f%%", resource, pressure, rules.MaxPressure)
+			}
+		}
+	}
+	if rules.NoPackageManager {
+		procs, err := e.probe.GetPackageManagerProcesses(ctx)
+		if err != nil {
+			e.unknown("package manager processes", err)
+		} else if len(procs) > 0 {
+			refuse("package manager running: %s", strings.Join(procs, ", "))
+		}
+	}
+
+	if len(reasons) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrRefused, strings.Join(reasons, "; "))
+}
+
+func (e *Engine) unknown(input string, err error) {
+	e.logger.Warn("policy input unavailable, not gating on it", "input", input, "error", err)
+}
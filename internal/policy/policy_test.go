@@ -0,0 +1,140 @@
+package policy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const service = "test-agent"
+
+type fakeProbe struct {
+	systemUptime time.Duration
+	agentUptime  time.Duration
+	cloudInit    string
+	systemState  string
+	loadPerCPU   float64
+	pressure     map[string]float64
+	packageProcs []string
+	err          error
+}
+
+func (f fakeProbe) GetSystemUptime(context.Context) (time.Duration, error) {
+	return f.systemUptime, f.err
+}
+
+func (f fakeProbe) GetServiceUptime(context.Context, string) (time.Duration, error) {
+	return f.agentUptime, f.err
+}
+
+func (f fakeProbe) GetCloudInitStatus(context.Context) (string, error) {
+	return f.cloudInit, f.err
+}
+
+func (f fakeProbe) GetSystemState(context.Context) (string, error) {
+	return f.systemState, f.err
+}
+
+func (f fakeProbe) GetLoadPerCPU(context.Context) (float64, error) {
+	return f.loadPerCPU, f.err
+}
+
+func (f fakeProbe) GetPressure(_ context.Context, resource string) (float64, error) {
+	return f.pressure[resource], f.err
+}
+
+func (f fakeProbe) GetPackageManagerProcesses(context.Context) ([]string, error) {
+	return f.packageProcs, f.err
+}
+
+func newEngine(rules Rules, probe Probe) *Engine {
+	return New(Config{Install: rules}, probe, slog.New(slog.NewTextHandler(io.Discard, nil)))
+}
+
+func TestCheck(t *testing.T) {
+	healthy := fakeProbe{
+		systemUptime: time.Hour,
+		agentUptime:  time.Hour,
+		cloudInit:    "done",
+		systemState:  "running",
+		loadPerCPU:   0.5,
+		pressure:     map[string]float64{"cpu": 1, "io": 2, "memory": 0},
+	}
+	all := Rules{
+		MinSystemUptime:   15 * time.Minute,
+		MinAgentUptime:    15 * time.Minute,
+		CloudInitDone:     true,
+		SystemNotStopping: true,
+		MaxLoadPerCPU:     2,
+		MaxPressure:       20,
+		NoPackageManager:  true,
+	}
+
+	tests := []struct {
+		name   string
+		modify func(*fakeProbe)
+		reason string
+	}{
+		{"all predicates hold", func(*fakeProbe) {}, ""},
+		{"system uptime", func(p *fakeProbe) { p.systemUptime = 10 * time.Minute; p.agentUptime = 10 * time.Minute }, "system uptime 10m0s is below 15m0s"},
+		{"agent uptime", func(p *fakeProbe) { p.systemUptime = 20 * time.Minute; p.agentUptime = 5 * time.Minute }, "agent uptime 5m0s is below 15m0s"},
+		{"agent uptime waived on fresh boot", func(p *fakeProbe) { p.systemUptime = 10 * time.Minute; p.agentUptime = time.Minute }, "system uptime 10m0s is below 15m0s"},
+		{"cloud-init running", func(p *fakeProbe) { p.cloudInit = "running" }, "cloud-init is still running"},
+		{"cloud-init not started", func(p *fakeProbe) { p.cloudInit = "not started" }, "cloud-init is still running"},
+		{"cloud-init failed", func(p *fakeProbe) { p.cloudInit = "error" }, "cloud-init finished with errors"},
+		{"cloud-init done with warnings", func(p *fakeProbe) { p.cloudInit = "degraded done" }, ""},
+		{"cloud-init disabled", func(p *fakeProbe) { p.cloudInit = "disabled" }, ""},
+		{"system stopping", func(p *fakeProbe) { p.systemState = "stopping" }, "system is shutting down"},
+		{"degraded system is not stopping", func(p *fakeProbe) { p.systemState = "degraded" }, ""},
+		{"load", func(p *fakeProbe) { p.loadPerCPU = 3 }, "load average per CPU 3.00 is above 2.00"},
+		{"pressure", func(p *fakeProbe) { p.pressure = map[string]float64{"io": 35.5} }, "io pressure 35.5% is above 20.0%"},
+		{"package manager", func(p *fakeProbe) { p.packageProcs = []string{"apt-get (pid 42)"} }, "package manager running: apt-get (pid 42)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			probe := healthy
+			tt.modify(&probe)
+
+			err := newEngine(all, probe).Check(context.Background(), ActionInstall, service)
+
+			if tt.reason == "" {
+				assert.NoError(t, err)
+				return
+			}
+			require.ErrorIs(t, err, ErrRefused)
+			assert.Equal(t, "refused by policy: "+tt.reason, err.Error())
+		})
+	}
+}
+
+func TestCheck_ReportsEveryReason(t *testing.T) {
+	probe := fakeProbe{systemUptime: time.Minute, cloudInit: "running"}
+	err := newEngine(Rules{MinSystemUptime: time.Hour, CloudInitDone: true}, probe).Check(context.Background(), ActionInstall, service)
+	assert.EqualError(t, err, "refused by policy: system uptime 1m0s is below 1h0m0s; cloud-init is still running")
+}
+
+func TestCheck_UnavailableInputsDoNotGate(t *testing.T) {
+	probe := fakeProbe{err: errors.New("unavailable")}
+	rules := Rules{MinSystemUptime: time.Hour, MinAgentUptime: time.Hour, CloudInitDone: true, SystemNotStopping: true, MaxLoadPerCPU: 1, MaxPressure: 1, NoPackageManager: true}
+	assert.NoError(t, newEngine(rules, probe).Check(context.Background(), ActionInstall, service))
+}
+
+func TestCheck_RulesPerAction(t *testing.T) {
+	probe := fakeProbe{systemUptime: time.Minute, agentUptime: time.Minute}
+	e := New(GetDefaultConfig(), probe, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	assert.ErrorIs(t, e.Check(context.Background(), ActionInstall, service), ErrRefused)
+	assert.NoError(t, e.Check(context.Background(), ActionRestart, service))
+	assert.NoError(t, e.Check(context.Background(), ActionFlagsRestart, service), "agent uptime is waived on a fresh boot")
+}
+
+func TestNilEngineAllowsEverything(t *testing.T) {
+	var e *Engine
+	assert.NoError(t, e.Check(context.Background(), ActionInstall, service))
+}
@@ -0,0 +1,185 @@
+package restartlimit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/nebius/nebius-observability-agent-updater/internal/osutils"
+)
+
+// ErrRestartRefused is wrapped by every error Check returns.
+var ErrRestartRefused = errors.New("restart refused")
+
+// Config bounds how often the updater restarts an agent. MaxRestarts restarts
+// are allowed per Window; zero disables the budget. The agent is considered
+// crash-looping when systemd has automatically restarted it at least
+// CrashLoopRestarts times since it was last started explicitly (NRestarts) and
+// its current process is younger than CrashLoopMaxUptime; zero
+// CrashLoopRestarts disables the check.
+type Config struct {
+	MaxRestarts        int           `yaml:"max_restarts"`
+	Window             time.Duration `yaml:"window"`
+	CrashLoopRestarts  int           `yaml:"crash_loop_restarts"`
+	CrashLoopMaxUptime time.Duration `yaml:"crash_loop_max_uptime"`
+}
+
+func GetDefaultConfig() Config {
+	return Config{
+		MaxRestarts:        6,
+		Window:             time.Hour,
+		CrashLoopRestarts:  3,
+		CrashLoopMaxUptime: 5 * time.Minute,
+	}
+}
+
+type serviceInfo interface {
+	GetServiceUptime(ctx context.Context, serviceName string) (time.Duration, error)
+	GetServiceRestartCount(ctx context.Context, serviceName string) (int, error)
+}
+
+// stateIOTimeout bounds reads and writes of the persisted restart history.
+const stateIOTimeout = 5 * time.Second
+
+// Limiter tracks restarts per service. The history is persisted in the state
+// directory so the budget survives updater restarts; with an empty state dir
+// it is kept in memory only. A nil *Limiter allows every restart.
+type Limiter struct {
+	cfg       Config
+	stateDir  string
+	si        serviceInfo
+	logger    *slog.Logger
+	fileGuard *osutils.FileGuard
+
+	mu      sync.Mutex
+	history map[string][]time.Time
+}
+
+func New(cfg Config, stateDir string, si serviceInfo, logger *slog.Logger, fileGuard *osutils.FileGuard) *Limiter {
+	return &Limiter{
+		cfg:       cfg,
+		stateDir:  stateDir,
+		si:        si,
+		logger:    logger,
+		fileGuard: fileGuard,
+		history:   make(map[string][]time.Time),
+	}
+}
+
+// Check returns nil if serviceName may be restarted now, or an error wrapping
+// ErrRestartRefused that says why not.
+func (l *Limiter) Check(ctx context.Context, serviceName string) error {
+	if l == nil {
+		return nil
+	}
+	if err := l.checkCrashLoop(ctx, serviceName); err != nil {
+		return err
+	}
+	if l.cfg.MaxRestarts <= 0 {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	recent := l.recentLocked(serviceName, time.Now())
+	if len(recent) >= l.cfg.MaxRestarts {
+		retryAt := recent[0].Add(l.cfg.Window)
+		return fmt.Errorf("%w: budget of %d restarts per %s exhausted, next restart allowed after %s",
+			ErrRestartRefused, l.cfg.MaxRestarts, l.cfg.Window, retryAt.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+func (l *Limiter) checkCrashLoop(ctx context.Context, serviceName string) error {
+	if l.cfg.CrashLoopRestarts <= 0 {
+		return nil
+	}
+	uptime, err := l.si.GetServiceUptime(ctx, serviceName)
+	if err != nil || uptime >= l.cfg.CrashLoopMaxUptime {
+		return nil
+	}
+	restarts, err := l.si.GetServiceRestartCount(ctx, serviceName)
+	if err != nil {
+		l.logger.Warn("failed to get service restart count", "error", err, "service", serviceName)
+		return nil
+	}
+	if restarts >= l.cfg.CrashLoopRestarts {
+		return fmt.Errorf("%w: %s is crash-looping (%d automatic restarts by systemd, current uptime %s)",
+			ErrRestartRefused, serviceName, restarts, uptime)
+	}
+	return nil
+}
+
+// Record counts a restart attempt made at the given time against the budget.
+func (l *Limiter) Record(serviceName string, at time.Time) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	recent := append(l.recentLocked(serviceName, at), at)
+	l.history[serviceName] = recent
+	l.persistLocked(serviceName, recent)
+}
+
+// recentLocked returns the restarts of serviceName within the window ending
+// at now, loading the persisted history on first use.
+func (l *Limiter) recentLocked(serviceName string, now time.Time) []time.Time {
+	all, loaded := l.history[serviceName]
+	if !loaded {
+		all = l.load(serviceName)
+	}
+	recent := make([]time.Time, 0, len(all))
+	for _, t := range all {
+		if l.cfg.Window <= 0 || now.Sub(t) < l.cfg.Window {
+			recent = append(recent, t)
+		}
+	}
+	l.history[serviceName] = recent
+	return recent
+}
+
+func (l *Limiter) statePath(serviceName string) string {
+	return filepath.Join(l.stateDir, serviceName+".restarts")
+}
+
+func (l *Limiter) load(serviceName string) []time.Time {
+	if l.stateDir == "" {
+		return nil
+	}
+	path := l.statePath(serviceName)
+	content, err := l.fileGuard.ReadFile(path, stateIOTimeout)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			l.logger.Error("failed to read restart history", "error", err, "path", path)
+		}
+		return nil
+	}
+	var history []time.Time
+	if err := json.Unmarshal(content, &history); err != nil {
+		l.logger.Warn("ignoring malformed restart history", "error", err, "path", path)
+		return nil
+	}
+	return history
+}
+
+func (l *Limiter) persistLocked(serviceName string, history []time.Time) {
+	if l.stateDir == "" {
+		return
+	}
+	path := l.statePath(serviceName)
+	content, err := json.Marshal(history)
+	if err != nil {
+		l.logger.Warn("failed to encode restart history", "error", err)
+		return
+	}
+	if err := l.fileGuard.WriteFileAtomic(path, content, 0640, stateIOTimeout); err != nil {
+		l.logger.Warn("failed to persist restart history", "error", err, "path", path)
+	}
+}
@@ -0,0 +1,103 @@
+package restartlimit
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nebius/nebius-observability-agent-updater/internal/osutils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const service = "test-agent"
+
+type fakeServiceInfo struct {
+	uptime   time.Duration
+	restarts int
+	err      error
+}
+
+func (f fakeServiceInfo) GetServiceUptime(context.Context, string) (time.Duration, error) {
+	return f.uptime, nil
+}
+
+func (f fakeServiceInfo) GetServiceRestartCount(context.Context, string) (int, error) {
+	return f.restarts, f.err
+}
+
+func newLimiter(cfg Config, stateDir string, si serviceInfo) *Limiter {
+	return New(cfg, stateDir, si, slog.New(slog.NewTextHandler(io.Discard, nil)), osutils.NewFileGuard(osutils.DefaultMaxPendingFileOps))
+}
+
+func TestBudget(t *testing.T) {
+	l := newLimiter(Config{MaxRestarts: 2, Window: time.Hour}, t.TempDir(), nil)
+
+	assert.NoError(t, l.Check(context.Background(), service))
+	l.Record(service, time.Now())
+	assert.NoError(t, l.Check(context.Background(), service))
+	l.Record(service, time.Now())
+
+	err := l.Check(context.Background(), service)
+	assert.ErrorIs(t, err, ErrRestartRefused)
+	assert.Contains(t, err.Error(), "budget of 2 restarts per 1h0m0s exhausted")
+	assert.NoError(t, l.Check(context.Background(), "other-agent"), "budget is per service")
+}
+
+func TestBudget_OldRestartsExpire(t *testing.T) {
+	l := newLimiter(Config{MaxRestarts: 1, Window: time.Hour}, t.TempDir(), nil)
+	l.Record(service, time.Now().Add(-2*time.Hour))
+	assert.NoError(t, l.Check(context.Background(), service))
+}
+
+func TestBudget_PersistsAcrossRestart(t *testing.T) {
+	stateDir := t.TempDir()
+	cfg := Config{MaxRestarts: 1, Window: time.Hour}
+	newLimiter(cfg, stateDir, nil).Record(service, time.Now())
+
+	reloaded := newLimiter(cfg, stateDir, nil)
+	assert.ErrorIs(t, reloaded.Check(context.Background(), service), ErrRestartRefused)
+}
+
+func TestBudget_MalformedStateIsIgnored(t *testing.T) {
+	stateDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(stateDir, service+".restarts"), []byte("garbage"), 0640))
+	l := newLimiter(Config{MaxRestarts: 1, Window: time.Hour}, stateDir, nil)
+	assert.NoError(t, l.Check(context.Background(), service))
+}
+
+func TestCrashLoop(t *testing.T) {
+	cfg := Config{CrashLoopRestarts: 3, CrashLoopMaxUptime: 5 * time.Minute}
+	tests := []struct {
+		name    string
+		si      fakeServiceInfo
+		refused bool
+	}{
+		{"young process with many restarts", fakeServiceInfo{uptime: time.Minute, restarts: 3}, true},
+		{"young process with few restarts", fakeServiceInfo{uptime: time.Minute, restarts: 2}, false},
+		{"stable process with many restarts", fakeServiceInfo{uptime: time.Hour, restarts: 10}, false},
+		{"restart count unavailable", fakeServiceInfo{uptime: time.Minute, err: errors.New("boom")}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := newLimiter(cfg, "", tt.si).Check(context.Background(), service)
+			if tt.refused {
+				assert.ErrorIs(t, err, ErrRestartRefused)
+				assert.Contains(t, err.Error(), "crash-looping")
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestNilLimiterAllows(t *testing.T) {
+	var l *Limiter
+	assert.NoError(t, l.Check(context.Background(), service))
+	l.Record(service, time.Now())
+}
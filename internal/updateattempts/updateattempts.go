@@ -0,0 +1,222 @@
+package updateattempts
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/nebius/nebius-observability-agent-updater/internal/osutils"
+)
+
+var (
+	// ErrBackoff is wrapped by Check errors for a version whose next attempt
+	// is not due yet.
+	ErrBackoff = errors.New("update backing off")
+	// ErrQuarantined is wrapped by Check errors for a version that failed
+	// too often to be attempted again.
+	ErrQuarantined = errors.New("version quarantined")
+)
+
+// Config bounds how often a failing update is retried. After a failed attempt
+// at a version the next one waits InitialBackoff, doubling with every further
+// failure up to MaxBackoff. After MaxFailures failures the version is
+// quarantined: it is not attempted again until the server asks for a
+// different version. Zero MaxFailures disables the quarantine and zero
+// InitialBackoff the backoff.
+type Config struct {
+	MaxFailures    int           `yaml:"max_failures"`
+	InitialBackoff time.Duration `yaml:"initial_backoff"`
+	MaxBackoff     time.Duration `yaml:"max_backoff"`
+}
+
+func GetDefaultConfig() Config {
+	return Config{
+		MaxFailures:    5,
+		InitialBackoff: 5 * time.Minute,
+		MaxBackoff:     4 * time.Hour,
+	}
+}
+
+// stateIOTimeout bounds reads and writes of the persisted attempts.
+const stateIOTimeout = 5 * time.Second
+
+// record holds the failed attempts at the version last asked for.
+type record struct {
+	Version     string    `json:"version"`
+	Failures    int       `json:"failures"`
+	LastFailure time.Time `json:"last_failure"`
+	LastError   string    `json:"last_error"`
+}
+
+// Tracker tracks failed update attempts per service. Only the version the
+// server currently asks for is tracked; asking for another version starts
+// over. The attempts are persisted in the state directory so backoff and
+// quarantine survive updater restarts; with an empty state dir they are kept
+// in memory only. A nil *Tracker allows every attempt.
+type Tracker struct {
+	cfg       Config
+	stateDir  string
+	logger    *slog.Logger
+	fileGuard *osutils.FileGuard
+
+	mu      sync.Mutex
+	records map[string]*record
+}
+
+func New(cfg Config, stateDir string, logger *slog.Logger, fileGuard *osutils.FileGuard) *Tracker {
+	return &Tracker{
+		cfg:       cfg,
+		stateDir:  stateDir,
+		logger:    logger,
+		fileGuard: fileGuard,
+		records:   make(map[string]*record),
+	}
+}
+
+// Check returns nil if serviceName may be updated to version now, or an error
+// wrapping ErrBackoff or ErrQuarantined that says why not.
+func (t *Tracker) Check(serviceName, version string) error {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	r := t.recordLocked(serviceName)
+	if r == nil {
+		return nil
+	}
+	if r.Version != version {
+		t.logger.Info("update target changed, forgetting failed attempts",
+			"service", serviceName, "version", version, "failed_version", r.Version, "failures", r.Failures)
+		t.clearLocked(serviceName)
+		return nil
+	}
+	if t.cfg.MaxFailures > 0 && r.Failures >= t.cfg.MaxFailures {
+		return fmt.Errorf("%w: update to %s failed %d times, not retrying until a different version is requested; last error: %s",
+			ErrQuarantined, version, r.Failures, r.LastError)
+	}
+	if next := r.LastFailure.Add(t.backoff(r.Failures)); time.Now().Before(next) {
+		return fmt.Errorf("%w: update to %s failed %d times, next attempt after %s",
+			ErrBackoff, version, r.Failures, next.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+// RecordFailure counts a failed attempt at version made at the given time.
+func (t *Tracker) RecordFailure(serviceName, version string, at time.Time, cause error) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	r := t.recordLocked(serviceName)
+	if r == nil || r.Version != version {
+		r = &record{Version: version}
+	}
+	r.Failures++
+	r.LastFailure = at
+	r.LastError = cause.Error()
+	t.records[serviceName] = r
+	t.persistLocked(serviceName, r)
+}
+
+// RecordSuccess forgets the failed attempts of serviceName.
+func (t *Tracker) RecordSuccess(serviceName string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.recordLocked(serviceName) != nil {
+		t.clearLocked(serviceName)
+	}
+}
+
+// backoff returns the wait after the given number of failures.
+func (t *Tracker) backoff(failures int) time.Duration {
+	if t.cfg.InitialBackoff <= 0 || failures <= 0 {
+		return 0
+	}
+	d := t.cfg.InitialBackoff
+	for i := 1; i < failures && d < math.MaxInt64/2; i++ {
+		d *= 2
+	}
+	if t.cfg.MaxBackoff > 0 {
+		d = min(d, t.cfg.MaxBackoff)
+	}
+	return d
+}
+
+// recordLocked returns the record of serviceName, loading the persisted one
+// on first use, or nil if there is none.
+func (t *Tracker) recordLocked(serviceName string) *record {
+	r, loaded := t.records[serviceName]
+	if !loaded {
+		r = t.load(serviceName)
+		t.records[serviceName] = r
+	}
+	return r
+}
+
+func (t *Tracker) clearLocked(serviceName string) {
+	t.records[serviceName] = nil
+	if t.stateDir == "" {
+		return
+	}
+	path := t.statePath(serviceName)
+	err := t.fileGuard.Run(path, stateIOTimeout, func() error {
+		err := os.Remove(path)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		t.logger.Warn("failed to remove update attempts", "error", err, "path", path)
+	}
+}
+
+func (t *Tracker) statePath(serviceName string) string {
+	return filepath.Join(t.stateDir, serviceName+".update-attempts")
+}
+
+func (t *Tracker) load(serviceName string) *record {
+	if t.stateDir == "" {
+		return nil
+	}
+	path := t.statePath(serviceName)
+	content, err := t.fileGuard.ReadFile(path, stateIOTimeout)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			t.logger.Error("failed to read update attempts", "error", err, "path", path)
+		}
+		return nil
+	}
+	var r record
+	if err := json.Unmarshal(content, &r); err != nil {
+		t.logger.Warn("ignoring malformed update attempts", "error", err, "path", path)
+		return nil
+	}
+	return &r
+}
+
+func (t *Tracker) persistLocked(serviceName string, r *record) {
+	if t.stateDir == "" {
+		return
+	}
+	path := t.statePath(serviceName)
+	content, err := json.Marshal(r)
+	if err != nil {
+		t.logger.Warn("failed to encode update attempts", "error", err)
+		return
+	}
+	if err := t.fileGuard.WriteFileAtomic(path, content, 0640, stateIOTimeout); err != nil {
+		t.logger.Warn("failed to persist update attempts", "error", err, "path", path)
+	}
+}
@@ -0,0 +1,97 @@
+package updateattempts
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nebius/nebius-observability-agent-updater/internal/osutils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const service = "test-agent"
+
+var errInstall = errors.New("apt-get failed")
+
+func newTracker(cfg Config, stateDir string) *Tracker {
+	return New(cfg, stateDir, slog.New(slog.NewTextHandler(io.Discard, nil)), osutils.NewFileGuard(osutils.DefaultMaxPendingFileOps))
+}
+
+func TestBackoff(t *testing.T) {
+	tr := newTracker(Config{InitialBackoff: time.Hour}, t.TempDir())
+	assert.NoError(t, tr.Check(service, "1.0.0"))
+
+	tr.RecordFailure(service, "1.0.0", time.Now(), errInstall)
+	err := tr.Check(service, "1.0.0")
+	assert.ErrorIs(t, err, ErrBackoff)
+	assert.Contains(t, err.Error(), "update to 1.0.0 failed 1 times")
+
+	tr.RecordFailure(service, "1.0.0", time.Now().Add(-3*time.Hour), errInstall)
+	assert.NoError(t, tr.Check(service, "1.0.0"), "two hour backoff after two failures has passed")
+	tr.RecordFailure(service, "1.0.0", time.Now().Add(-3*time.Hour), errInstall)
+	assert.ErrorIs(t, tr.Check(service, "1.0.0"), ErrBackoff, "backoff doubles to four hours after three failures")
+
+	assert.NoError(t, tr.Check("other-agent", "1.0.0"), "attempts are per service")
+}
+
+func TestBackoffDuration(t *testing.T) {
+	tr := newTracker(Config{InitialBackoff: time.Minute, MaxBackoff: 10 * time.Minute}, "")
+	assert.Equal(t, time.Duration(0), tr.backoff(0))
+	assert.Equal(t, time.Minute, tr.backoff(1))
+	assert.Equal(t, 4*time.Minute, tr.backoff(3))
+	assert.Equal(t, 10*time.Minute, tr.backoff(5))
+	assert.Equal(t, 10*time.Minute, tr.backoff(1000))
+}
+
+func TestQuarantine(t *testing.T) {
+	tr := newTracker(Config{MaxFailures: 2}, t.TempDir())
+	tr.RecordFailure(service, "1.0.0", time.Now(), errInstall)
+	assert.NoError(t, tr.Check(service, "1.0.0"))
+	tr.RecordFailure(service, "1.0.0", time.Now(), errInstall)
+
+	err := tr.Check(service, "1.0.0")
+	assert.ErrorIs(t, err, ErrQuarantined)
+	assert.Contains(t, err.Error(), "last error: apt-get failed")
+
+	assert.NoError(t, tr.Check(service, "1.0.1"), "a different version is attempted")
+	assert.NoError(t, tr.Check(service, "1.0.0"), "the failures of the old version were forgotten")
+}
+
+func TestRecordSuccessClears(t *testing.T) {
+	stateDir := t.TempDir()
+	tr := newTracker(Config{MaxFailures: 1}, stateDir)
+	tr.RecordFailure(service, "1.0.0", time.Now(), errInstall)
+	require.FileExists(t, filepath.Join(stateDir, service+".update-attempts"))
+
+	tr.RecordSuccess(service)
+
+	assert.NoError(t, tr.Check(service, "1.0.0"))
+	assert.NoFileExists(t, filepath.Join(stateDir, service+".update-attempts"))
+}
+
+func TestPersistsAcrossRestart(t *testing.T) {
+	stateDir := t.TempDir()
+	cfg := Config{MaxFailures: 1}
+	newTracker(cfg, stateDir).RecordFailure(service, "1.0.0", time.Now(), errInstall)
+
+	assert.ErrorIs(t, newTracker(cfg, stateDir).Check(service, "1.0.0"), ErrQuarantined)
+}
+
+func TestMalformedStateIgnored(t *testing.T) {
+	stateDir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(stateDir, service+".update-attempts"), []byte("{not json"), 0640))
+
+	assert.NoError(t, newTracker(Config{MaxFailures: 1}, stateDir).Check(service, "1.0.0"))
+}
+
+func TestNilTrackerAllowsEverything(t *testing.T) {
+	var tr *Tracker
+	tr.RecordFailure(service, "1.0.0", time.Now(), errInstall)
+	tr.RecordSuccess(service)
+	assert.NoError(t, tr.Check(service, "1.0.0"))
+}
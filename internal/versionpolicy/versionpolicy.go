@@ -0,0 +1,222 @@
+package versionpolicy
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/nebius/nebius-observability-agent-updater/internal/osutils"
+	"gopkg.in/yaml.v3"
+)
+
+// ErrRejected is wrapped by every error Check returns for a version the
+// policy does not accept.
+var ErrRejected = errors.New("rejected by local version policy")
+
+// ioTimeout bounds the policy file read so an unresponsive disk cannot hang
+// the poll loop.
+const ioTimeout = 5 * time.Second
+
+// Policy restricts the versions the updater installs on this node, so a node's
+// agent can be frozen regardless of what the server asks for. It is read from
+// a YAML file next to the updater config:
+//
+//	allow_downgrade: false
+//	packages:
+//	  nebius-observability-agent:
+//	    pin: "0.2.150"
+//	    allowed: [">= 0.2.100, << 0.3"]
+//	    allow_downgrade: true
+//
+// A pinned package is only installed at the pinned version, which may be a
+// downgrade. Otherwise a version must satisfy one of the allowed ranges, if
+// any are listed, and must not be older than the installed version unless
+// downgrades are allowed for the package or globally.
+type Policy struct {
+	AllowDowngrade bool            `yaml:"allow_downgrade"`
+	Packages       map[string]Rule `yaml:"packages"`
+}
+
+// Rule is the policy for one Debian package.
+type Rule struct {
+	Pin            DebVersion `yaml:"pin"`
+	Allowed        []Range    `yaml:"allowed"`
+	AllowDowngrade bool       `yaml:"allow_downgrade"`
+}
+
+// Load reads the policy at path. A missing file yields the default policy,
+// which only refuses downgrades.
+func Load(fileGuard *osutils.FileGuard, path string) (*Policy, error) {
+	p := &Policy{}
+	if path == "" {
+		return p, nil
+	}
+	content, err := fileGuard.ReadFile(path, ioTimeout)
+	if os.IsNotExist(err) {
+		return p, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read version policy: %w", err)
+	}
+	if err := yaml.Unmarshal(content, p); err != nil {
+		return nil, fmt.Errorf("failed to parse version policy %s: %w", path, err)
+	}
+	return p, nil
+}
+
+// Check returns nil if pkg may be installed at target while installed is the
+// current version (empty if unknown), or an error wrapping ErrRejected that
+// says why not.
+func (p *Policy) Check(pkg, target, installed string) error {
+	targetVersion, err := osutils.ParseDebVersion(target)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrRejected, err)
+	}
+	rule := p.Packages[pkg]
+	if rule.Pin.set() {
+		if targetVersion.Compare(rule.Pin.v) != 0 {
+			return fmt.Errorf("%w: %s is pinned to %s", ErrRejected, pkg, rule.Pin)
+		}
+		return nil
+	}
+	if len(rule.Allowed) > 0 && !anyContains(rule.Allowed, targetVersion) {
+		ranges := make([]string, len(rule.Allowed))
+		for i, r := range rule.Allowed {
+			ranges[i] = r.String()
+		}
+		return fmt.Errorf("%w: %s %s is outside the allowed ranges %s", ErrRejected, pkg, target, strings.Join(ranges, " | "))
+	}
+	if installed == "" || rule.AllowDowngrade || p.AllowDowngrade {
+		return nil
+	}
+	installedVersion, err := osutils.ParseDebVersion(installed)
+	if err != nil {
+		return nil
+	}
+	if targetVersion.Compare(installedVersion) < 0 {
+		return fmt.Errorf("%w: %s %s would downgrade from %s", ErrRejected, pkg, target, installed)
+	}
+	return nil
+}
+
+func anyContains(ranges []Range, v osutils.DebVersion) bool {
+	for _, r := range ranges {
+		if r.Contains(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// DebVersion is a Debian version validated when the policy is parsed.
+type DebVersion struct {
+	v osutils.DebVersion
+}
+
+func (d DebVersion) set() bool {
+	return d.v.Upstream != ""
+}
+
+func (d DebVersion) String() string {
+	return d.v.String()
+}
+
+func (d *DebVersion) UnmarshalYAML(value *yaml.Node) error {
+	var s string
+	if err := value.Decode(&s); err != nil {
+		return err
+	}
+	v, err := osutils.ParseDebVersion(s)
+	if err != nil {
+		return err
+	}
+	d.v = v
+	return nil
+}
+
+// Range is a comma-separated list of Debian version relations that must all
+// hold, e.g. ">= 1.2, << 2.0". The relations are those of package
+// dependencies: <<, <=, =, >= and >>.
+type Range struct {
+	text      string
+	relations []relation
+}
+
+type relation struct {
+	op      string
+	version osutils.DebVersion
+}
+
+// ParseRange parses a range such as ">= 1.2, << 2.0".
+func ParseRange(s string) (Range, error) {
+	r := Range{text: strings.TrimSpace(s)}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		op := relationOp(part)
+		if op == "" {
+			return Range{}, fmt.Errorf("invalid version range %q: relation must be one of <<, <=, =, >=, >>", s)
+		}
+		v, err := osutils.ParseDebVersion(strings.TrimSpace(part[len(op):]))
+		if err != nil {
+			return Range{}, fmt.Errorf("invalid version range %q: %w", s, err)
+		}
+		r.relations = append(r.relations, relation{op: op, version: v})
+	}
+	return r, nil
+}
+
+// relationOp returns the relation operator s starts with, or "" if none.
+func relationOp(s string) string {
+	for _, op := range []string{"<<", "<=", ">=", ">>"} {
+		if strings.HasPrefix(s, op) {
+			return op
+		}
+	}
+	if strings.HasPrefix(s, "=") {
+		return "="
+	}
+	return ""
+}
+
+// Contains reports whether v satisfies every relation of r.
+func (r Range) Contains(v osutils.DebVersion) bool {
+	for _, rel := range r.relations {
+		c := v.Compare(rel.version)
+		var ok bool
+		switch rel.op {
+		case "<<":
+			ok = c < 0
+		case "<=":
+			ok = c <= 0
+		case "=":
+			ok = c == 0
+		case ">=":
+			ok = c >= 0
+		case ">>":
+			ok = c > 0
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (r Range) String() string {
+	return r.text
+}
+
+func (r *Range) UnmarshalYAML(value *yaml.Node) error {
+	var s string
+	if err := value.Decode(&s); err != nil {
+		return err
+	}
+	parsed, err := ParseRange(s)
+	if err != nil {
+		return err
+	}
+	*r = parsed
+	return nil
+}
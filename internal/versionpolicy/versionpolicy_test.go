@@ -0,0 +1,87 @@
+package versionpolicy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nebius/nebius-observability-agent-updater/internal/osutils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+const pkg = "nebius-observability-agent"
+
+func mustParse(t *testing.T, doc string) *Policy {
+	t.Helper()
+	p := &Policy{}
+	require.NoError(t, yaml.Unmarshal([]byte(doc), p))
+	return p
+}
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		name      string
+		doc       string
+		target    string
+		installed string
+		reason    string
+	}{
+		{"no policy allows upgrades", "", "1.1", "1.0", ""},
+		{"no policy refuses downgrades", "", "1.0", "1.1", "nebius-observability-agent 1.0 would downgrade from 1.1"},
+		{"unknown installed version", "", "1.0", "", ""},
+		{"global downgrade allowance", "allow_downgrade: true", "1.0", "1.1", ""},
+		{"package downgrade allowance", "packages: {nebius-observability-agent: {allow_downgrade: true}}", "1.0", "1.1", ""},
+		{"other package rule does not apply", "packages: {other: {allow_downgrade: true}}", "1.0", "1.1", "nebius-observability-agent 1.0 would downgrade from 1.1"},
+		{"pinned version", "packages: {nebius-observability-agent: {pin: '1:1.0-1'}}", "1:1.0-1", "1:2.0", ""},
+		{"pin refuses others", "packages: {nebius-observability-agent: {pin: '1:1.0-1'}}", "1:1.1", "1:1.0-1", "nebius-observability-agent is pinned to 1:1.0-1"},
+		{"inside range", "packages: {nebius-observability-agent: {allowed: ['>= 0.2.100, << 0.3']}}", "0.2.150", "0.2.100", ""},
+		{"tilde below range end", "packages: {nebius-observability-agent: {allowed: ['>= 0.2.100, << 0.3']}}", "0.3~rc1", "0.2.150", ""},
+		{"outside range", "packages: {nebius-observability-agent: {allowed: ['>= 0.2.100, << 0.3', '= 0.1.5']}}", "0.3.0", "0.2.150",
+			"nebius-observability-agent 0.3.0 is outside the allowed ranges >= 0.2.100, << 0.3 | = 0.1.5"},
+		{"second range", "packages: {nebius-observability-agent: {allowed: ['>= 0.2.100, << 0.3', '= 0.1.5'], allow_downgrade: true}}", "0.1.5", "0.2.150", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := mustParse(t, tt.doc).Check(pkg, tt.target, tt.installed)
+			if tt.reason == "" {
+				assert.NoError(t, err)
+				return
+			}
+			require.ErrorIs(t, err, ErrRejected)
+			assert.Equal(t, "rejected by local version policy: "+tt.reason, err.Error())
+		})
+	}
+}
+
+func TestUnmarshal_InvalidValues(t *testing.T) {
+	for _, doc := range []string{
+		"packages: {a: {pin: 'x:1'}}",
+		"packages: {a: {allowed: ['> 1.0']}}",
+		"packages: {a: {allowed: ['>= 1.0, 2.0']}}",
+		"packages: {a: {allowed: ['>= ']}}",
+	} {
+		var p Policy
+		assert.Error(t, yaml.Unmarshal([]byte(doc), &p), doc)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	fileGuard := osutils.NewFileGuard(osutils.DefaultMaxPendingFileOps)
+	dir := t.TempDir()
+
+	p, err := Load(fileGuard, filepath.Join(dir, "missing.yaml"))
+	require.NoError(t, err)
+	assert.ErrorIs(t, p.Check(pkg, "1.0", "2.0"), ErrRejected, "downgrades are refused without a policy file")
+
+	path := filepath.Join(dir, "version-policy.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("packages:\n  nebius-observability-agent:\n    pin: \"1.0\"\n"), 0640))
+	p, err = Load(fileGuard, path)
+	require.NoError(t, err)
+	assert.NoError(t, p.Check(pkg, "1.0", "2.0"))
+
+	require.NoError(t, os.WriteFile(path, []byte("packages: [\n"), 0640))
+	_, err = Load(fileGuard, path)
+	assert.Error(t, err)
+}
@@ -311,6 +311,8 @@ grpc:
   insecure: true
   timeout: 5s
 update_repo_script_path: /usr/local/bin/fake-update-repo.sh
+restart_limit:
+  max_restarts: 0
 `
 	writeCmd := fmt.Sprintf("cat > /etc/nebius-observability-agent-updater/config.yaml << 'TESTEOF'\n%sTESTEOF", configContent)
 	cmd := exec.CommandContext(context.Background(), "docker", "exec", s.containerID, "sh", "-c", writeCmd)